@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/idaaser/syncdemov1/server"
+)
+
+// 默认的client registry文件
+const clientFile = "./clients.json"
+
+const clientUsage = `usage: client <command> [flags]
+
+commands:
+  add      register a new client, print its client_secret
+  disable  disable a client, its tokens are rejected immediately
+  enable   enable a disabled client
+  rotate   generate a new client_secret, print it
+  list     list clients (without secrets)
+`
+
+// client 管理client registry文件中的client. client_secret只在创建或轮换时输出一次, 文件中只保存其hash.
+// 返回进程退出码: 0 成功, 1 操作失败, 2 参数错误
+func client(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, clientUsage)
+		return 2
+	}
+
+	cmd := args[0]
+	fs := flag.NewFlagSet("client "+cmd, flag.ContinueOnError)
+	file := fs.String("registry", clientFile, "client registry file")
+	id := fs.String("id", "", "client_id, generated when adding a client without -id")
+	name := fs.String("name", "", "client name (add)")
+	scope := fs.String("scope", "", "space-delimited scopes the client may request (add), default: read scopes")
+	expires := fs.String("expires", "", "expiry date YYYY-MM-DD (add)")
+	method := fs.String("auth-method", server.AuthMethodClientSecretPost,
+		"client_secret_post, private_key_jwt or tls_client_auth (add)")
+	jwks := fs.String("jwks", "", "JWK Set file with the client's public keys (add, private_key_jwt)")
+	tlsSubject := fs.String("tls-subject", "", "certificate subject DN, e.g. CN=hr-sync,O=Example (add, tls_client_auth)")
+	tlsSAN := fs.String("tls-san", "", "certificate SAN: DNS name, email, URI or IP (add, tls_client_auth)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if cmd != "add" && cmd != "list" && *id == "" {
+		fmt.Fprintln(os.Stderr, "missing -id")
+		return 2
+	}
+
+	registry, err := server.NewFileClientRegistry(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch cmd {
+	case "add":
+		var expiresAt *time.Time
+		if *expires != "" {
+			t, err := time.ParseInLocation(time.DateOnly, *expires, time.Local)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid -expires:", err)
+				return 2
+			}
+			expiresAt = &t
+		}
+		c := &server.Client{
+			ID: *id, Name: *name, Enabled: true, Scopes: strings.Fields(*scope), ExpiresAt: expiresAt,
+			TLSSubjectDN: *tlsSubject, TLSSAN: *tlsSAN,
+		}
+		if *method != server.AuthMethodClientSecretPost {
+			c.AuthMethod = *method
+		}
+		if *jwks != "" {
+			if c.JWKS, err = os.ReadFile(*jwks); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		err = addClient(ctx, registry, c)
+	case "disable", "enable":
+		err = updateClient(ctx, registry, *id, func(c *server.Client) error {
+			c.Enabled = cmd == "enable"
+			return nil
+		})
+	case "rotate":
+		err = rotateSecret(ctx, registry, *id)
+	case "list":
+		err = listClients(ctx, registry)
+	default:
+		fmt.Fprint(os.Stderr, clientUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func addClient(ctx context.Context, registry server.ClientRegistry, c *server.Client) error {
+	if c.ID == "" {
+		id, err := server.GenerateSecret()
+		if err != nil {
+			return err
+		}
+		c.ID = "client_" + id[:16]
+	}
+	if _, err := registry.GetClient(ctx, c.ID); !errors.Is(err, server.ErrClientNotFound) {
+		if err == nil {
+			err = fmt.Errorf("client %q already exists", c.ID)
+		}
+		return err
+	}
+
+	switch c.AuthMethod {
+	case "":
+	case server.AuthMethodPrivateKeyJWT:
+		if len(c.JWKS) == 0 {
+			return errors.New("private_key_jwt requires -jwks")
+		}
+	case server.AuthMethodTLSClientAuth:
+		if c.TLSSubjectDN == "" && c.TLSSAN == "" {
+			return errors.New("tls_client_auth requires -tls-subject or -tls-san")
+		}
+	default:
+		return fmt.Errorf("unsupported -auth-method %q", c.AuthMethod)
+	}
+
+	c.CreatedAt = time.Now().Truncate(time.Second)
+	var secret string
+	if c.AuthMethod == "" {
+		var err error
+		if secret, err = setNewSecret(c); err != nil {
+			return err
+		}
+	}
+	if err := registry.SaveClient(ctx, c); err != nil {
+		return err
+	}
+	fmt.Println("client_id:", c.ID)
+	if secret != "" {
+		fmt.Println("client_secret:", secret)
+	}
+	return nil
+}
+
+// rotateSecret 生成新的client_secret, 之前的client_secret随即失效
+func rotateSecret(ctx context.Context, registry server.ClientRegistry, id string) error {
+	var secret string
+	if err := updateClient(ctx, registry, id, func(c *server.Client) (err error) {
+		if c.AuthMethod != "" && c.AuthMethod != server.AuthMethodClientSecretPost {
+			return fmt.Errorf("client %q authenticates with %s, not a client_secret", id, c.AuthMethod)
+		}
+		secret, err = setNewSecret(c)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Println("client_secret:", secret)
+	return nil
+}
+
+func updateClient(ctx context.Context, registry server.ClientRegistry, id string, update func(*server.Client) error) error {
+	current, err := registry.GetClient(ctx, id)
+	if err != nil {
+		return err
+	}
+	c := *current
+	if err := update(&c); err != nil {
+		return err
+	}
+	return registry.SaveClient(ctx, &c)
+}
+
+// setNewSecret 为client生成新的client_secret, 返回明文
+func setNewSecret(c *server.Client) (string, error) {
+	secret, err := server.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	if c.SecretHash, err = server.HashSecret(secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func listClients(ctx context.Context, registry server.ClientRegistry) error {
+	clients, err := registry.ListClients(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tAUTH\tENABLED\tCREATED\tEXPIRES\tSCOPES")
+	for _, c := range clients {
+		expires := "-"
+		if c.ExpiresAt != nil {
+			expires = c.ExpiresAt.Format(time.DateOnly)
+		}
+		method := c.AuthMethod
+		if method == "" {
+			method = server.AuthMethodClientSecretPost
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\n", c.ID, c.Name, method, c.Enabled,
+			c.CreatedAt.Format(time.DateOnly), expires, strings.Join(c.Scopes, " "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/idaaser/syncdemov1/server"
+)
+
+// export 把通讯录文件导出为单个bundle文件, bundle的格式根据输出文件的扩展名判断.
+// 返回进程退出码: 0 导出成功, 2 文件无法加载, 导出失败或参数错误
+func export(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dept := fs.String("dept", deptFile, "departments file")
+	user := fs.String("user", userFile, "users file")
+	group := fs.String("group", groupFile, "groups file")
+	groupMembers := fs.String("group-users", groupMemberFile, "group memberships file")
+	bundle := fs.String("bundle", "", "read from this bundle instead of the 4 files")
+	out := fs.String("o", "", "output bundle: .json, .yaml, .json.gz, .zip, .tar or .tar.gz")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "missing -o")
+		fs.Usage()
+		return 2
+	}
+
+	var store server.ContactStore
+	var err error
+	if *bundle != "" {
+		store, err = server.NewContactBundleStore(*bundle, server.WithReloadInterval(0))
+	} else {
+		store, err = server.NewContactFileStore(*dept, *user, *group, *groupMembers, server.WithReloadInterval(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := server.ExportContactBundle(context.Background(), store, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
@@ -2,20 +2,43 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/idaaser/syncdemov1/server"
 	"github.com/lestrrat-go/jwx/v3/jwk"
 )
 
+// 默认的通讯录文件
+const (
+	deptFile        = "./server/testdata/departments.json"
+	userFile        = "./server/testdata/users.json"
+	groupFile       = "./server/testdata/groups.json"
+	groupMemberFile = "./server/testdata/group-users.json"
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "export":
+			os.Exit(export(os.Args[2:]))
+		case "client":
+			os.Exit(client(os.Args[2:]))
+		}
+	}
+
 	srv := server.New(
 		8001,
 		/**
@@ -26,15 +49,18 @@ func main() {
 			"client_id_2", "client_secret_2",
 		),
 		*/
-		server.WithContactFileStore(
-			"./server/testdata/departments.json",
-			"./server/testdata/users.json",
-			"./server/testdata/groups.json",
-			"./server/testdata/group-users.json",
-		),
+		server.WithContactFileStore(deptFile, userFile, groupFile, groupMemberFile),
+		server.WithSCIMProvider(),
 	)
 
-	srv.Start()
+	// 收到SIGTERM或SIGINT后, 等待处理中的请求完成再退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	err := srv.Start(ctx)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func generateRSAKey() *rsa.PrivateKey {
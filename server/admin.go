@@ -0,0 +1,352 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+)
+
+// WithAdminClients 允许申请ScopeAdmin的client_id, 只有包含ScopeAdmin的token可以调用管理接口(/v1/admin).
+// AuthnStore须支持(如WithJWTAuthnStore), 否则Start时返回错误; client自身允许的scope包含ScopeAdmin时无须设置
+func WithAdminClients(clientIDs ...string) Option {
+	return func(srv *Server) {
+		if srv.admins == nil {
+			srv.admins = map[string]bool{}
+		}
+		for _, id := range clientIDs {
+			srv.admins[id] = true
+		}
+	}
+}
+
+const errConflict = "conflict"
+
+// mountAdmin 注册管理接口, 仅当ContactStore实现了MutableContactStore时可用
+func (s *Server) mountAdmin(g *echo.Group) {
+	g.Use(s.requireAdmin())
+
+	g.POST("/depts", s.createDept)
+	g.PUT("/depts/:id", s.replaceDept)
+	g.PATCH("/depts/:id", s.patchDept)
+	g.DELETE("/depts/:id", s.deleteDept)
+
+	g.POST("/users", s.createUser)
+	g.PUT("/users/:id", s.replaceUser)
+	g.PATCH("/users/:id", s.patchUser)
+	g.DELETE("/users/:id", s.deleteUser)
+
+	g.POST("/groups", s.createGroup)
+	g.PUT("/groups/:id", s.replaceGroup)
+	g.PATCH("/groups/:id", s.patchGroup)
+	g.DELETE("/groups/:id", s.deleteGroup)
+
+	// 添加group成员, body为{"members": ["uid-1", ...]}
+	g.POST("/groups/:id/members", s.addGroupMembers)
+	g.DELETE("/groups/:id/members/:user", s.removeGroupMember)
+}
+
+// adminGrantable 可以给WithAdminClients中的client授予ScopeAdmin的AuthnStore
+type adminGrantable interface {
+	setAdminClients(ids map[string]bool)
+}
+
+// requireAdmin 须在authn之后使用, token中没有ScopeAdmin时返回403
+func (s *Server) requireAdmin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			clientid, _ := c.Get(contextClientIDKey).(string)
+			if !hasScope(c, ScopeAdmin) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate,
+					fmt.Sprintf(`Bearer error="%s", scope="%s"`, errInsufficientScope, ScopeAdmin))
+				return s.returnJSONError(c, 403, errInsufficientScope,
+					fmt.Errorf("client %q is not allowed to modify contacts", clientid))
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *Server) mutableStore(c echo.Context) (MutableContactStore, bool) {
+	store, ok := s.getContactStore(c).(MutableContactStore)
+	return store, ok
+}
+
+func (s *Server) returnNotMutable(c echo.Context) error {
+	return s.returnJSONError(c, 404, spec.ErrInvalidRequest,
+		errors.New("modifying contacts is not supported"))
+}
+
+// returnMutationError 返回修改通讯录时的错误:
+// id冲突返回409, 未通过完整性校验返回400, 其他同returnStoreError
+func (s *Server) returnMutationError(c echo.Context, err error) error {
+	var invalid *ValidationError
+	switch {
+	case errors.Is(err, ErrConflict):
+		return s.returnJSONError(c, 409, errConflict, err)
+	case errors.As(err, &invalid):
+		return c.JSON(400, struct {
+			spec.ErrResponse
+			Issues []ValidationIssue `json:"issues"`
+		}{
+			ErrResponse: s.errResponse(c, spec.ErrInvalidRequest, err),
+			Issues:      invalid.Report.Issues,
+		})
+	}
+	return s.returnStoreError(c, err)
+}
+
+// bindEntity 解析body, 并校验body中的id与路径中的id一致; 路径中没有id时要求body中的id不为空
+func bindEntity[T any](c echo.Context, v *T, id func(*T) *string) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(v); err != nil {
+		return err
+	}
+
+	p := id(v)
+	if param := c.Param("id"); param != "" {
+		if *p == "" {
+			*p = param
+		}
+		if *p != param {
+			return fmt.Errorf("id %q in body does not match %q in path", *p, param)
+		}
+	}
+	if *p == "" {
+		return errors.New("missing id")
+	}
+	return nil
+}
+
+// mergePatch 按JSON Merge Patch(RFC 7396)的方式把body合并到当前数据上, 不允许修改id
+func mergePatch[T any](c echo.Context, current *T, id func(*T) *string) (*T, error) {
+	patch, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	next := new(T)
+	*next = *current
+	if err := json.Unmarshal(patch, next); err != nil {
+		return nil, err
+	}
+	if *id(next) != *id(current) {
+		return nil, errors.New("id can not be modified")
+	}
+	return next, nil
+}
+
+func deptIDField(d *spec.Department) *string { return &d.ID }
+func userIDField(u *spec.User) *string       { return &u.ID }
+func groupIDField(g *spec.Group) *string     { return &g.ID }
+
+func (s *Server) createDept(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	dept := &spec.Department{}
+	if err := bindEntity(c, dept, deptIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.CreateDepartment(c.Request().Context(), dept); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(201, dept)
+}
+
+func (s *Server) replaceDept(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	dept := &spec.Department{}
+	if err := bindEntity(c, dept, deptIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateDepartment(c.Request().Context(), dept); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, dept)
+}
+
+func (s *Server) patchDept(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	current, err := store.GetDepartment(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return s.returnMutationError(c, err)
+	}
+	dept, err := mergePatch(c, current, deptIDField)
+	if err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateDepartment(c.Request().Context(), dept); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, dept)
+}
+
+func (s *Server) deleteDept(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	if err := store.DeleteDepartment(c.Request().Context(), c.Param("id")); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) createUser(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	user := &spec.User{}
+	if err := bindEntity(c, user, userIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.CreateUser(c.Request().Context(), user); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(201, user)
+}
+
+func (s *Server) replaceUser(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	user := &spec.User{}
+	if err := bindEntity(c, user, userIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateUser(c.Request().Context(), user); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, user)
+}
+
+func (s *Server) patchUser(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	current, err := store.GetUser(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return s.returnMutationError(c, err)
+	}
+	user, err := mergePatch(c, copyUser(current), userIDField)
+	if err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateUser(c.Request().Context(), user); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, user)
+}
+
+func (s *Server) deleteUser(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	if err := store.DeleteUser(c.Request().Context(), c.Param("id")); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) createGroup(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	group := &spec.Group{}
+	if err := bindEntity(c, group, groupIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.CreateGroup(c.Request().Context(), group); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(201, group)
+}
+
+func (s *Server) replaceGroup(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	group := &spec.Group{}
+	if err := bindEntity(c, group, groupIDField); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateGroup(c.Request().Context(), group); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, group)
+}
+
+func (s *Server) patchGroup(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	current, err := store.GetGroup(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return s.returnMutationError(c, err)
+	}
+	group, err := mergePatch(c, current, groupIDField)
+	if err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.UpdateGroup(c.Request().Context(), group); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.JSON(200, group)
+}
+
+func (s *Server) deleteGroup(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	if err := store.DeleteGroup(c.Request().Context(), c.Param("id")); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) addGroupMembers(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	req := struct {
+		Members []string `json:"members"`
+	}{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	if err := store.AddGroupMembers(c.Request().Context(), c.Param("id"), req.Members); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) removeGroupMember(c echo.Context) error {
+	store, ok := s.mutableStore(c)
+	if !ok {
+		return s.returnNotMutable(c)
+	}
+	if err := store.RemoveGroupMembers(c.Request().Context(), c.Param("id"), []string{c.Param("user")}); err != nil {
+		return s.returnMutationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adminRequest(t *testing.T, e *echo.Echo, method, path, body string) (int, map[string]any) {
+	req := httptest.NewRequest(method, "/v1/admin"+path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer any")
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	resp := map[string]any{}
+	if rec.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	return rec.Code, resp
+}
+
+func Test_admin(t *testing.T) {
+	store, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	// allowAnyAs的client_id为any_client
+	e := New(0, WithContactStore(store), WithAdminClients("any_client")).newEcho()
+
+	status, body := adminRequest(t, e, "POST", "/depts", `{"id": "1.4", "parent": "1", "name": "广东"}`)
+	assert.Equal(t, 201, status)
+	assert.Equal(t, "广东", body["name"])
+
+	status, body = adminRequest(t, e, "POST", "/depts", `{"id": "1.4", "parent": "1", "name": "广东"}`)
+	assert.Equal(t, 409, status)
+	assert.Equal(t, errConflict, body["code"])
+
+	status, body = adminRequest(t, e, "PATCH", "/depts/1.4", `{"name": "广东省"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "广东省", body["name"])
+	assert.Equal(t, "1", body["parent"])
+
+	status, _ = adminRequest(t, e, "PUT", "/users/uid-1", `{"id": "uid-2", "name": "user 1"}`)
+	assert.Equal(t, 400, status)
+
+	status, body = adminRequest(t, e, "POST", "/users", `{"id": "uid-10", "name": "user 10", "main_department": "notexists"}`)
+	assert.Equal(t, 400, status)
+	assert.NotEmpty(t, body["issues"])
+
+	status, _ = adminRequest(t, e, "POST", "/users", `{"id": "uid-10", "name": "user 10", "email": "a@example.com", "main_department": "1.4"}`)
+	assert.Equal(t, 201, status)
+
+	// PATCH不会修改快照中的数据
+	status, body = adminRequest(t, e, "PATCH", "/users/uid-10", `{"email": "b@example.com", "active": true}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "b@example.com", body["email"])
+	u, err := store.GetUser(context.TODO(), "uid-10")
+	require.NoError(t, err)
+	assert.Equal(t, "b@example.com", *u.Email)
+
+	status, _ = adminRequest(t, e, "POST", "/groups/7/members", `{"members": ["uid-10"]}`)
+	assert.Equal(t, 204, status)
+	status, _ = adminRequest(t, e, "DELETE", "/groups/7/members/uid-10", "")
+	assert.Equal(t, 204, status)
+
+	status, _ = adminRequest(t, e, "DELETE", "/users/uid-10", "")
+	assert.Equal(t, 204, status)
+	status, body = adminRequest(t, e, "DELETE", "/users/uid-10", "")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, errNotFound, body["code"])
+}
+
+func Test_admin_forbidden(t *testing.T) {
+	// 不是管理员
+	e := New(0, WithAdminClients("admin")).newEcho()
+	status, body := adminRequest(t, e, "DELETE", "/users/uid-1", "")
+	assert.Equal(t, 403, status)
+	assert.Equal(t, errInsufficientScope, body["code"])
+
+	// ContactStore不支持修改
+	e = New(0, WithAdminClients("any_client")).newEcho()
+	status, _ = adminRequest(t, e, "DELETE", "/users/uid-1", "")
+	assert.Equal(t, 404, status)
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	spec "github.com/idaaser/syncspecv1"
@@ -9,21 +11,89 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// OAuth2 scope, 各接口需要的scope见Server.newEcho
+const (
+	ScopeDeptsRead  = "contacts.depts.read"
+	ScopeUsersRead  = "contacts.users.read"
+	ScopeGroupsRead = "contacts.groups.read"
+	// 调用管理接口(/v1/admin)
+	ScopeAdmin = "contacts.admin"
+)
+
+// DefaultScopes 未设置scope的client允许申请的scope, 以及不支持scope的AuthnStore颁发的token的scope
+var DefaultScopes = []string{ScopeDeptsRead, ScopeUsersRead, ScopeGroupsRead}
+
+const (
+	// token中缺少接口需要的scope时返回的错误码
+	errInsufficientScope = "insufficient_scope"
+	// 申请的scope非法时返回的错误码
+	errInvalidScope = "invalid_scope"
+)
+
+// tokenRequest 在spec.GetTokenRequest的基础上, 增加了可选的scope参数(空格分隔),
+// 以及private_key_jwt鉴权时的client assertion, 见CredentialAuthnStore
+type tokenRequest struct {
+	spec.GetTokenRequest
+	Scope string `json:"scope" form:"scope"`
+
+	ClientAssertionType string `json:"client_assertion_type" form:"client_assertion_type"`
+	ClientAssertion     string `json:"client_assertion" form:"client_assertion"`
+}
+
+// tokenResponse 在spec.Token的基础上, 返回授予的scope
+type tokenResponse struct {
+	Token *grantedToken `json:"token"`
+}
+
+type grantedToken struct {
+	*spec.Token
+	Scope string `json:"scope,omitempty"`
+}
+
 func (s *Server) token(c echo.Context) error {
-	req := spec.GetTokenRequest{}
+	req := tokenRequest{}
 	if err := c.Bind(&req); err != nil {
 		return s.returnBadRequest(c, err)
 	}
 
+	if store, ok := s.clients.(CredentialAuthnStore); ok {
+		cred, err := s.clientCredentials(c, req.ClientID, req.ClientSecret, req.ClientAssertionType, req.ClientAssertion)
+		if err != nil {
+			return s.returnBadRequest(c, err)
+		}
+		tok, scopes, err := store.AuthWithCredentials(c.Request().Context(), cred, strings.Fields(req.Scope))
+		return s.returnGrantedToken(c, tok, scopes, err)
+	}
+
 	if err := req.Validate(); err != nil {
 		return s.returnBadRequest(c, err)
 	}
 
-	tok, err := s.clients.Auth(c.Request().Context(), req.ClientID, req.ClientSecret)
+	scoped, ok := s.clients.(ScopedAuthnStore)
+	if !ok {
+		if req.Scope != "" {
+			return s.returnJSONError(c, 400, errInvalidScope, errors.New("scope is not supported"))
+		}
+		tok, err := s.clients.Auth(c.Request().Context(), req.ClientID, req.ClientSecret)
+		if err != nil {
+			return s.returnJSONError(c, 401, spec.ErrInvalidClient, err)
+		}
+		return c.JSON(200, spec.GetTokenResponse{Token: tok})
+	}
+
+	tok, scopes, err := scoped.AuthWithScope(c.Request().Context(), req.ClientID, req.ClientSecret,
+		strings.Fields(req.Scope))
+	return s.returnGrantedToken(c, tok, scopes, err)
+}
+
+func (s *Server) returnGrantedToken(c echo.Context, tok *spec.Token, scopes []string, err error) error {
+	if errors.Is(err, ErrInvalidScope) {
+		return s.returnJSONError(c, 400, errInvalidScope, err)
+	}
 	if err != nil {
 		return s.returnJSONError(c, 401, spec.ErrInvalidClient, err)
 	}
-	return c.JSON(200, spec.GetTokenResponse{Token: tok})
+	return c.JSON(200, tokenResponse{Token: &grantedToken{Token: tok, Scope: strings.Join(scopes, " ")}})
 }
 
 const (
@@ -31,10 +101,14 @@ const (
 
 	// 当鉴权成功时, 将会把请求者的client_id添加至context中对应的key
 	contextClientIDKey = "authn.clientid"
+	// 当鉴权成功时, 将会把token的scope添加至context中对应的key
+	contextScopesKey = "authn.scopes"
+	// 串联多个AuthnStore时, 将会把校验成功的AuthnStore的名称添加至context中对应的key, 见NewChainAuthnStore
+	contextAuthnStoreKey = "authn.store"
 )
 
 // 鉴权middleware,
-// 当校验成功时, 将会把请求者的client_id添加至context中
+// 当校验成功时, 将会把请求者的client_id以及token的scope添加至context中
 // 当校验失败时, 返回401
 func (s *Server) authn() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -43,13 +117,14 @@ func (s *Server) authn() echo.MiddlewareFunc {
 			l := len(bearer)
 			if len(auth) > l+1 && strings.EqualFold(auth[:l], bearer) {
 				if tok := strings.TrimSpace(auth[l+1:]); tok != "" {
-					clientid, err := s.clients.Verify(c.Request().Context(), tok)
+					clientid, scopes, err := s.verify(c, tok)
 					if err != nil {
 						return s.returnJSONError(c, 401, spec.ErrInvalidToken, err)
 					}
 
-					// 把请求者的client_id添加至context中
+					// 把请求者的client_id以及scope添加至context中
 					c.Set(contextClientIDKey, clientid)
+					c.Set(contextScopesKey, scopes)
 
 					return next(c)
 				}
@@ -61,3 +136,58 @@ func (s *Server) authn() echo.MiddlewareFunc {
 		}
 	}
 }
+
+func (s *Server) verify(c echo.Context, tok string) (string, []string, error) {
+	if chain, ok := s.chain(); ok {
+		name, clientid, scopes, err := chain.verify(c.Request().Context(), tok)
+		if err == nil {
+			c.Set(contextAuthnStoreKey, name)
+		}
+		return clientid, scopes, err
+	}
+
+	if scoped, ok := s.clients.(ScopedAuthnStore); ok {
+		return scoped.VerifyWithScope(c.Request().Context(), tok)
+	}
+
+	clientid, err := s.clients.Verify(c.Request().Context(), tok)
+	return clientid, DefaultScopes, err
+}
+
+func (s *Server) chain() (*chainAuthnStore, bool) {
+	switch store := s.clients.(type) {
+	case *chainAuthnStore:
+		return store, true
+	case *chainJWKSAuthnStore:
+		return store.chainAuthnStore, true
+	}
+	return nil, false
+}
+
+// requireScope 须在authn之后使用, token中缺少任一scope时返回403
+func (s *Server) requireScope(scopes ...string) echo.MiddlewareFunc {
+	return s.checkScope(func(c echo.Context, err error) error {
+		return s.returnJSONError(c, 403, errInsufficientScope, err)
+	}, scopes...)
+}
+
+func (s *Server) checkScope(reject func(c echo.Context, err error) error, scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, scope := range scopes {
+				if !hasScope(c, scope) {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate,
+						fmt.Sprintf(`Bearer error="%s", scope="%s"`, errInsufficientScope, strings.Join(scopes, " ")))
+					return reject(c, fmt.Errorf("access_token is missing scope %q", scope))
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// hasScope 请求的token是否包含scope
+func hasScope(c echo.Context, scope string) bool {
+	scopes, _ := c.Get(contextScopesKey).([]string)
+	return slices.Contains(scopes, scope)
+}
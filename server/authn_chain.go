@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// NamedAuthnStore 串联的AuthnStore, Name记录在请求的context中(见contextAuthnStoreKey)
+type NamedAuthnStore struct {
+	Name  string
+	Store AuthnStore
+}
+
+// ClientOwner 可选接口, 串联AuthnStore时, /v1/token的请求交给管理该client的AuthnStore处理.
+// 未实现该接口的AuthnStore只用于校验token
+type ClientOwner interface {
+	// OwnsClient client是否由该AuthnStore管理
+	OwnsClient(ctx context.Context, clientid string) (bool, error)
+}
+
+// WithChainedAuthnStores 依次使用多个AuthnStore校验token, 如迁移期间同时接受JWT token和旧的API key.
+// 配置错误时, Start返回错误, 见NewChainAuthnStore
+func WithChainedAuthnStores(stores ...NamedAuthnStore) Option {
+	store, err := NewChainAuthnStore(stores...)
+	if err != nil {
+		return withError(err)
+	}
+	return WithAuthnStore(store)
+}
+
+// NewChainAuthnStore 串联多个AuthnStore:
+//   - Verify: 依次校验, 使用第一个校验成功的AuthnStore的结果
+//   - Auth: 交给管理该client(见ClientOwner)的第一个AuthnStore
+//
+// 串联后支持scope; 任一AuthnStore实现了JWKSProvider时, 合并公开全部公钥;
+// WithKeyRotation和WithRevocationList对支持的AuthnStore生效. 撤销token以及其他client鉴权方式的接口不可用
+func NewChainAuthnStore(stores ...NamedAuthnStore) (AuthnStore, error) {
+	if len(stores) == 0 {
+		return nil, errors.New("authn chain: no authn store")
+	}
+	names := map[string]bool{}
+	for _, s := range stores {
+		if s.Name == "" || s.Store == nil {
+			return nil, errors.New("authn chain: name and store are required")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("authn chain: duplicate name %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	chain := &chainAuthnStore{stores: stores}
+	for _, s := range stores {
+		if _, ok := s.Store.(JWKSProvider); ok {
+			return &chainJWKSAuthnStore{chain}, nil
+		}
+	}
+	return chain, nil
+}
+
+type chainAuthnStore struct {
+	stores []NamedAuthnStore
+}
+
+// chainJWKSAuthnStore 至少有一个AuthnStore实现了JWKSProvider
+type chainJWKSAuthnStore struct {
+	*chainAuthnStore
+}
+
+// interface compliance
+var (
+	_ ScopedAuthnStore = (*chainAuthnStore)(nil)
+	_ keyRotator       = (*chainAuthnStore)(nil)
+	_ revocable        = (*chainAuthnStore)(nil)
+	_ adminGrantable   = (*chainAuthnStore)(nil)
+	_ JWKSProvider     = (*chainJWKSAuthnStore)(nil)
+)
+
+// Auth 实现了AuthnStore接口
+func (c *chainAuthnStore) Auth(ctx context.Context, clientid, clientsecret string) (*spec.Token, error) {
+	tok, _, err := c.AuthWithScope(ctx, clientid, clientsecret, nil)
+	return tok, err
+}
+
+// AuthWithScope 实现了ScopedAuthnStore接口, 交给管理该client的AuthnStore处理
+func (c *chainAuthnStore) AuthWithScope(ctx context.Context, clientid, clientsecret string, scopes []string) (
+	*spec.Token, []string, error,
+) {
+	owner, err := c.owner(ctx, clientid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if scoped, ok := owner.Store.(ScopedAuthnStore); ok {
+		return scoped.AuthWithScope(ctx, clientid, clientsecret, scopes)
+	}
+	if len(scopes) > 0 {
+		return nil, nil, fmt.Errorf("%w: scope is not supported by %s", ErrInvalidScope, owner.Name)
+	}
+	tok, err := owner.Store.Auth(ctx, clientid, clientsecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tok, DefaultScopes, nil
+}
+
+// owner 返回管理该client的第一个AuthnStore
+func (c *chainAuthnStore) owner(ctx context.Context, clientid string) (NamedAuthnStore, error) {
+	owner, ok, err := c.findOwner(ctx, clientid)
+	if err == nil && !ok {
+		err = errors.New("invalid client id or client secret")
+	}
+	return owner, err
+}
+
+func (c *chainAuthnStore) findOwner(ctx context.Context, clientid string) (NamedAuthnStore, bool, error) {
+	for _, s := range c.stores {
+		o, ok := s.Store.(ClientOwner)
+		if !ok {
+			continue
+		}
+		owns, err := o.OwnsClient(ctx, clientid)
+		if err != nil {
+			return NamedAuthnStore{}, false, err
+		}
+		if owns {
+			return s, true, nil
+		}
+	}
+	return NamedAuthnStore{}, false, nil
+}
+
+// Verify 实现了AuthnStore接口
+func (c *chainAuthnStore) Verify(ctx context.Context, tok string) (string, error) {
+	_, clientid, _, err := c.verify(ctx, tok)
+	return clientid, err
+}
+
+// VerifyWithScope 实现了ScopedAuthnStore接口, 不支持scope的AuthnStore校验的token只有DefaultScopes
+func (c *chainAuthnStore) VerifyWithScope(ctx context.Context, tok string) (string, []string, error) {
+	_, clientid, scopes, err := c.verify(ctx, tok)
+	return clientid, scopes, err
+}
+
+// verify 依次校验token, 返回第一个校验成功的AuthnStore的名称.
+// client_id由其他AuthnStore管理时token无效, 否则API key或OIDC的sub可以冒充该client(管理员权限、ClientPolicy等均按client_id生效)
+func (c *chainAuthnStore) verify(ctx context.Context, tok string) (string, string, []string, error) {
+	errs := make([]error, 0, len(c.stores))
+	for _, s := range c.stores {
+		var clientid string
+		scopes := DefaultScopes
+		var err error
+		if scoped, ok := s.Store.(ScopedAuthnStore); ok {
+			clientid, scopes, err = scoped.VerifyWithScope(ctx, tok)
+		} else {
+			clientid, err = s.Store.Verify(ctx, tok)
+		}
+		if err == nil {
+			owner, ok, err := c.findOwner(ctx, clientid)
+			if err != nil {
+				return "", "", nil, err
+			}
+			if ok && owner.Name != s.Name {
+				return "", "", nil, fmt.Errorf("%s: client_id %q is managed by %s", s.Name, clientid, owner.Name)
+			}
+			return s.Name, clientid, scopes, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", s.Name, err))
+	}
+	return "", "", nil, errors.Join(errs...)
+}
+
+// PublicKeys 实现了JWKSProvider接口, 合并全部AuthnStore的公钥
+func (c *chainJWKSAuthnStore) PublicKeys(ctx context.Context) (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, s := range c.stores {
+		provider, ok := s.Store.(JWKSProvider)
+		if !ok {
+			continue
+		}
+		keys, err := provider.PublicKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range keys.Len() {
+			key, _ := keys.Key(i)
+			if err := set.AddKey(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return set, nil
+}
+
+// startRotation 轮换全部支持轮换的AuthnStore的密钥, 都不支持时返回错误
+func (c *chainAuthnStore) startRotation(r *keyRotation) (func(), error) {
+	stops := []func(){}
+	for _, s := range c.stores {
+		if rotator, ok := s.Store.(keyRotator); ok {
+			stop, err := rotator.startRotation(r)
+			if err != nil {
+				for _, stop := range stops {
+					stop()
+				}
+				return nil, err
+			}
+			stops = append(stops, stop)
+		}
+	}
+	if len(stops) == 0 {
+		return nil, errors.New("key rotation is not supported by any chained authn store")
+	}
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			for _, stop := range stops {
+				stop()
+			}
+		})
+	}, nil
+}
+
+func (c *chainAuthnStore) setRevocationList(list RevocationList) {
+	for _, s := range c.stores {
+		if store, ok := s.Store.(revocable); ok {
+			store.setRevocationList(list)
+		}
+	}
+}
+
+func (c *chainAuthnStore) setAdminClients(ids map[string]bool) {
+	for _, s := range c.stores {
+		if store, ok := s.Store.(adminGrantable); ok {
+			store.setAdminClients(ids)
+		}
+	}
+}
+
+// OwnsClient 实现了ClientOwner接口
+func (s *jwtAuthnStore) OwnsClient(ctx context.Context, clientid string) (bool, error) {
+	_, err := s.registry.GetClient(ctx, clientid)
+	if errors.Is(err, ErrClientNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NewAPIKeyAuthnStore 使用固定的API key作为access_token, keys为API key -> client_id.
+// 不颁发token; API key只保存sha256, 比较时耗时与内容无关. 通常与其他AuthnStore串联, 用于兼容旧的调用方
+func NewAPIKeyAuthnStore(keys map[string]string) AuthnStore {
+	s := &apiKeyAuthnStore{}
+	for key, clientid := range keys {
+		s.keys = append(s.keys, apiKey{hash: sha256.Sum256([]byte(key)), clientid: clientid})
+	}
+	return s
+}
+
+type apiKeyAuthnStore struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	hash     [sha256.Size]byte
+	clientid string
+}
+
+// Auth 实现了AuthnStore接口, API key不能换取token
+func (s *apiKeyAuthnStore) Auth(context.Context, string, string) (*spec.Token, error) {
+	return nil, errors.New("api keys can not be exchanged for access tokens")
+}
+
+// Verify 实现了AuthnStore接口, 比较全部API key, 不提前返回
+func (s *apiKeyAuthnStore) Verify(_ context.Context, tok string) (string, error) {
+	hash := sha256.Sum256([]byte(tok))
+	clientid := ""
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			clientid = k.clientid
+		}
+	}
+	if clientid == "" {
+		return "", errors.New("invalid api key")
+	}
+	return clientid, nil
+}
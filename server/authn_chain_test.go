@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_chainAuthnStore(t *testing.T) {
+	jwtStore := newTestJWTAuthnStore(t, NewMemoryClientRegistry(mustNewClient("c1", "secret", nil)))
+	s := New(0, WithChainedAuthnStores(
+		NamedAuthnStore{Name: "legacy", Store: NewAPIKeyAuthnStore(map[string]string{"api-key-1": "legacy-client"})},
+		NamedAuthnStore{Name: "jwt", Store: jwtStore},
+	))
+	e := s.newEcho()
+	e.GET("/whoami", func(c echo.Context) error {
+		return c.JSON(200, map[string]any{
+			"client": c.Get(contextClientIDKey), "store": c.Get(contextAuthnStoreKey), "scopes": c.Get(contextScopesKey),
+		})
+	}, s.authn())
+
+	whoami := func(tok string) (int, map[string]any) {
+		req := httptest.NewRequest("GET", "/whoami", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	// /v1/token交给管理该client的AuthnStore
+	status, body := requestToken(t, e, url.Values{
+		"client_id": {"c1"}, "client_secret": {"secret"}, "scope": {ScopeDeptsRead},
+	})
+	require.Equal(t, 200, status, body)
+	tok := body["token"].(map[string]any)["access_token"].(string)
+	status, _ = requestToken(t, e, url.Values{"client_id": {"legacy-client"}, "client_secret": {"api-key-1"}})
+	assert.Equal(t, 401, status)
+
+	status, body = whoami(tok)
+	require.Equal(t, 200, status, body)
+	assert.Equal(t, "c1", body["client"])
+	assert.Equal(t, "jwt", body["store"])
+	assert.Equal(t, []any{ScopeDeptsRead}, body["scopes"])
+
+	status, body = whoami("api-key-1")
+	require.Equal(t, 200, status, body)
+	assert.Equal(t, "legacy-client", body["client"])
+	assert.Equal(t, "legacy", body["store"])
+	assert.Len(t, body["scopes"], len(DefaultScopes))
+
+	status, _ = whoami("api-key-2")
+	assert.Equal(t, 401, status)
+
+	// 合并公开JWT AuthnStore的公钥
+	req := httptest.NewRequest("GET", "/v1/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, 200, rec.Code)
+	set, err := jwk.Parse(rec.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, 1, set.Len())
+}
+
+func Test_chainAuthnStore_sharedClientID(t *testing.T) {
+	// API key与JWT AuthnStore中的client使用相同的client_id
+	jwtStore := newTestJWTAuthnStore(t, NewMemoryClientRegistry(mustNewClient("ops", "secret", nil)))
+	e := New(0, WithChainedAuthnStores(
+		NamedAuthnStore{Name: "legacy", Store: NewAPIKeyAuthnStore(map[string]string{"k-ops": "ops", "k-legacy": "legacy"})},
+		NamedAuthnStore{Name: "jwt", Store: jwtStore},
+	), WithAdminClients("ops"), WithClientPolicy("ops", ClientPolicy{Departments: []string{"1.1"}})).newEcho()
+
+	call := func(method, path, tok string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	status, body := requestToken(t, e, url.Values{"client_id": {"ops"}, "client_secret": {"secret"}})
+	require.Equal(t, 200, status, body)
+	tok := body["token"].(map[string]any)["access_token"].(string)
+	// 通过了管理员校验, 但ContactStore不支持修改
+	assert.Equal(t, 404, call("DELETE", "/v1/admin/users/uid-1", tok).Code)
+	assert.Equal(t, 200, call("GET", "/v1/depts", tok).Code)
+
+	// API key不能冒充JWT AuthnStore管理的client
+	rec := call("DELETE", "/v1/admin/users/uid-1", "k-ops")
+	assert.Equal(t, 401, rec.Code)
+	assert.Contains(t, rec.Body.String(), "managed by jwt")
+	assert.Equal(t, 401, call("GET", "/v1/depts", "k-ops").Code)
+
+	assert.Equal(t, 200, call("GET", "/v1/depts", "k-legacy").Code)
+	assert.Equal(t, 403, call("DELETE", "/v1/admin/users/uid-1", "k-legacy").Code)
+}
+
+func Test_chainAuthnStore_options(t *testing.T) {
+	apiKeys := NamedAuthnStore{Name: "legacy", Store: NewAPIKeyAuthnStore(map[string]string{"k": "c"})}
+
+	// 没有JWKSProvider时不提供/v1/jwks.json
+	e := New(0, WithChainedAuthnStores(apiKeys)).newEcho()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/jwks.json", nil))
+	assert.Equal(t, 404, rec.Code)
+
+	// 密钥轮换以及RevocationList对支持的AuthnStore生效
+	jwtStore := newTestJWTAuthnStore(t, NewMemoryClientRegistry())
+	list := NewMemoryRevocationList()
+	srv := New(0, WithChainedAuthnStores(apiKeys, NamedAuthnStore{Name: "jwt", Store: jwtStore}),
+		WithKeyRotation(time.Hour, func() (jwk.Key, error) { return newTestKey(t), nil }),
+		WithRevocationList(list),
+	)
+	assert.NoError(t, srv.Err())
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	assert.Same(t, list, jwtStore.revocations)
+
+	// 都不支持密钥轮换时, Start返回错误
+	srv = New(0, WithChainedAuthnStores(apiKeys),
+		WithKeyRotation(time.Hour, func() (jwk.Key, error) { return newTestKey(t), nil }))
+	assert.ErrorContains(t, srv.Start(context.Background()), "key rotation is not supported")
+
+	_, err := NewChainAuthnStore(apiKeys, apiKeys)
+	assert.Error(t, err)
+	_, err = NewChainAuthnStore()
+	assert.Error(t, err)
+}
+
+func Test_apiKeyAuthnStore(t *testing.T) {
+	store := NewAPIKeyAuthnStore(map[string]string{"k1": "c1", "k2": "c2"})
+
+	clientid, err := store.Verify(context.TODO(), "k2")
+	require.NoError(t, err)
+	assert.Equal(t, "c2", clientid)
+	_, err = store.Verify(context.TODO(), "k3")
+	assert.Error(t, err)
+	_, err = store.Auth(context.TODO(), "c1", "k1")
+	assert.Error(t, err)
+}
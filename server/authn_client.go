@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+)
+
+// client在/v1/token等接口的鉴权方式, 见RFC 7591, RFC 7523以及RFC 8705
+const (
+	// client_id/client_secret作为表单参数
+	AuthMethodClientSecretPost = "client_secret_post"
+	// 以client注册的私钥签名的JWT(client assertion)
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+	// TLS客户端证书, 证书的subject或SAN与client绑定
+	AuthMethodTLSClientAuth = "tls_client_auth"
+)
+
+// private_key_jwt时client_assertion_type参数的值
+const clientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// client assertion的最长有效期, 已使用的assertion(jti)记录至其过期, 防止重放
+const maxAssertionLifetime = time.Hour
+
+// CredentialAuthnStore 可选接口, 除client_secret外还支持其他client鉴权方式的AuthnStore可以实现该接口.
+// 实现后, /v1/token以及撤销token等接口按请求中的凭证选择鉴权方式, 并在.well-known中返回支持的鉴权方式
+type CredentialAuthnStore interface {
+	ScopedAuthnStore
+
+	// AuthMethods 支持的鉴权方式, 如AuthMethodPrivateKeyJWT
+	AuthMethods() []string
+
+	// AuthenticateCredentials 校验client的凭证, 返回client_id
+	AuthenticateCredentials(ctx context.Context, cred *ClientCredentials) (string, error)
+
+	// AuthWithCredentials 校验client的凭证并颁发access_token, scope同AuthWithScope
+	AuthWithCredentials(ctx context.Context, cred *ClientCredentials, scopes []string) (*spec.Token, []string, error)
+}
+
+// ClientCredentials client在请求中提供的凭证
+type ClientCredentials struct {
+	// 鉴权方式, 如AuthMethodClientSecretPost
+	Method       string
+	ClientID     string
+	ClientSecret string
+
+	// private_key_jwt: client assertion, 其aud须包含Audience(token接口的地址)
+	Assertion string
+	Audience  string
+
+	// tls_client_auth: 已通过CA校验的客户端证书
+	Certificate *x509.Certificate
+}
+
+// clientCredentials 按请求中的参数确定鉴权方式:
+// 有client_assertion时为private_key_jwt; 没有client_secret且有已校验的客户端证书时为tls_client_auth; 否则为client_secret_post
+func (s *Server) clientCredentials(c echo.Context, clientid, secret, assertionType, assertion string) (
+	*ClientCredentials, error,
+) {
+	cred := &ClientCredentials{ClientID: clientid, ClientSecret: secret}
+
+	switch tls := c.Request().TLS; {
+	case assertionType != "" || assertion != "":
+		if assertionType != clientAssertionTypeJWT {
+			return nil, fmt.Errorf("unsupported client_assertion_type %q", assertionType)
+		}
+		if assertion == "" {
+			return nil, errors.New("missing client_assertion")
+		}
+		cred.Method, cred.Assertion, cred.Audience = AuthMethodPrivateKeyJWT, assertion, s.tokenEndpoint(c)
+	case secret == "" && tls != nil && len(tls.VerifiedChains) > 0:
+		if clientid == "" {
+			return nil, errors.New("missing client_id")
+		}
+		cred.Method, cred.Certificate = AuthMethodTLSClientAuth, tls.VerifiedChains[0][0]
+	default:
+		if clientid == "" || secret == "" {
+			return nil, errors.New("missing client_id or client_secret")
+		}
+		cred.Method = AuthMethodClientSecretPost
+	}
+	return cred, nil
+}
+
+// tokenEndpoint 返回当前请求对应的/token接口的地址, 即client assertion的aud
+func (s *Server) tokenEndpoint(c echo.Context) string {
+	p := c.Request().URL.Path
+	if i := strings.LastIndex(p, "/token"); i >= 0 {
+		p = p[:i]
+	}
+	u, _ := url.JoinPath(s.trustedRootURL(c), p, "token")
+	return u
+}
+
+// authMethods 返回支持的client鉴权方式, 未配置校验客户端证书的CA时不支持tls_client_auth
+func (s *Server) authMethods() []string {
+	store, ok := s.clients.(CredentialAuthnStore)
+	if !ok {
+		return []string{AuthMethodClientSecretPost}
+	}
+
+	methods := slices.Clone(store.AuthMethods())
+	if s.tlsConfig == nil || s.tlsConfig.ClientCAs == nil {
+		methods = slices.DeleteFunc(methods, func(m string) bool { return m == AuthMethodTLSClientAuth })
+	}
+	return methods
+}
+
+// interface compliance
+var _ CredentialAuthnStore = (*jwtAuthnStore)(nil)
+
+// AuthMethods 实现了CredentialAuthnStore接口
+func (s *jwtAuthnStore) AuthMethods() []string {
+	return []string{AuthMethodClientSecretPost, AuthMethodPrivateKeyJWT, AuthMethodTLSClientAuth}
+}
+
+// AuthenticateCredentials 实现了CredentialAuthnStore接口
+func (s *jwtAuthnStore) AuthenticateCredentials(ctx context.Context, cred *ClientCredentials) (string, error) {
+	client, err := s.authenticate(ctx, cred)
+	if err != nil {
+		return "", err
+	}
+	return client.ID, nil
+}
+
+// AuthWithCredentials 实现了CredentialAuthnStore接口
+func (s *jwtAuthnStore) AuthWithCredentials(ctx context.Context, cred *ClientCredentials, scopes []string) (
+	*spec.Token, []string, error,
+) {
+	client, err := s.authenticate(ctx, cred)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.grant(ctx, client, scopes)
+}
+
+func (s *jwtAuthnStore) authenticate(ctx context.Context, cred *ClientCredentials) (*Client, error) {
+	switch cred.Method {
+	case "", AuthMethodClientSecretPost:
+		return authenticateClient(ctx, s.registry, cred.ClientID, cred.ClientSecret)
+	case AuthMethodPrivateKeyJWT:
+		return s.verifyAssertion(ctx, cred)
+	case AuthMethodTLSClientAuth:
+		return s.verifyCertificate(ctx, cred)
+	}
+	return nil, fmt.Errorf("unsupported client authentication method %q", cred.Method)
+}
+
+// errInvalidClientCredentials client不存在、鉴权方式不符或已停用, 不区分具体原因
+var errInvalidClientCredentials = errors.New("invalid client credentials")
+
+// registeredClient 返回使用method鉴权且启用的client
+func (s *jwtAuthnStore) registeredClient(ctx context.Context, clientid, method string) (*Client, error) {
+	client, err := s.registry.GetClient(ctx, clientid)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, errInvalidClientCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.authMethod() != method || !client.Active(time.Now()) {
+		return nil, errInvalidClientCredentials
+	}
+	return client, nil
+}
+
+// verifyAssertion 校验client assertion(RFC 7523): 以client注册的公钥校验签名,
+// iss和sub为client_id, aud包含token接口的地址, 须有exp和jti, 且每个assertion只能使用一次
+func (s *jwtAuthnStore) verifyAssertion(ctx context.Context, cred *ClientCredentials) (*Client, error) {
+	clientid := cred.ClientID
+	if clientid == "" {
+		// 没有client_id参数时, 以assertion的sub作为client_id, 随后校验签名
+		unverified, err := jwt.ParseInsecure([]byte(cred.Assertion))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client assertion: %w", err)
+		}
+		clientid, _ = unverified.Subject()
+	}
+
+	client, err := s.registeredClient(ctx, clientid, AuthMethodPrivateKeyJWT)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := jwk.Parse(client.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwks of client %q: %w", clientid, err)
+	}
+
+	token, err := jwt.Parse([]byte(cred.Assertion),
+		jwt.WithKeySet(keys, jws.WithRequireKid(false), jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithAcceptableSkew(tokenSkew),
+		jwt.WithIssuer(clientid),
+		jwt.WithSubject(clientid),
+		jwt.WithAudience(cred.Audience),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+		jwt.WithRequiredClaim(jwt.JwtIDKey),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client assertion: %w", err)
+	}
+
+	exp, _ := token.Expiration()
+	if time.Until(exp) > maxAssertionLifetime {
+		return nil, fmt.Errorf("invalid client assertion: exp is more than %s in the future", maxAssertionLifetime)
+	}
+	jti, _ := token.JwtID()
+	first, err := s.markUsed(ctx, "client_assertion:"+clientid+":"+jti, exp.Add(tokenSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		return nil, errors.New("invalid client assertion: jti has been used")
+	}
+	return client, nil
+}
+
+// markUsed 原子地检查并记录已使用的jti, 已记录时返回false.
+// RevocationList未实现AtomicRevocationList时, 在检查和记录期间持有锁, 只能保证同一实例内的原子性
+func (s *jwtAuthnStore) markUsed(ctx context.Context, used string, until time.Time) (bool, error) {
+	if list, ok := s.revocations.(AtomicRevocationList); ok {
+		return list.RevokeIfAbsent(ctx, used, until)
+	}
+
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	replayed, err := s.revocations.Revoked(ctx, used)
+	if err != nil || replayed {
+		return false, err
+	}
+	return true, s.revocations.Revoke(ctx, used, until)
+}
+
+// verifyCertificate 校验客户端证书(RFC 8705)与client绑定: subject DN或SAN与注册的一致
+func (s *jwtAuthnStore) verifyCertificate(ctx context.Context, cred *ClientCredentials) (*Client, error) {
+	client, err := s.registeredClient(ctx, cred.ClientID, AuthMethodTLSClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Certificate == nil || !client.matchCertificate(cred.Certificate) {
+		return nil, errInvalidClientCredentials
+	}
+	return client, nil
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClientAssertion 生成client assertion, 可以通过set修改claim
+func newClientAssertion(t *testing.T, key jwk.Key, clientID string, set func(jwt.Token)) string {
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, clientID)
+	_ = token.Set(jwt.SubjectKey, clientID)
+	_ = token.Set(jwt.AudienceKey, "http://example.com/v1/token")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(5*time.Minute).Unix())
+	jti, err := newTokenID()
+	require.NoError(t, err)
+	_ = token.Set(jwt.JwtIDKey, jti)
+	if set != nil {
+		set(token)
+	}
+
+	alg, _ := key.Algorithm()
+	b, err := jwt.Sign(token, jwt.WithKey(alg, key))
+	require.NoError(t, err)
+	return string(b)
+}
+
+// newAssertionClient 返回使用private_key_jwt鉴权的client"hr"及其私钥
+func newAssertionClient(t *testing.T) (jwk.Key, ClientRegistry) {
+	clientKey := newTestKey(t)
+	public, err := jwk.PublicKeyOf(clientKey)
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(public))
+	jwks, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	return clientKey, NewMemoryClientRegistry(&Client{
+		ID: "hr", Enabled: true, AuthMethod: AuthMethodPrivateKeyJWT, JWKS: jwks, CreatedAt: time.Now(),
+	})
+}
+
+func Test_privateKeyJWT(t *testing.T) {
+	clientKey, registry := newAssertionClient(t)
+	e := New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry)).newEcho()
+
+	assertion := newClientAssertion(t, clientKey, "hr", nil)
+	form := url.Values{"client_assertion_type": {clientAssertionTypeJWT}, "client_assertion": {assertion}}
+	status, body := requestToken(t, e, form)
+	require.Equal(t, 200, status, body)
+	tok := body["token"].(map[string]any)["access_token"].(string)
+
+	req := httptest.NewRequest("GET", "/v1/depts", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	// 同一个assertion不能重复使用
+	status, body = requestToken(t, e, form)
+	assert.Equal(t, 401, status)
+	assert.Contains(t, body["msg"], "jti has been used")
+
+	for name, assertion := range map[string]string{
+		"wrong aud": newClientAssertion(t, clientKey, "hr", func(tok jwt.Token) {
+			_ = tok.Set(jwt.AudienceKey, "http://other.example.com/v1/token")
+		}),
+		"too long": newClientAssertion(t, clientKey, "hr", func(tok jwt.Token) {
+			_ = tok.Set(jwt.ExpirationKey, time.Now().Add(24*time.Hour).Unix())
+		}),
+		"other key":  newClientAssertion(t, newTestKey(t), "hr", nil),
+		"other iss":  newClientAssertion(t, clientKey, "hr", func(tok jwt.Token) { _ = tok.Set(jwt.IssuerKey, "x") }),
+		"unknown id": newClientAssertion(t, clientKey, "unknown", nil),
+	} {
+		status, _ := requestToken(t, e, url.Values{
+			"client_assertion_type": {clientAssertionTypeJWT}, "client_assertion": {assertion},
+		})
+		assert.Equal(t, 401, status, name)
+	}
+
+	// 使用private_key_jwt的client不能使用client_secret
+	status, _ = requestToken(t, e, url.Values{"client_id": {"hr"}, "client_secret": {""}})
+	assert.Equal(t, 400, status)
+	status, _ = requestToken(t, e, url.Values{"client_id": {"hr"}, "client_secret": {"any"}})
+	assert.Equal(t, 401, status)
+
+	// 撤销token时使用同样的鉴权方式
+	revoke := url.Values{
+		"client_assertion_type": {clientAssertionTypeJWT},
+		"client_assertion":      {newClientAssertion(t, clientKey, "hr", nil)},
+		"token":                 {tok},
+	}
+	req = httptest.NewRequest("POST", "/v1/token/revoke", strings.NewReader(revoke.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code, rec.Body.String())
+}
+
+func Test_privateKeyJWT_replay(t *testing.T) {
+	clientKey, registry := newAssertionClient(t)
+
+	// 内置的RevocationList, 以及只实现了RevocationList的自定义实现
+	for name, list := range map[string]RevocationList{
+		"memory": NewMemoryRevocationList(),
+		"custom": struct{ RevocationList }{NewMemoryRevocationList()},
+	} {
+		e := New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry), WithRevocationList(list)).newEcho()
+		form := url.Values{
+			"client_assertion_type": {clientAssertionTypeJWT},
+			"client_assertion":      {newClientAssertion(t, clientKey, "hr", nil)},
+		}
+
+		// 并发使用同一个assertion, 只有一个请求成功
+		statuses := make(chan int, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, _ := requestToken(t, e, form)
+				statuses <- status
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		succeeded := 0
+		for status := range statuses {
+			if status == 200 {
+				succeeded++
+			}
+		}
+		assert.Equal(t, 1, succeeded, name)
+	}
+}
+
+func Test_privateKeyJWT_audience(t *testing.T) {
+	clientKey, registry := newAssertionClient(t)
+	request := func(e *echo.Echo, aud string, header http.Header) int {
+		assertion := newClientAssertion(t, clientKey, "hr", func(tok jwt.Token) { _ = tok.Set(jwt.AudienceKey, aud) })
+		form := url.Values{"client_assertion_type": {clientAssertionTypeJWT}, "client_assertion": {assertion}}
+		req := httptest.NewRequest("POST", "/v1/token", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	forged := http.Header{"X-Forwarded-Host": {"other.example.com"}, "X-Forwarded-Proto": {"https"}}
+
+	// 默认不信任X-Forwarded-*头, 伪造的头不能使发给其他服务的assertion通过校验
+	e := New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry)).newEcho()
+	assert.Equal(t, 401, request(e, "https://other.example.com/v1/token", forged))
+	assert.Equal(t, 200, request(e, "http://example.com/v1/token", forged))
+
+	// 以配置的地址为准
+	e = New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry),
+		WithBaseURL("https://sync.example.com/")).newEcho()
+	assert.Equal(t, 401, request(e, "http://example.com/v1/token", nil))
+	assert.Equal(t, 401, request(e, "https://other.example.com/v1/token", forged))
+	assert.Equal(t, 200, request(e, "https://sync.example.com/v1/token", forged))
+
+	// 信任来自反向代理(httptest的请求来自192.0.2.1)的X-Forwarded-*头
+	e = New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry),
+		WithTrustedProxies("192.0.2.0/24")).newEcho()
+	assert.Equal(t, 200, request(e, "https://other.example.com/v1/token", forged))
+	e = New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry),
+		WithTrustedProxies("10.0.0.1")).newEcho()
+	assert.Equal(t, 401, request(e, "https://other.example.com/v1/token", forged))
+
+	// 其他接口地址仍按请求的X-Forwarded-*头生成
+	req := httptest.NewRequest("GET", "/v1/.well-known", nil)
+	req.Header = forged.Clone()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), "https://other.example.com/v1/token")
+
+	assert.Error(t, New(0, WithBaseURL("sync.example.com")).Err())
+	assert.Error(t, New(0, WithTrustedProxies("10.0.0.0/33")).Err())
+}
+
+func Test_tlsClientAuth(t *testing.T) {
+	registry := NewMemoryClientRegistry(
+		&Client{ID: "by-dn", Enabled: true, AuthMethod: AuthMethodTLSClientAuth, TLSSubjectDN: "CN=hr-sync,O=Example"},
+		&Client{ID: "by-san", Enabled: true, AuthMethod: AuthMethodTLSClientAuth, TLSSAN: "hr.example.com"},
+		mustNewClient("secret-client", "secret", nil),
+	)
+	e := New(0, WithJWTAuthnStoreRegistry(newTestKey(t), time.Hour, registry)).newEcho()
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "hr-sync", Organization: []string{"Example"}},
+		DNSNames: []string{"hr.example.com"},
+	}
+	requestWithCert := func(clientID string, cert *x509.Certificate) int {
+		req := httptest.NewRequest("POST", "/v1/token", strings.NewReader(url.Values{"client_id": {clientID}}.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, 200, requestWithCert("by-dn", cert))
+	assert.Equal(t, 200, requestWithCert("by-san", cert))
+	assert.Equal(t, 401, requestWithCert("by-san", &x509.Certificate{DNSNames: []string{"other.example.com"}}))
+	// client不使用tls_client_auth
+	assert.Equal(t, 401, requestWithCert("secret-client", cert))
+	// 没有客户端证书
+	assert.Equal(t, 400, requestWithCert("by-dn", nil))
+}
+
+func Test_wellknown_authMethods(t *testing.T) {
+	methods := func(opts ...Option) []any {
+		req := httptest.NewRequest("GET", "/v1/.well-known", nil)
+		rec := httptest.NewRecorder()
+		New(0, opts...).newEcho().ServeHTTP(rec, req)
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body["token_endpoint_auth_methods_supported"].([]any)
+	}
+
+	assert.Equal(t, []any{AuthMethodClientSecretPost}, methods())
+
+	jwtStore := WithJWTAuthnStore(newTestKey(t), time.Hour)
+	assert.Equal(t, []any{AuthMethodClientSecretPost, AuthMethodPrivateKeyJWT}, methods(jwtStore))
+	assert.Equal(t, []any{AuthMethodClientSecretPost, AuthMethodPrivateKeyJWT, AuthMethodTLSClientAuth},
+		methods(jwtStore, WithTLS(tls.Certificate{}, x509.NewCertPool())))
+}
+
+func Test_Client_matchCertificate(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.com/hr-sync")
+	cert := &x509.Certificate{URIs: []*url.URL{u}, EmailAddresses: []string{"hr@example.com"}}
+
+	assert.True(t, (&Client{TLSSAN: "spiffe://example.com/hr-sync"}).matchCertificate(cert))
+	assert.True(t, (&Client{TLSSAN: "hr@example.com"}).matchCertificate(cert))
+	assert.False(t, (&Client{TLSSAN: "other@example.com"}).matchCertificate(cert))
+	assert.False(t, (&Client{}).matchCertificate(cert))
+}
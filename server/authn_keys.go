@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// JWKSProvider 可选接口, 签发JWT token的AuthnStore可以实现该接口.
+// 实现后, 服务会在/v1/jwks.json公开校验token的公钥, 并在.well-known中返回其地址,
+// 下游的网关等可以自行校验token
+type JWKSProvider interface {
+	// PublicKeys 返回当前有效的全部公钥, 包括正在使用的签名密钥, 即将使用的密钥以及之前的密钥
+	PublicKeys(ctx context.Context) (jwk.Set, error)
+}
+
+// WithKeyRotation 每隔interval使用generate生成新的密钥签发token.
+// 新的密钥先在/v1/jwks.json公开, 至少经过jwks的缓存时间(5分钟)后才用于签名, 即interval小于5分钟时按5分钟轮换;
+// 之前的密钥在其签发的token全部过期前仍用于校验; 仅对WithJWTAuthnStore等内置的JWT AuthnStore生效
+func WithKeyRotation(interval time.Duration, generate func() (jwk.Key, error)) Option {
+	return func(srv *Server) {
+		srv.rotation = &keyRotation{interval: interval, generate: generate}
+	}
+}
+
+type keyRotation struct {
+	interval time.Duration
+	generate func() (jwk.Key, error)
+}
+
+// keyRotator 支持轮换签名密钥的AuthnStore
+type keyRotator interface {
+	startRotation(r *keyRotation) (stop func(), err error)
+}
+
+// /v1/jwks.json的缓存时间
+const jwksMaxAge = 5 * time.Minute
+
+// signingKeys 签名密钥集合: 当前用于签名的密钥, 已公开但尚未使用的下一个密钥,
+// 以及之前的密钥(仅用于校验, 直到其签发的token全部过期)
+type signingKeys struct {
+	mu      sync.RWMutex
+	active  jwk.Key
+	next    *nextKey
+	retired []retiredKey
+
+	// token的有效期, 之前的密钥在轮换后保留的时间
+	exp time.Duration
+	// 下一个密钥公开后, 至少经过该时间才用于签名, 默认为jwksMaxAge
+	prepublish time.Duration
+}
+
+type nextKey struct {
+	key   jwk.Key
+	since time.Time
+}
+
+type retiredKey struct {
+	key   jwk.Key
+	until time.Time
+}
+
+// newSigningKeys 创建签名密钥集合, 密钥没有kid时以其指纹(RFC 7638)作为kid.
+// 注: 密钥须设置alg
+func newSigningKeys(key jwk.Key, exp time.Duration) (*signingKeys, error) {
+	if err := prepareSigningKey(key); err != nil {
+		return nil, err
+	}
+	return &signingKeys{active: key, exp: exp, prepublish: jwksMaxAge}, nil
+}
+
+func prepareSigningKey(key jwk.Key) error {
+	if _, ok := key.Algorithm(); !ok {
+		return fmt.Errorf("signing key must have alg")
+	}
+	if _, ok := key.KeyID(); !ok {
+		return jwk.AssignKeyID(key)
+	}
+	return nil
+}
+
+// signer 返回当前用于签名的密钥
+func (k *signingKeys) signer() jwk.Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// publishNext 公开下一个密钥, 经过prepublish后由promote用于签名
+func (k *signingKeys) publishNext(next jwk.Key) error {
+	if err := prepareSigningKey(next); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.next = &nextKey{key: next, since: time.Now()}
+	return nil
+}
+
+// promote 下一个密钥已公开足够长的时间时, 使用其签名并返回该密钥
+func (k *signingKeys) promote() (jwk.Key, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.next == nil || time.Since(k.next.since) < k.prepublish {
+		return nil, false
+	}
+	next := k.next.key
+	k.rotateLocked(next)
+	return next, true
+}
+
+// rotate 立即使用新的密钥签名, 之前的密钥保留至其签发的token全部过期
+func (k *signingKeys) rotate(next jwk.Key) error {
+	if err := prepareSigningKey(next); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rotateLocked(next)
+	return nil
+}
+
+func (k *signingKeys) rotateLocked(next jwk.Key) {
+	now := time.Now()
+	retired := []retiredKey{{key: k.active, until: now.Add(k.exp + tokenSkew)}}
+	for _, r := range k.retired {
+		if r.until.After(now) {
+			retired = append(retired, r)
+		}
+	}
+	k.active, k.retired = next, retired
+	if k.next != nil && k.next.key == next {
+		k.next = nil
+	}
+}
+
+// verifiers 返回用于校验token的私钥集合, 包括当前的签名密钥, 下一个密钥以及未过期的之前的密钥
+func (k *signingKeys) verifiers() jwk.Set {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jwk.NewSet()
+	_ = set.AddKey(k.active)
+	if k.next != nil {
+		_ = set.AddKey(k.next.key)
+	}
+	now := time.Now()
+	for _, r := range k.retired {
+		if r.until.After(now) {
+			_ = set.AddKey(r.key)
+		}
+	}
+	return set
+}
+
+// public 返回verifiers对应的公钥集合
+func (k *signingKeys) public() (jwk.Set, error) {
+	return jwk.PublicSetOf(k.verifiers())
+}
+
+// startRotation 立即公开下一个密钥, 之后定期轮换: 使用已公开足够长时间的下一个密钥签名, 并公开新的下一个密钥.
+// 生成密钥失败时继续使用当前的密钥, 下次再试
+func (k *signingKeys) startRotation(r *keyRotation) (stop func()) {
+	publish := func() {
+		next, err := r.generate()
+		if err == nil {
+			err = k.publishNext(next)
+		}
+		if err != nil {
+			log.Printf("authn: generate next signing key failed: %v", err)
+			return
+		}
+		kid, _ := next.KeyID()
+		log.Printf("authn: published next signing key, kid=%s", kid)
+	}
+	publish()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if key, ok := k.promote(); ok {
+					kid, _ := key.KeyID()
+					log.Printf("authn: rotated signing key, kid=%s", kid)
+				}
+				k.mu.RLock()
+				pending := k.next != nil
+				k.mu.RUnlock()
+				if !pending {
+					publish()
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (s *Server) jwks(c echo.Context) error {
+	provider, ok := s.clients.(JWKSProvider)
+	if !ok {
+		return s.returnJSONError(c, 404, errNotFound, fmt.Errorf("jwks is not supported"))
+	}
+
+	set, err := provider.PublicKeys(c.Request().Context())
+	if err != nil {
+		return s.returnJSONError(c, 500, "server_error", err)
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, fmt.Sprintf("max-age=%d", int(jwksMaxAge.Seconds())))
+	return c.JSON(200, set)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_jwks(t *testing.T) {
+	store := newTestJWTAuthnStore(t, NewMemoryClientRegistry())
+	store.addClient("client", "secret")
+	e := New(0, WithAuthnStore(store)).newEcho()
+
+	fetchJWKS := func() jwk.Set {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/jwks.json", nil))
+		require.Equal(t, 200, rec.Code)
+		set, err := jwk.Parse(rec.Body.Bytes())
+		require.NoError(t, err)
+		return set
+	}
+	issue := func() string {
+		status, body := requestToken(t, e, url.Values{"client_id": {"client"}, "client_secret": {"secret"}})
+		require.Equal(t, 200, status)
+		return body["token"].(map[string]any)["access_token"].(string)
+	}
+
+	old := issue()
+
+	// 下游可以用公开的公钥自行校验token
+	set := fetchJWKS()
+	require.Equal(t, 1, set.Len())
+	key, _ := set.Key(0)
+	_, isPrivate := key.(jwk.ECDSAPrivateKey)
+	assert.False(t, isPrivate)
+	_, err := jwt.Parse([]byte(old), jwt.WithKeySet(set))
+	require.NoError(t, err)
+
+	// 轮换后, 之前签发的token仍然有效
+	require.NoError(t, store.keys.rotate(newTestKey(t)))
+	assert.Equal(t, 2, fetchJWKS().Len())
+
+	clientid, err := store.Verify(context.TODO(), old)
+	require.NoError(t, err)
+	assert.Equal(t, "client", clientid)
+
+	_, err = jwt.Parse([]byte(issue()), jwt.WithKeySet(set))
+	assert.Error(t, err, "signed by the new key")
+	_, err = jwt.Parse([]byte(issue()), jwt.WithKeySet(fetchJWKS()))
+	assert.NoError(t, err)
+
+	// 之前的密钥过期后不再用于校验
+	store.keys.retired[0].until = time.Now().Add(-time.Second)
+	_, err = store.Verify(context.TODO(), old)
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetchJWKS().Len())
+
+	// .well-known中返回jwks的地址
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/.well-known", nil))
+	assert.Contains(t, rec.Body.String(), `"jwks_uri":"http://example.com/v1/jwks.json"`)
+}
+
+func Test_signingKeys_startRotation(t *testing.T) {
+	keys, err := newSigningKeys(newTestKey(t), time.Hour)
+	require.NoError(t, err)
+	first, _ := keys.signer().KeyID()
+	assert.NotEmpty(t, first, "kid is assigned")
+
+	keys.prepublish = 100 * time.Millisecond
+	stop := keys.startRotation(&keyRotation{
+		interval: 10 * time.Millisecond,
+		generate: func() (jwk.Key, error) { return newTestKey(t), nil },
+	})
+	defer stop()
+
+	// 下一个密钥在用于签名之前已经公开
+	public, err := keys.public()
+	require.NoError(t, err)
+	require.Equal(t, 2, public.Len())
+	next, _ := public.Key(1)
+	nextKid, _ := next.KeyID()
+	assert.NotEqual(t, first, nextKid)
+	kid, _ := keys.signer().KeyID()
+	assert.Equal(t, first, kid)
+
+	assert.Eventually(t, func() bool {
+		kid, _ := keys.signer().KeyID()
+		return kid != first
+	}, time.Second, 10*time.Millisecond)
+	kid, _ = keys.signer().KeyID()
+	assert.Equal(t, nextKid, kid)
+
+	noAlg, err := jwk.Import([]byte("secret"))
+	require.NoError(t, err)
+	_, err = newSigningKeys(noAlg, time.Hour)
+	assert.ErrorContains(t, err, "must have alg")
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+)
+
+// OIDCConfig 校验外部OIDC issuer(如企业的IdP)签发的token的配置
+type OIDCConfig struct {
+	// token的iss须与Issuer一致
+	Issuer string
+	// token的aud须包含Audience
+	Audience string
+
+	// issuer的公钥(JWK Set), JWKSURL与JWKSFile二选一
+	JWKSURL  string
+	JWKSFile string
+	// 公钥的缓存时间, 默认1小时. 遇到无法校验的token(如issuer轮换了密钥)时提前刷新, 但间隔不小于MinRefreshInterval
+	RefreshInterval time.Duration
+	// 两次刷新公钥的最小间隔, 默认1分钟
+	MinRefreshInterval time.Duration
+	// 获取JWKSURL使用的http client, 默认为http.DefaultClient
+	HTTPClient *http.Client
+
+	// 作为client_id的claim, 默认为sub; 如azp, client_id
+	ClientIDClaim string
+}
+
+// WithOIDCAuthnStore 接受外部OIDC issuer签发的token, 见NewOIDCAuthnStore. 配置错误时, Start返回错误
+func WithOIDCAuthnStore(cfg OIDCConfig) Option {
+	store, err := NewOIDCAuthnStore(cfg)
+	if err != nil {
+		return withError(err)
+	}
+	return WithAuthnStore(store)
+}
+
+// NewOIDCAuthnStore 校验外部OIDC issuer签发的JWT token: 以issuer的公钥校验签名, 并校验iss, aud以及exp.
+// 不颁发token(/v1/token返回401), token的scope为DefaultScopes
+func NewOIDCAuthnStore(cfg OIDCConfig) (AuthnStore, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("oidc: issuer and audience are required")
+	}
+	if (cfg.JWKSURL == "") == (cfg.JWKSFile == "") {
+		return nil, errors.New("oidc: exactly one of jwks url and jwks file is required")
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	if cfg.MinRefreshInterval <= 0 {
+		cfg.MinRefreshInterval = time.Minute
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.ClientIDClaim == "" {
+		cfg.ClientIDClaim = jwt.SubjectKey
+	}
+
+	return &oidcAuthnStore{cfg: cfg}, nil
+}
+
+// oidcAuthnStore 校验外部issuer签发的token, 缓存issuer的公钥
+type oidcAuthnStore struct {
+	cfg OIDCConfig
+
+	mu      sync.Mutex
+	keys    jwk.Set
+	fetched time.Time
+}
+
+// interface compliance
+var _ AuthnStore = (*oidcAuthnStore)(nil)
+
+// Auth 实现了AuthnStore接口, token由外部issuer颁发
+func (s *oidcAuthnStore) Auth(context.Context, string, string) (*spec.Token, error) {
+	return nil, fmt.Errorf("access tokens are issued by %s", s.cfg.Issuer)
+}
+
+// Verify 实现了AuthnStore接口, 返回ClientIDClaim的值作为client_id.
+// 校验失败且公钥可以刷新时, 刷新公钥后重试一次
+func (s *oidcAuthnStore) Verify(ctx context.Context, tok string) (string, error) {
+	keys, err := s.publicKeys(ctx, false)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := s.parse(keys, tok)
+	if err != nil {
+		refreshed, rerr := s.publicKeys(ctx, true)
+		if rerr != nil || refreshed == keys {
+			return "", err
+		}
+		if token, err = s.parse(refreshed, tok); err != nil {
+			return "", err
+		}
+	}
+
+	var clientid string
+	if err := token.Get(s.cfg.ClientIDClaim, &clientid); err != nil || clientid == "" {
+		return "", fmt.Errorf("missing claim %q", s.cfg.ClientIDClaim)
+	}
+	return clientid, nil
+}
+
+func (s *oidcAuthnStore) parse(keys jwk.Set, tok string) (jwt.Token, error) {
+	// issuer的公钥可能没有alg, 按密钥类型推断; 没有kid的token依次尝试全部密钥
+	return jwt.Parse([]byte(tok),
+		jwt.WithKeySet(keys, jws.WithRequireKid(false), jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithAcceptableSkew(tokenSkew),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.cfg.Audience),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+	)
+}
+
+// publicKeys 返回缓存的公钥, 超过RefreshInterval时重新加载;
+// force为true时, 距上次加载超过MinRefreshInterval即重新加载. 加载失败时继续使用之前的公钥
+func (s *oidcAuthnStore) publicKeys(ctx context.Context, force bool) (jwk.Set, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	age := time.Since(s.fetched)
+	if s.keys != nil && age < s.cfg.RefreshInterval && (!force || age < s.cfg.MinRefreshInterval) {
+		return s.keys, nil
+	}
+
+	keys, err := s.load(ctx)
+	if err != nil {
+		if s.keys == nil {
+			return nil, &UnavailableError{Source: s.source(), Err: err}
+		}
+		log.Printf("oidc: reload jwks from %s failed, keep using the cached keys: %v", s.source(), err)
+		// 避免每个请求都重试
+		s.fetched = time.Now()
+		return s.keys, nil
+	}
+
+	s.keys, s.fetched = keys, time.Now()
+	return keys, nil
+}
+
+func (s *oidcAuthnStore) source() string {
+	if s.cfg.JWKSURL != "" {
+		return s.cfg.JWKSURL
+	}
+	return s.cfg.JWKSFile
+}
+
+func (s *oidcAuthnStore) load(ctx context.Context) (jwk.Set, error) {
+	if s.cfg.JWKSFile != "" {
+		b, err := os.ReadFile(s.cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		return jwk.Parse(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return jwk.Parse(b)
+}
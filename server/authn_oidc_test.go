@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuer = "https://idp.example.com"
+
+// testIdP 模拟外部issuer, 通过httptest提供JWKS
+type testIdP struct {
+	mu      sync.Mutex
+	key     jwk.Key
+	fetches atomic.Int32
+	srv     *httptest.Server
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{key: newTestKey(t)}
+	require.NoError(t, jwk.AssignKeyID(idp.key))
+	idp.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		idp.fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(idp.jwks(t))
+	}))
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *testIdP) jwks(t *testing.T) []byte {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	public, err := jwk.PublicKeyOf(idp.key)
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(public))
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+	return b
+}
+
+// rotate issuer使用新的密钥签名, JWKS中只有新的公钥
+func (idp *testIdP) rotate(t *testing.T) {
+	key := newTestKey(t)
+	require.NoError(t, jwk.AssignKeyID(key))
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key = key
+}
+
+func (idp *testIdP) issue(t *testing.T, claims map[string]any) string {
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, testIssuer)
+	_ = token.Set(jwt.AudienceKey, "syncdemo")
+	_ = token.Set(jwt.SubjectKey, "user-or-app")
+	_ = token.Set("azp", "hr-app")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour).Unix())
+	for k, v := range claims {
+		_ = token.Set(k, v)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	alg, _ := idp.key.Algorithm()
+	b, err := jwt.Sign(token, jwt.WithKey(alg, idp.key))
+	require.NoError(t, err)
+	return string(b)
+}
+
+func Test_oidcAuthnStore(t *testing.T) {
+	idp := newTestIdP(t)
+	store, err := NewOIDCAuthnStore(OIDCConfig{
+		Issuer: testIssuer, Audience: "syncdemo", JWKSURL: idp.srv.URL, ClientIDClaim: "azp",
+	})
+	require.NoError(t, err)
+
+	clientid, err := store.Verify(context.TODO(), idp.issue(t, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "hr-app", clientid)
+
+	for name, claims := range map[string]map[string]any{
+		"wrong iss": {jwt.IssuerKey: "https://other.example.com"},
+		"wrong aud": {jwt.AudienceKey: "other"},
+		"expired":   {jwt.ExpirationKey: time.Now().Add(-time.Hour).Unix()},
+		"no azp":    {"azp": ""},
+	} {
+		_, err := store.Verify(context.TODO(), idp.issue(t, claims))
+		assert.Error(t, err, name)
+	}
+	// 公钥已缓存
+	assert.EqualValues(t, 1, idp.fetches.Load())
+
+	_, err = store.Auth(context.TODO(), "id", "secret")
+	assert.Error(t, err)
+}
+
+func Test_oidcAuthnStore_refresh(t *testing.T) {
+	idp := newTestIdP(t)
+	store, err := NewOIDCAuthnStore(OIDCConfig{
+		Issuer: testIssuer, Audience: "syncdemo", JWKSURL: idp.srv.URL, MinRefreshInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+
+	clientid, err := store.Verify(context.TODO(), idp.issue(t, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "user-or-app", clientid)
+
+	// issuer轮换密钥后, 刷新公钥
+	idp.rotate(t)
+	_, err = store.Verify(context.TODO(), idp.issue(t, nil))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, idp.fetches.Load())
+
+	// 缓存过期但JWKS不可用时, 继续使用缓存的公钥
+	store.(*oidcAuthnStore).cfg.RefreshInterval = time.Nanosecond
+	idp.srv.Close()
+	_, err = store.Verify(context.TODO(), idp.issue(t, nil))
+	assert.NoError(t, err)
+}
+
+func Test_oidcAuthnStore_file(t *testing.T) {
+	idp := newTestIdP(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(file, idp.jwks(t), 0o600))
+
+	e := New(0, WithOIDCAuthnStore(OIDCConfig{Issuer: testIssuer, Audience: "syncdemo", JWKSFile: file})).newEcho()
+
+	req := httptest.NewRequest("GET", "/v1/depts", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+idp.issue(t, nil))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	// 只有读取的scope
+	req = httptest.NewRequest("DELETE", "/v1/admin/users/uid-1", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+idp.issue(t, nil))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 403, rec.Code)
+}
+
+func Test_NewOIDCAuthnStore_invalid(t *testing.T) {
+	_, err := NewOIDCAuthnStore(OIDCConfig{Issuer: testIssuer, Audience: "syncdemo"})
+	assert.Error(t, err)
+	_, err = NewOIDCAuthnStore(OIDCConfig{Audience: "syncdemo", JWKSFile: "jwks.json"})
+	assert.Error(t, err)
+	assert.Error(t, New(0, WithOIDCAuthnStore(OIDCConfig{})).Err())
+}
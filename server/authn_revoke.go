@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+)
+
+// RevocableAuthnStore 可选接口, 支持撤销token(RFC 7009)和查询token状态(RFC 7662)的AuthnStore可以实现该接口.
+// 实现后, 服务提供/v1/token/revoke和/v1/token/introspect接口, 调用时以client_id/client_secret(表单或HTTP Basic)鉴权
+type RevocableAuthnStore interface {
+	AuthnStore
+
+	// AuthenticateClient 校验client_id/client_secret的合法性
+	AuthenticateClient(ctx context.Context, clientid, clientsecret string) error
+
+	// Revoke 撤销client的token, 之后Verify将拒绝该token. token无效或已过期时忽略;
+	// token不是颁发给该client时返回ErrTokenNotOwned
+	Revoke(ctx context.Context, clientid, tok string) error
+
+	// Introspect 返回token的状态, token无效、过期或已撤销时返回Active为false
+	Introspect(ctx context.Context, tok string) (*TokenIntrospection, error)
+}
+
+// ErrTokenNotOwned 撤销的token不是颁发给请求者的
+var ErrTokenNotOwned = errors.New("token was not issued to the client")
+
+// TokenIntrospection token的状态, 见RFC 7662. token无效时只有Active字段
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Nbf       int64  `json:"nbf,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// RevocationList 已撤销的token(按jti记录), Verify时查询
+type RevocationList interface {
+	// Revoke 撤销jti对应的token. until为token的过期时间, 之后可以删除该记录
+	Revoke(ctx context.Context, jti string, until time.Time) error
+	// Revoked jti对应的token是否已撤销
+	Revoked(ctx context.Context, jti string) (bool, error)
+}
+
+// AtomicRevocationList 可选接口, 支持原子地检查并撤销的RevocationList可以实现该接口(内置的实现均已实现).
+// 用于client assertion的jti防重放; 未实现时只在同一实例内保证原子性, 多个实例共享的list应实现该接口
+type AtomicRevocationList interface {
+	RevocationList
+	// RevokeIfAbsent jti未撤销时撤销并返回true, 已撤销时不修改并返回false
+	RevokeIfAbsent(ctx context.Context, jti string, until time.Time) (bool, error)
+}
+
+// WithRevocationList 使用list记录已撤销的token, 默认记录在内存中(重启后丢失).
+// 仅对WithJWTAuthnStore等内置的JWT AuthnStore生效, 见NewFileRevocationList
+func WithRevocationList(list RevocationList) Option {
+	return func(srv *Server) {
+		srv.revocations = list
+	}
+}
+
+// revocable 可以设置RevocationList的AuthnStore
+type revocable interface {
+	setRevocationList(list RevocationList)
+}
+
+// NewMemoryRevocationList 内存中的RevocationList
+func NewMemoryRevocationList() RevocationList {
+	return &memoryRevocations{revoked: map[string]time.Time{}}
+}
+
+type memoryRevocations struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// interface compliance
+var (
+	_ AtomicRevocationList = (*memoryRevocations)(nil)
+	_ AtomicRevocationList = (*fileRevocations)(nil)
+)
+
+// Revoke implements RevocationList.
+func (l *memoryRevocations) Revoke(_ context.Context, jti string, until time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.revokeLocked(jti, until)
+	return nil
+}
+
+// RevokeIfAbsent implements AtomicRevocationList.
+func (l *memoryRevocations) RevokeIfAbsent(_ context.Context, jti string, until time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.revoked[jti]; found {
+		return false, nil
+	}
+	l.revokeLocked(jti, until)
+	return true, nil
+}
+
+// revokeLocked 记录jti, 同时删除已过期的记录
+func (l *memoryRevocations) revokeLocked(jti string, until time.Time) {
+	now := time.Now()
+	for id, t := range l.revoked {
+		if !t.After(now) {
+			delete(l.revoked, id)
+		}
+	}
+	l.revoked[jti] = until
+}
+
+// Revoked implements RevocationList.
+func (l *memoryRevocations) Revoked(_ context.Context, jti string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, found := l.revoked[jti]
+	return found, nil
+}
+
+// NewFileRevocationList 保存在文件中的RevocationList, 多个实例可以共享同一个文件, 修改时通过file.lock互斥.
+// 文件格式同通讯录文件(根据扩展名判断); 文件不存在时为空, 撤销时创建; 文件被修改后, 下次查询时重新加载
+func NewFileRevocationList(file string) (RevocationList, error) {
+	l := &fileRevocations{file: file}
+	if _, err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+type fileRevocations struct {
+	file string
+
+	mu      sync.Mutex
+	stamp   fileStamp
+	revoked []*revokedToken
+}
+
+type revokedToken struct {
+	JTI   string    `json:"jti"`
+	Until time.Time `json:"until"`
+}
+
+func (l *fileRevocations) load() ([]*revokedToken, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadLocked()
+}
+
+func (l *fileRevocations) loadLocked() ([]*revokedToken, error) {
+	stamp := statFile(l.file)
+	if l.revoked != nil && stamp.equal(l.stamp) {
+		return l.revoked, nil
+	}
+
+	revoked, err := newJSONFileStore[*revokedToken](l.file).read()
+	if errors.Is(err, os.ErrNotExist) {
+		revoked, err = []*revokedToken{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.revoked, l.stamp = revoked, stamp
+	return revoked, nil
+}
+
+// Revoke implements RevocationList. 同时删除已过期的记录
+func (l *fileRevocations) Revoke(ctx context.Context, jti string, until time.Time) error {
+	_, err := l.revoke(ctx, jti, until, false)
+	return err
+}
+
+// RevokeIfAbsent implements AtomicRevocationList. 共享同一文件的多个实例之间通过锁文件互斥
+func (l *fileRevocations) RevokeIfAbsent(ctx context.Context, jti string, until time.Time) (bool, error) {
+	return l.revoke(ctx, jti, until, true)
+}
+
+// revoke 持有锁文件, 读取文件的最新内容后记录jti并写回, 同时删除已过期的记录.
+// ifAbsent为true且jti已撤销时不修改, 返回false
+func (l *fileRevocations) revoke(ctx context.Context, jti string, until time.Time, ifAbsent bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	unlock, err := lockFile(ctx, l.file)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// 其他实例修改后文件的修改时间和大小可能不变, 总是重新读取
+	l.revoked = nil
+	current, err := l.loadLocked()
+	if err != nil {
+		return false, err
+	}
+	if ifAbsent && slices.ContainsFunc(current, func(r *revokedToken) bool { return r.JTI == jti }) {
+		return false, nil
+	}
+
+	now := time.Now()
+	revoked := []*revokedToken{{JTI: jti, Until: until}}
+	for _, r := range current {
+		if r.JTI != jti && r.Until.After(now) {
+			revoked = append(revoked, r)
+		}
+	}
+
+	if err := writeFileAtomic(l.file, func(w io.Writer) error {
+		return encodeFile(l.file, w, revoked)
+	}); err != nil {
+		return false, err
+	}
+	l.revoked, l.stamp = revoked, statFile(l.file)
+	return true, nil
+}
+
+// 等待锁文件的最长时间, 以及锁文件失效(持有者异常退出)的时间
+const (
+	fileLockWait  = 5 * time.Second
+	fileLockStale = 30 * time.Second
+)
+
+// lockFile 以独占方式创建file.lock, 作为共享同一文件的多个实例之间的锁, 返回释放锁的函数
+func lockFile(ctx context.Context, file string) (func(), error) {
+	lock := file + ".lock"
+	ctx, cancel := context.WithTimeout(ctx, fileLockWait)
+	defer cancel()
+
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { _ = os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > fileLockStale {
+			_ = os.Remove(lock)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lock %s: %w", lock, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Revoked implements RevocationList.
+func (l *fileRevocations) Revoked(_ context.Context, jti string) (bool, error) {
+	revoked, err := l.load()
+	if err != nil {
+		return false, &UnavailableError{Source: l.file, Err: err}
+	}
+	return slices.ContainsFunc(revoked, func(r *revokedToken) bool { return r.JTI == jti }), nil
+}
+
+// revokeRequest 撤销token以及查询token状态的请求, client_id/client_secret也可以通过HTTP Basic传递
+type revokeRequest struct {
+	Token         string `json:"token" form:"token"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+	ClientID      string `json:"client_id" form:"client_id"`
+	ClientSecret  string `json:"client_secret" form:"client_secret"`
+
+	ClientAssertionType string `json:"client_assertion_type" form:"client_assertion_type"`
+	ClientAssertion     string `json:"client_assertion" form:"client_assertion"`
+}
+
+// bindRevokeRequest 解析请求, HTTP Basic中的client_id/client_secret优先
+func bindRevokeRequest(c echo.Context) (*revokeRequest, error) {
+	req := &revokeRequest{}
+	if err := c.Bind(req); err != nil {
+		return nil, err
+	}
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		req.ClientID, req.ClientSecret = id, secret
+	}
+	if req.Token == "" {
+		return nil, errors.New("missing token")
+	}
+	return req, nil
+}
+
+// authenticateRevokeRequest 校验请求者, 返回其client_id.
+// AuthnStore实现了CredentialAuthnStore时, 支持的鉴权方式同/v1/token
+func (s *Server) authenticateRevokeRequest(c echo.Context, store RevocableAuthnStore, req *revokeRequest) (
+	string, error,
+) {
+	ctx := c.Request().Context()
+	if multi, ok := store.(CredentialAuthnStore); ok {
+		cred, err := s.clientCredentials(c, req.ClientID, req.ClientSecret, req.ClientAssertionType, req.ClientAssertion)
+		if err != nil {
+			return "", err
+		}
+		return multi.AuthenticateCredentials(ctx, cred)
+	}
+	return req.ClientID, store.AuthenticateClient(ctx, req.ClientID, req.ClientSecret)
+}
+
+// revokeToken 撤销token(RFC 7009), 成功或token无效时均返回200
+func (s *Server) revokeToken(c echo.Context) error {
+	store, ok := s.clients.(RevocableAuthnStore)
+	if !ok {
+		return s.returnRevocationNotSupported(c)
+	}
+	req, err := bindRevokeRequest(c)
+	if err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	clientid, err := s.authenticateRevokeRequest(c, store, req)
+	if err != nil {
+		return s.returnJSONError(c, 401, spec.ErrInvalidClient, err)
+	}
+
+	err = store.Revoke(c.Request().Context(), clientid, req.Token)
+	if errors.Is(err, ErrTokenNotOwned) {
+		return s.returnJSONError(c, 403, spec.ErrInvalidRequest, err)
+	}
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	return c.NoContent(200)
+}
+
+// introspectToken 查询token状态(RFC 7662). 只能查询颁发给自己的token, 管理员client可以查询全部token
+func (s *Server) introspectToken(c echo.Context) error {
+	store, ok := s.clients.(RevocableAuthnStore)
+	if !ok {
+		return s.returnRevocationNotSupported(c)
+	}
+	req, err := bindRevokeRequest(c)
+	if err != nil {
+		return s.returnBadRequest(c, err)
+	}
+	clientid, err := s.authenticateRevokeRequest(c, store, req)
+	if err != nil {
+		return s.returnJSONError(c, 401, spec.ErrInvalidClient, err)
+	}
+
+	info, err := store.Introspect(c.Request().Context(), req.Token)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	// clientid由RevocableAuthnStore本身鉴权, 不会是其他AuthnStore的API key或OIDC的sub
+	if info.Active && info.ClientID != clientid && !s.admins[clientid] {
+		info = &TokenIntrospection{}
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.JSON(200, info)
+}
+
+func (s *Server) returnRevocationNotSupported(c echo.Context) error {
+	return s.returnJSONError(c, 404, errNotFound, errors.New("token revocation is not supported"))
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_revokeToken(t *testing.T) {
+	e := New(0,
+		WithJWTAuthnStore(newTestKey(t), time.Hour, "c1", "secret", "c2", "secret", "admin", "secret"),
+		WithAdminClients("admin"),
+	).newEcho()
+
+	accessToken := func(clientID string) string {
+		status, body := requestToken(t, e, url.Values{"client_id": {clientID}, "client_secret": {"secret"}})
+		require.Equal(t, 200, status, body)
+		return body["token"].(map[string]any)["access_token"].(string)
+	}
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	introspect := func(clientID, tok string) map[string]any {
+		rec := post("/v1/token/introspect", url.Values{
+			"client_id": {clientID}, "client_secret": {"secret"}, "token": {tok},
+		})
+		require.Equal(t, 200, rec.Code, rec.Body.String())
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body
+	}
+	listDepts := func(tok string) int {
+		req := httptest.NewRequest("GET", "/v1/depts", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tok := accessToken("c1")
+	info := introspect("c1", tok)
+	assert.Equal(t, true, info["active"])
+	assert.Equal(t, "c1", info["client_id"])
+	assert.Equal(t, strings.Join(DefaultScopes, " "), info["scope"])
+	assert.NotEmpty(t, info["jti"])
+
+	// 其他client只能看到active为false, 管理员client可以查询
+	assert.Equal(t, map[string]any{"active": false}, introspect("c2", tok))
+	assert.Equal(t, true, introspect("admin", tok)["active"])
+
+	// 鉴权失败
+	rec := post("/v1/token/revoke", url.Values{"client_id": {"c1"}, "client_secret": {"wrong"}, "token": {tok}})
+	assert.Equal(t, 401, rec.Code)
+	// 不能撤销其他client的token
+	rec = post("/v1/token/revoke", url.Values{"client_id": {"c2"}, "client_secret": {"secret"}, "token": {tok}})
+	assert.Equal(t, 403, rec.Code)
+
+	// 使用HTTP Basic鉴权撤销, 之后token立即失效
+	other := accessToken("c1")
+	req := httptest.NewRequest("POST", "/v1/token/revoke", strings.NewReader(url.Values{"token": {tok}}.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.SetBasicAuth("c1", "secret")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	assert.Equal(t, 401, listDepts(tok))
+	assert.Equal(t, map[string]any{"active": false}, introspect("c1", tok))
+	// 同一client的其他token不受影响
+	assert.Equal(t, 200, listDepts(other))
+
+	// 无效的token也返回200
+	rec = post("/v1/token/revoke", url.Values{"client_id": {"c1"}, "client_secret": {"secret"}, "token": {"invalid"}})
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, map[string]any{"active": false}, introspect("c1", "invalid"))
+}
+
+func Test_revokeToken_notSupported(t *testing.T) {
+	e := New(0).newEcho()
+
+	req := httptest.NewRequest("POST", "/v1/token/revoke", strings.NewReader("token=any"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 404, rec.Code)
+}
+
+func Test_fileRevocations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked.json")
+
+	list, err := NewFileRevocationList(file)
+	require.NoError(t, err)
+	require.NoError(t, list.Revoke(context.TODO(), "expired", time.Now().Add(-time.Minute)))
+	require.NoError(t, list.Revoke(context.TODO(), "jti-1", time.Now().Add(time.Hour)))
+
+	// 其他实例共享同一个文件
+	other, err := NewFileRevocationList(file)
+	require.NoError(t, err)
+	revoked, err := other.Revoked(context.TODO(), "jti-1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = other.Revoked(context.TODO(), "jti-2")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	// 撤销时删除已过期的记录
+	require.NoError(t, other.Revoke(context.TODO(), "jti-2", time.Now().Add(time.Hour)))
+	revoked, err = list.Revoked(context.TODO(), "expired")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	revoked, err = list.Revoked(context.TODO(), "jti-2")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+}
+
+func Test_RevokeIfAbsent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked.json")
+	list, err := NewFileRevocationList(file)
+	require.NoError(t, err)
+	// 其他实例共享同一个文件
+	other, err := NewFileRevocationList(file)
+	require.NoError(t, err)
+
+	for name, lists := range map[string][]RevocationList{
+		"memory": {NewMemoryRevocationList()},
+		"file":   {list, other},
+	} {
+		var first atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(l AtomicRevocationList) {
+				defer wg.Done()
+				ok, err := l.RevokeIfAbsent(context.TODO(), "jti-1", time.Now().Add(time.Hour))
+				assert.NoError(t, err, name)
+				if ok {
+					first.Add(1)
+				}
+			}(lists[i%len(lists)].(AtomicRevocationList))
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), first.Load(), name)
+
+		revoked, err := lists[0].Revoked(context.TODO(), "jti-1")
+		require.NoError(t, err, name)
+		assert.True(t, revoked, name)
+	}
+
+	// 持有者异常退出后残留的锁文件失效
+	lock := file + ".lock"
+	require.NoError(t, os.WriteFile(lock, nil, 0o600))
+	stale := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(lock, stale, stale))
+	ok, err := other.(AtomicRevocationList).RevokeIfAbsent(context.TODO(), "jti-2", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoFileExists(t, lock)
+}
@@ -2,11 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	spec "github.com/idaaser/syncspecv1"
 	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
 	"github.com/lestrrat-go/jwx/v3/jwt"
 )
 
@@ -18,14 +25,48 @@ func WithAuthnStore(store AuthnStore) Option {
 }
 
 // WithJWTAuthnStore 使用JWT token的AuthnStore, 用内存来管理client_id/client_secret, 以及使用JWT的token来鉴权
-// 注: 使用RSA格式的私钥来签发鉴权token, 私钥长度建议>=2048
+// 注: 使用RSA格式的私钥来签发鉴权token, 私钥长度建议>=2048; client允许申请的scope为DefaultScopes.
+// 私钥须设置alg, 没有kid时以其指纹作为kid; 公钥通过/v1/jwks.json公开, 见WithKeyRotation.
+// 私钥或client无效时, Start返回错误
 func WithJWTAuthnStore(key jwk.Key, exp time.Duration, clientIDAndSecrets ...string) Option {
-	store := &jwtAuthnStore{
-		clients: map[string]string{},
-		key:     key, exp: exp,
+	store, err := newJWTAuthnStore(key, exp, NewMemoryClientRegistry())
+	if err == nil {
+		err = store.addClient(clientIDAndSecrets...)
 	}
-	store.addClient(clientIDAndSecrets...)
+	if err != nil {
+		return withError(err)
+	}
+	return WithAuthnStore(store)
+}
 
+// JWTClient 注册到JWT AuthnStore的client
+type JWTClient struct {
+	ID     string
+	Secret string
+	// 允许申请的scope, 为空时为DefaultScopes
+	Scopes []string
+}
+
+// WithJWTAuthnStoreClients 同WithJWTAuthnStore, 可以为每个client设置允许申请的scope
+func WithJWTAuthnStoreClients(key jwk.Key, exp time.Duration, clients ...JWTClient) Option {
+	registry := NewMemoryClientRegistry()
+	for _, c := range clients {
+		client, err := newSecretClient(c.ID, c.Secret, c.Scopes)
+		if err != nil {
+			return withError(err)
+		}
+		_ = registry.SaveClient(context.Background(), client)
+	}
+	return WithJWTAuthnStoreRegistry(key, exp, registry)
+}
+
+// WithJWTAuthnStoreRegistry 同WithJWTAuthnStore, client保存在registry中(见NewFileClientRegistry, NewSQLClientRegistry).
+// client_secret以bcrypt hash保存; 停用或过期的client不能申请token, 已颁发的token也随即失效
+func WithJWTAuthnStoreRegistry(key jwk.Key, exp time.Duration, registry ClientRegistry) Option {
+	store, err := newJWTAuthnStore(key, exp, registry)
+	if err != nil {
+		return withError(err)
+	}
 	return WithAuthnStore(store)
 }
 
@@ -38,8 +79,26 @@ type AuthnStore interface {
 	Verify(ctx context.Context, tok string) (string, error)
 }
 
-// 允许任何access_token. 注: 仅用于测试
-type allowAnyAs struct{}
+// ScopedAuthnStore 可选接口, 支持OAuth2 scope的AuthnStore可以实现该接口.
+// 未实现时, 所有token都只有DefaultScopes
+type ScopedAuthnStore interface {
+	AuthnStore
+
+	// AuthWithScope 颁发access_token, 并返回授予的scope.
+	// scopes为空时授予client允许的全部scope; 包含client不允许的scope时返回ErrInvalidScope
+	AuthWithScope(ctx context.Context, clientid, clientsecret string, scopes []string) (*spec.Token, []string, error)
+
+	// VerifyWithScope 校验token的合法性, 若校验成功返回token对应的clientid以及scope
+	VerifyWithScope(ctx context.Context, tok string) (string, []string, error)
+}
+
+// ErrInvalidScope 申请的scope不存在或client不允许申请
+var ErrInvalidScope = errors.New("invalid scope")
+
+// 允许任何access_token, client_id为any_client. 注: 仅用于测试
+type allowAnyAs struct {
+	admin bool
+}
 
 func (s *allowAnyAs) Auth(ctx context.Context, clientid, clientsecret string) (*spec.Token, error) {
 	return &spec.Token{AccessToken: "any token", ExpiresIn: 7200}, nil
@@ -49,68 +108,292 @@ func (s *allowAnyAs) Verify(ctx context.Context, tok string) (string, error) {
 	return "any_client", nil
 }
 
-// 1. 使用map来维护client_id/client_secret
+// AuthWithScope 实现了ScopedAuthnStore接口, 不校验申请的scope
+func (s *allowAnyAs) AuthWithScope(ctx context.Context, clientid, clientsecret string, scopes []string) (
+	*spec.Token, []string, error,
+) {
+	if len(scopes) == 0 {
+		scopes = s.scopes()
+	}
+	tok, err := s.Auth(ctx, clientid, clientsecret)
+	return tok, scopes, err
+}
+
+// VerifyWithScope 实现了ScopedAuthnStore接口
+func (s *allowAnyAs) VerifyWithScope(ctx context.Context, tok string) (string, []string, error) {
+	return "any_client", s.scopes(), nil
+}
+
+func (s *allowAnyAs) scopes() []string {
+	if s.admin {
+		return append(slices.Clone(DefaultScopes), ScopeAdmin)
+	}
+	return DefaultScopes
+}
+
+func (s *allowAnyAs) setAdminClients(ids map[string]bool) {
+	s.admin = ids["any_client"]
+}
+
+// 1. 使用ClientRegistry来维护client, client_secret以bcrypt hash保存
 // 2. 使用JWT token(RS256签名算法)
+// 3. 每个client可以设置允许申请的scope, 颁发的token中以scope claim(空格分隔)记录授予的scope
+// 4. 签名密钥可以轮换, token header中的kid指明签名的密钥
+// 5. 每个token有唯一的jti, 撤销的token记录在RevocationList中
 type jwtAuthnStore struct {
-	clients map[string]string
+	registry    ClientRegistry
+	revocations RevocationList
+	// RevocationList未实现AtomicRevocationList时, 检查和记录client assertion的jti期间持有
+	usedMu sync.Mutex
+
+	keys *signingKeys
+	exp  time.Duration
 
-	key jwk.Key
-	exp time.Duration
+	// 允许申请ScopeAdmin的client, 见WithAdminClients
+	admins map[string]bool
 }
 
-// Auth 实现了AuthnStore接口, 生成一个token
-func (s *jwtAuthnStore) Auth(ctx context.Context, clientid, clientsecret string) (*spec.Token, error) {
-	if err := s.verifyClient(ctx, clientid, clientsecret); err != nil {
+// interface compliance
+var (
+	_ ScopedAuthnStore    = (*jwtAuthnStore)(nil)
+	_ RevocableAuthnStore = (*jwtAuthnStore)(nil)
+	_ JWKSProvider        = (*jwtAuthnStore)(nil)
+	_ keyRotator          = (*jwtAuthnStore)(nil)
+	_ revocable           = (*jwtAuthnStore)(nil)
+	_ adminGrantable      = (*jwtAuthnStore)(nil)
+)
+
+// token的exp/nbf允许的时钟偏差
+const tokenSkew = 2 * time.Minute
+
+func newJWTAuthnStore(key jwk.Key, exp time.Duration, registry ClientRegistry) (*jwtAuthnStore, error) {
+	keys, err := newSigningKeys(key, exp)
+	if err != nil {
 		return nil, err
 	}
 
-	return s.issueToken(ctx, clientid)
+	return &jwtAuthnStore{
+		registry: registry, revocations: NewMemoryRevocationList(),
+		keys: keys, exp: exp,
+	}, nil
+}
+
+func (s *jwtAuthnStore) setRevocationList(list RevocationList) {
+	s.revocations = list
+}
+
+// PublicKeys 实现了JWKSProvider接口
+func (s *jwtAuthnStore) PublicKeys(context.Context) (jwk.Set, error) {
+	return s.keys.public()
+}
+
+func (s *jwtAuthnStore) startRotation(r *keyRotation) (func(), error) {
+	return s.keys.startRotation(r), nil
+}
+
+// Auth 实现了AuthnStore接口, 生成一个token, 授予client允许的全部scope
+func (s *jwtAuthnStore) Auth(ctx context.Context, clientid, clientsecret string) (*spec.Token, error) {
+	tok, _, err := s.AuthWithScope(ctx, clientid, clientsecret, nil)
+	return tok, err
+}
+
+// AuthWithScope 实现了ScopedAuthnStore接口
+func (s *jwtAuthnStore) AuthWithScope(ctx context.Context, clientid, clientsecret string, scopes []string) (
+	*spec.Token, []string, error,
+) {
+	client, err := authenticateClient(ctx, s.registry, clientid, clientsecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.grant(ctx, client, scopes)
+}
+
+// grant 给已鉴权的client颁发token, scopes为空时授予client允许的全部scope
+func (s *jwtAuthnStore) grant(ctx context.Context, client *Client, scopes []string) (*spec.Token, []string, error) {
+	allowed := s.allowedScopes(client)
+	if len(scopes) == 0 {
+		scopes = allowed
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return nil, nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+
+	tok, err := s.issueToken(ctx, client.ID, scopes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tok, scopes, nil
 }
 
 func (s *jwtAuthnStore) Verify(ctx context.Context, tok string) (string, error) {
-	alg, _ := s.key.Algorithm()
-	token, err := jwt.Parse([]byte(tok),
-		jwt.WithKey(alg, s.key),
-		jwt.WithAcceptableSkew(2*time.Minute),
+	clientid, _, err := s.VerifyWithScope(ctx, tok)
+	return clientid, err
+}
+
+// VerifyWithScope 实现了ScopedAuthnStore接口.
+// client须仍为启用且未过期, 只返回client当前仍允许的scope; 没有scope claim的token(升级前颁发)视为DefaultScopes
+func (s *jwtAuthnStore) VerifyWithScope(ctx context.Context, tok string) (string, []string, error) {
+	_, client, scopes, err := s.parse(ctx, tok)
+	if err != nil {
+		return "", nil, err
+	}
+	return client.ID, scopes, nil
+}
+
+// AuthenticateClient 实现了RevocableAuthnStore接口, 其他鉴权方式见AuthenticateCredentials
+func (s *jwtAuthnStore) AuthenticateClient(ctx context.Context, clientid, clientsecret string) error {
+	_, err := authenticateClient(ctx, s.registry, clientid, clientsecret)
+	return err
+}
+
+// Revoke 实现了RevocableAuthnStore接口. 没有jti的token(升级前颁发)无法撤销, 只能停用client
+func (s *jwtAuthnStore) Revoke(ctx context.Context, clientid, tok string) error {
+	token, err := s.parseSigned(tok)
+	if err != nil {
+		return nil
+	}
+
+	if sub, _ := token.Subject(); sub != clientid {
+		return ErrTokenNotOwned
+	}
+	jti, ok := token.JwtID()
+	if !ok {
+		return nil
+	}
+	exp, _ := token.Expiration()
+	return s.revocations.Revoke(ctx, jti, exp.Add(tokenSkew))
+}
+
+// Introspect 实现了RevocableAuthnStore接口
+func (s *jwtAuthnStore) Introspect(ctx context.Context, tok string) (*TokenIntrospection, error) {
+	token, client, scopes, err := s.parse(ctx, tok)
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return &TokenIntrospection{}, nil
+	}
+
+	info := &TokenIntrospection{
+		Active:    true,
+		Scope:     strings.Join(scopes, " "),
+		ClientID:  client.ID,
+		TokenType: bearer,
+		Sub:       client.ID,
+	}
+	info.Jti, _ = token.JwtID()
+	if t, ok := token.Expiration(); ok {
+		info.Exp = t.Unix()
+	}
+	if t, ok := token.IssuedAt(); ok {
+		info.Iat = t.Unix()
+	}
+	if t, ok := token.NotBefore(); ok {
+		info.Nbf = t.Unix()
+	}
+	return info, nil
+}
+
+// parseSigned 校验token的签名以及有效期
+func (s *jwtAuthnStore) parseSigned(tok string) (jwt.Token, error) {
+	keys, err := s.keys.public()
+	if err != nil {
+		return nil, err
+	}
+	// 按token header中的kid选择密钥; 没有kid的token依次尝试全部密钥
+	return jwt.Parse([]byte(tok),
+		jwt.WithKeySet(keys, jws.WithRequireKid(false)),
+		jwt.WithAcceptableSkew(tokenSkew),
 		jwt.WithClaimValue("spec", "v1"),
 	)
+}
+
+// parse 校验token, 并返回token对应的client以及授予的scope; token已撤销或client已停用时校验失败
+func (s *jwtAuthnStore) parse(ctx context.Context, tok string) (jwt.Token, *Client, []string, error) {
+	token, err := s.parseSigned(tok)
 	if err != nil {
-		return "", err
+		return nil, nil, nil, err
+	}
+
+	if jti, ok := token.JwtID(); ok {
+		revoked, err := s.revocations.Revoked(ctx, jti)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if revoked {
+			return nil, nil, nil, errors.New("token has been revoked")
+		}
 	}
 
 	sub, _ := token.Subject()
-	if _, found := s.clients[sub]; !found {
-		return "", fmt.Errorf("invalid client_id %q", sub)
+	client, err := s.registry.GetClient(ctx, sub)
+	if errors.Is(err, ErrClientNotFound) || err == nil && !client.Active(time.Now()) {
+		return nil, nil, nil, fmt.Errorf("invalid client_id %q", sub)
+	}
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return sub, nil
-}
+	granted := DefaultScopes
+	var claim string
+	if err := token.Get(scopeClaim, &claim); err == nil {
+		granted = strings.Fields(claim)
+	}
 
-// verifyClient 校验 client_id/client_secret的合法性
-func (s *jwtAuthnStore) verifyClient(_ context.Context, clientid, clientsecret string) error {
-	found, ok := s.clients[clientid]
-	if !ok {
-		return fmt.Errorf("invalid client id or client secret")
+	allowed := s.allowedScopes(client)
+	scopes := []string{}
+	for _, scope := range granted {
+		if slices.Contains(allowed, scope) {
+			scopes = append(scopes, scope)
+		}
 	}
+	return token, client, scopes, nil
+}
 
-	if found != clientsecret {
-		return fmt.Errorf("invalid client id or client secret")
+// allowedScopes 返回client允许申请的scope, 管理员client还可以申请ScopeAdmin
+func (s *jwtAuthnStore) allowedScopes(client *Client) []string {
+	allowed := clientScopes(client)
+	if s.admins[client.ID] && !slices.Contains(allowed, ScopeAdmin) {
+		allowed = append(slices.Clone(allowed), ScopeAdmin)
 	}
+	return allowed
+}
 
-	return nil
+func (s *jwtAuthnStore) setAdminClients(ids map[string]bool) {
+	s.admins = ids
+}
+
+func clientScopes(client *Client) []string {
+	if len(client.Scopes) > 0 {
+		return client.Scopes
+	}
+	return DefaultScopes
 }
 
-func (s *jwtAuthnStore) issueToken(_ context.Context, clientid string) (*spec.Token, error) {
+// token中记录授予的scope的claim, 见RFC 9068
+const scopeClaim = "scope"
+
+func (s *jwtAuthnStore) issueToken(_ context.Context, clientid string, scopes []string) (*spec.Token, error) {
 	token := jwt.New()
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	_ = token.Set(jwt.JwtIDKey, jti)
 	_ = token.Set(jwt.SubjectKey, clientid)
 	_ = token.Set("spec", "v1")
+	_ = token.Set(scopeClaim, strings.Join(scopes, " "))
 	_ = token.Set(jwt.IssuedAtKey, time.Now().Unix())
 	_ = token.Set(jwt.NotBeforeKey, time.Now().Unix())
 	_ = token.Set(jwt.ExpirationKey, time.Now().Add(s.exp).Unix())
 
-	alg, _ := s.key.Algorithm()
+	key := s.keys.signer()
+	alg, _ := key.Algorithm()
 	tok, err := jwt.Sign(token,
-		jwt.WithKey(alg, s.key),
+		jwt.WithKey(alg, key),
 	)
 	if err != nil {
 		return nil, err
@@ -122,12 +405,38 @@ func (s *jwtAuthnStore) issueToken(_ context.Context, clientid string) (*spec.To
 	}, nil
 }
 
-func (s *jwtAuthnStore) addClient(clientIDAndSecrets ...string) {
+// newTokenID 生成token的jti(128位随机数)
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// addClient 添加client_id/client_secret成对的client
+func (s *jwtAuthnStore) addClient(clientIDAndSecrets ...string) error {
 	l := len(clientIDAndSecrets)
-	if l%2 == 0 {
-		for i := 0; i < l; i += 2 {
-			id, secret := clientIDAndSecrets[i], clientIDAndSecrets[i+1]
-			s.clients[id] = secret
+	if l%2 != 0 {
+		return errors.New("client id and secret must be given in pairs")
+	}
+	for i := 0; i < l; i += 2 {
+		client, err := newSecretClient(clientIDAndSecrets[i], clientIDAndSecrets[i+1], nil)
+		if err != nil {
+			return err
+		}
+		if err := s.registry.SaveClient(context.Background(), client); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// newSecretClient 用明文的client_secret创建启用的client
+func newSecretClient(id, secret string, scopes []string) (*Client, error) {
+	hash, err := HashSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("client %q: %w", id, err)
+	}
+	return &Client{ID: id, SecretHash: hash, Enabled: true, Scopes: scopes, CreatedAt: time.Now()}, nil
 }
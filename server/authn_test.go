@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) jwk.Key {
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	k, err := jwk.Import(raw)
+	require.NoError(t, err)
+	require.NoError(t, k.Set(jwk.AlgorithmKey, "ES256"))
+	return k
+}
+
+// requestToken 请求access_token, 返回状态码以及响应
+func requestToken(t *testing.T, e *echo.Echo, form url.Values) (int, map[string]any) {
+	req := httptest.NewRequest("POST", "/v1/token", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	body := map[string]any{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec.Code, body
+}
+
+func Test_scopes(t *testing.T) {
+	e := New(0, WithJWTAuthnStoreClients(newTestKey(t), time.Hour,
+		JWTClient{ID: "reader", Secret: "secret"},
+		JWTClient{ID: "admin", Secret: "secret", Scopes: []string{ScopeDeptsRead, ScopeAdmin}},
+	)).newEcho()
+
+	accessToken := func(clientID, scope string) string {
+		status, body := requestToken(t, e, url.Values{
+			"client_id": {clientID}, "client_secret": {"secret"}, "scope": {scope},
+		})
+		require.Equal(t, 200, status, body)
+		return body["token"].(map[string]any)["access_token"].(string)
+	}
+	call := func(method, path, tok string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 不指定scope时, 授予client允许的全部scope
+	status, body := requestToken(t, e, url.Values{"client_id": {"reader"}, "client_secret": {"secret"}})
+	require.Equal(t, 200, status)
+	assert.Equal(t, strings.Join(DefaultScopes, " "), body["token"].(map[string]any)["scope"])
+
+	tok := accessToken("reader", ScopeDeptsRead)
+	assert.Equal(t, 200, call("GET", "/v1/depts", tok).Code)
+
+	rec := call("GET", "/v1/users?dept_id=1", tok)
+	assert.Equal(t, 403, rec.Code)
+	assert.Contains(t, rec.Body.String(), errInsufficientScope)
+	assert.Contains(t, rec.Header().Get(echo.HeaderWWWAuthenticate), `scope="`+ScopeUsersRead+`"`)
+	assert.Equal(t, 403, call("GET", "/v1/changes", tok).Code)
+	assert.Equal(t, 403, call("DELETE", "/v1/admin/users/uid-1", accessToken("reader", "")).Code)
+
+	// client不允许的scope
+	status, body = requestToken(t, e, url.Values{
+		"client_id": {"reader"}, "client_secret": {"secret"}, "scope": {ScopeAdmin},
+	})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, errInvalidScope, body["code"])
+
+	// 通过了管理员校验, 但ContactStore不支持修改
+	assert.Equal(t, 404, call("DELETE", "/v1/admin/users/uid-1", accessToken("admin", ScopeAdmin)).Code)
+}
+
+func Test_adminClients(t *testing.T) {
+	e := New(0,
+		WithJWTAuthnStore(newTestKey(t), time.Hour, "ops", "secret", "reader", "secret"),
+		WithAdminClients("ops"),
+	).newEcho()
+
+	accessToken := func(clientID, scope string) string {
+		status, body := requestToken(t, e, url.Values{
+			"client_id": {clientID}, "client_secret": {"secret"}, "scope": {scope},
+		})
+		require.Equal(t, 200, status, body)
+		return body["token"].(map[string]any)["access_token"].(string)
+	}
+	deleteUser := func(tok string) int {
+		req := httptest.NewRequest("DELETE", "/v1/admin/users/uid-1", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// 管理员client的token不包含ScopeAdmin时不能调用管理接口
+	assert.Equal(t, 403, deleteUser(accessToken("ops", ScopeUsersRead)))
+	// 通过了管理员校验, 但ContactStore不支持修改
+	assert.Equal(t, 404, deleteUser(accessToken("ops", ScopeAdmin)))
+	assert.Equal(t, 404, deleteUser(accessToken("ops", "")))
+
+	status, body := requestToken(t, e, url.Values{
+		"client_id": {"reader"}, "client_secret": {"secret"}, "scope": {ScopeAdmin},
+	})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, errInvalidScope, body["code"])
+
+	// AuthnStore不能颁发ScopeAdmin
+	s := New(0, WithAuthnStore(NewAPIKeyAuthnStore(map[string]string{"k": "ops"})), WithAdminClients("ops"))
+	assert.ErrorContains(t, s.Err(), "admin clients are not supported")
+}
+
+// mustNewClient 用明文的client_secret创建启用的client
+func mustNewClient(id, secret string, scopes []string) *Client {
+	client, err := newSecretClient(id, secret, scopes)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func newTestJWTAuthnStore(t *testing.T, registry ClientRegistry) *jwtAuthnStore {
+	store, err := newJWTAuthnStore(newTestKey(t), time.Hour, registry)
+	require.NoError(t, err)
+	return store
+}
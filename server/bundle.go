@@ -0,0 +1,491 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	spec "github.com/idaaser/syncspecv1"
+	"gopkg.in/yaml.v3"
+)
+
+// bundle格式的版本
+const bundleVersion = 1
+
+// 归档格式的bundle中清单文件的文件名, tar归档中必须是第一个文件
+const bundleManifestFile = "manifest.json"
+
+// 导出归档格式的bundle时各文件的文件名
+const (
+	bundleDeptFile        = "departments.json"
+	bundleUserFile        = "users.ndjson"
+	bundleGroupFile       = "groups.json"
+	bundleGroupMemberFile = "group-users.json"
+)
+
+// bundleDocument 单个JSON/YAML文档格式的bundle
+type bundleDocument struct {
+	Version     int                `json:"version"`
+	Departments []*spec.Department `json:"departments"`
+	Users       []*spec.User       `json:"users"`
+	Groups      []*spec.Group      `json:"groups"`
+	GroupUsers  []*groupMembership `json:"group_users"`
+}
+
+// bundleManifest 归档格式的bundle中的清单, 记录各数据文件的文件名和校验和
+type bundleManifest struct {
+	Version     int         `json:"version"`
+	Departments bundleEntry `json:"departments"`
+	Users       bundleEntry `json:"users"`
+	Groups      bundleEntry `json:"groups"`
+	GroupUsers  bundleEntry `json:"group_users"`
+}
+
+type bundleEntry struct {
+	// 归档中的文件名, 文件格式根据扩展名判断, 同NewContactFileStore
+	File string `json:"file"`
+	// 文件内容的sha256, hex编码
+	SHA256 string `json:"sha256"`
+}
+
+// WithContactBundleStore 通讯录bundle格式的存储, 见NewContactBundleStore. 文件读取, 解析或校验失败时, Start返回该错误
+func WithContactBundleStore(file string, opts ...FileStoreOption) Option {
+	store, err := NewContactBundleStore(file, opts...)
+	if err != nil {
+		return withError(err)
+	}
+	return WithContactStore(store)
+}
+
+// NewContactBundleStore 创建通讯录bundle格式的存储, 并加载文件, 也可以通过WithContactStore使用.
+// 全部数据保存在一个文件中, 整体加载, 不会读到不一致的数据. 根据扩展名判断bundle的格式:
+//   - .zip/.tar/.tar.gz/.tgz: 归档, 包含manifest.json以及其中列出的4个数据文件, 加载时校验各文件的sha256
+//   - 其他: 单个JSON/YAML文档, 包含departments/users/groups/group_users 4个数组, 可以用gzip压缩
+//
+// 与NewContactFileStore相同, 文件变化时自动重新加载.
+// 文件读取, 解析或校验和检查失败时返回错误; 数据未通过完整性校验时返回*ValidationError
+func NewContactBundleStore(file string, opts ...FileStoreOption) (ContactStore, error) {
+	return newContactsFSFromSource(&contactsBundle{file: file}, opts...)
+}
+
+// ExportContactBundle 把ContactStore中的全部数据导出为bundle文件, 格式根据扩展名判断, 同NewContactBundleStore.
+// 先写入同目录下的临时文件再重命名, 导出过程中不会出现不完整的文件
+func ExportContactBundle(ctx context.Context, store ContactStore, file string) error {
+	snap, err := allContacts(ctx, store)
+	if err != nil {
+		return err
+	}
+	return (&contactsBundle{file: file}).write(snap)
+}
+
+// bundleKind 根据扩展名判断bundle的格式: zip, tar或document
+func bundleKind(file string) string {
+	name := strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar"
+	default:
+		return "document"
+	}
+}
+
+// contactsBundle 单个文件的bundle
+type contactsBundle struct {
+	file string
+}
+
+func (b *contactsBundle) stamps() []fileStamp {
+	return []fileStamp{statFile(b.file)}
+}
+
+func (b *contactsBundle) read() (*contactsSnapshot, error) {
+	switch bundleKind(b.file) {
+	case "zip":
+		return b.readZip()
+	case "tar":
+		return b.readTar()
+	default:
+		return b.readDocument()
+	}
+}
+
+// write 把数据整体写回bundle文件
+func (b *contactsBundle) write(snap *contactsSnapshot) error {
+	return writeFileAtomic(b.file, func(w io.Writer) error {
+		switch bundleKind(b.file) {
+		case "zip":
+			return writeZipBundle(w, snap)
+		case "tar":
+			return writeTarBundle(w, snap, !strings.HasSuffix(strings.ToLower(b.file), ".tar"))
+		default:
+			return writeDocumentBundle(w, b.file, snap)
+		}
+	})
+}
+
+func (b *contactsBundle) readDocument() (*contactsSnapshot, error) {
+	f, err := os.Open(b.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, format, err := decompress(b.file, f)
+	if err != nil {
+		return nil, err
+	}
+	doc := bundleDocument{}
+	if err := decodeDocument(b.file, format, r, &doc); err != nil {
+		return nil, err
+	}
+	if err := b.checkVersion(doc.Version); err != nil {
+		return nil, err
+	}
+
+	return &contactsSnapshot{
+		depts:        nonNil(doc.Departments),
+		users:        nonNil(doc.Users),
+		groups:       nonNil(doc.Groups),
+		groupMembers: nonNil(doc.GroupUsers),
+	}, nil
+}
+
+func (b *contactsBundle) readZip() (*contactsSnapshot, error) {
+	zr, err := zip.OpenReader(b.file)
+	if err != nil {
+		return nil, &parseError{file: b.file, err: err}
+	}
+	defer zr.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[archiveName(f.Name)] = f
+	}
+
+	a := &bundleArchive{file: b.file}
+	read := func(name string) error {
+		f, found := files[archiveName(name)]
+		if !found {
+			return &parseError{file: b.file, err: fmt.Errorf("missing %s", name)}
+		}
+		return a.readZipEntry(f)
+	}
+
+	// 先读取清单, 才能知道各数据文件的文件名
+	if err := read(bundleManifestFile); err != nil {
+		return nil, err
+	}
+	for _, name := range a.pending() {
+		if err := read(name); err != nil {
+			return nil, err
+		}
+	}
+	return a.snapshot()
+}
+
+func (b *contactsBundle) readTar() (*contactsSnapshot, error) {
+	f, err := os.Open(b.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(strings.ToLower(b.file), ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, &parseError{file: b.file, err: err}
+		}
+		r = gz
+	}
+
+	a := &bundleArchive{file: b.file}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &parseError{file: b.file, err: err}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if a.manifest == nil && archiveName(hdr.Name) != bundleManifestFile {
+			return nil, &parseError{file: b.file, err: fmt.Errorf("%s must be the first file", bundleManifestFile)}
+		}
+		if err := a.entry(hdr.Name, tr); err != nil {
+			return nil, err
+		}
+	}
+	return a.snapshot()
+}
+
+func (b *contactsBundle) checkVersion(version int) error {
+	if version > bundleVersion {
+		return &parseError{file: b.file, err: fmt.Errorf("unsupported bundle version %d", version)}
+	}
+	return nil
+}
+
+// bundleArchive 按清单解析归档中的文件, 并校验各文件的sha256
+type bundleArchive struct {
+	file     string
+	manifest *bundleManifest
+	snap     contactsSnapshot
+	loaded   map[string]bool
+}
+
+// pending 清单中列出但尚未读取的文件
+func (a *bundleArchive) pending() []string {
+	if a.manifest == nil {
+		return nil
+	}
+	names := []string{}
+	for _, e := range a.entries() {
+		if !a.loaded[archiveName(e.File)] {
+			names = append(names, e.File)
+		}
+	}
+	return names
+}
+
+func (a *bundleArchive) entries() []bundleEntry {
+	return []bundleEntry{a.manifest.Departments, a.manifest.Users, a.manifest.Groups, a.manifest.GroupUsers}
+}
+
+func (a *bundleArchive) readZipEntry(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return &parseError{file: a.file + ":" + f.Name, err: err}
+	}
+	defer r.Close()
+	return a.entry(f.Name, r)
+}
+
+// entry 解析归档中的一个文件, 忽略清单中未列出的文件
+func (a *bundleArchive) entry(name string, r io.Reader) error {
+	if a.manifest == nil {
+		manifest := &bundleManifest{}
+		if err := decodeDocument(a.file+":"+name, ".json", r, manifest); err != nil {
+			return err
+		}
+		if manifest.Version > bundleVersion {
+			return &parseError{file: a.file, err: fmt.Errorf("unsupported bundle version %d", manifest.Version)}
+		}
+
+		a.manifest = manifest
+		a.loaded = map[string]bool{}
+		for _, e := range a.entries() {
+			if e.File == "" || e.SHA256 == "" {
+				return &parseError{file: a.file + ":" + name, err: fmt.Errorf("missing file or sha256")}
+			}
+		}
+		return nil
+	}
+
+	var err error
+	name = archiveName(name)
+	switch name {
+	case archiveName(a.manifest.Departments.File):
+		a.snap.depts, err = decodeEntry[*spec.Department](a, a.manifest.Departments, r)
+	case archiveName(a.manifest.Users.File):
+		a.snap.users, err = decodeEntry[*spec.User](a, a.manifest.Users, r)
+	case archiveName(a.manifest.Groups.File):
+		a.snap.groups, err = decodeEntry[*spec.Group](a, a.manifest.Groups, r)
+	case archiveName(a.manifest.GroupUsers.File):
+		a.snap.groupMembers, err = decodeEntry[*groupMembership](a, a.manifest.GroupUsers, r)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.loaded[name] = true
+	return nil
+}
+
+// archiveName 规范化归档中的文件名, 如tar -C dir -czf bundle.tgz .生成的./manifest.json
+func archiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// decodeEntry 解析文件的同时计算sha256, 与清单中的不一致时返回错误
+func decodeEntry[T any](a *bundleArchive, e bundleEntry, r io.Reader) ([]T, error) {
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+
+	name := a.file + ":" + e.File
+	data, err := decodeFile[T](name, tee)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, &parseError{file: name, err: err}
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, e.SHA256) {
+		return nil, &parseError{file: name, err: fmt.Errorf("sha256 mismatch: expect %s, got %s", e.SHA256, sum)}
+	}
+	return data, nil
+}
+
+func (a *bundleArchive) snapshot() (*contactsSnapshot, error) {
+	if a.manifest == nil {
+		return nil, &parseError{file: a.file, err: fmt.Errorf("missing %s", bundleManifestFile)}
+	}
+	if pending := a.pending(); len(pending) > 0 {
+		return nil, &parseError{file: a.file, err: fmt.Errorf("missing %s", strings.Join(pending, ", "))}
+	}
+	return &a.snap, nil
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func writeDocumentBundle(w io.Writer, file string, snap *contactsSnapshot) error {
+	doc := bundleDocument{
+		Version:     bundleVersion,
+		Departments: snap.depts,
+		Users:       snap.users,
+		Groups:      snap.groups,
+		GroupUsers:  snap.groupMembers,
+	}
+
+	if !strings.EqualFold(filepath.Ext(file), ".gz") {
+		return encodeDocument(w, strings.ToLower(filepath.Ext(file)), doc)
+	}
+
+	gz := gzip.NewWriter(w)
+	format := strings.ToLower(filepath.Ext(strings.TrimSuffix(file, filepath.Ext(file))))
+	if err := encodeDocument(gz, format, doc); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// encodeDocument 按扩展名输出JSON或YAML文档, YAML使用JSON的字段名, 与读取时一致
+func encodeDocument(w io.Writer, format string, v any) error {
+	if format != ".yaml" && format != ".yml" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var raw any
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(raw); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// bundleFiles 归档格式的bundle中的清单和各数据文件的内容, 清单在第一个
+func bundleFiles(snap *contactsSnapshot) ([]string, map[string][]byte, error) {
+	files := map[string][]byte{}
+	manifest := bundleManifest{Version: bundleVersion}
+
+	add := func(entry *bundleEntry, name string, content []byte) {
+		sum := sha256.Sum256(content)
+		*entry = bundleEntry{File: name, SHA256: hex.EncodeToString(sum[:])}
+		files[name] = content
+	}
+	marshal := func(v any) []byte {
+		b, _ := json.MarshalIndent(v, "", "  ")
+		return b
+	}
+
+	// 用户文件可能很大, 使用JSON Lines格式, 加载时逐行解析
+	users := bytes.Buffer{}
+	enc := json.NewEncoder(&users)
+	for _, u := range snap.users {
+		if err := enc.Encode(u); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	add(&manifest.Departments, bundleDeptFile, marshal(snap.depts))
+	add(&manifest.Users, bundleUserFile, users.Bytes())
+	add(&manifest.Groups, bundleGroupFile, marshal(snap.groups))
+	add(&manifest.GroupUsers, bundleGroupMemberFile, marshal(snap.groupMembers))
+	files[bundleManifestFile] = marshal(manifest)
+
+	return []string{
+		bundleManifestFile, bundleDeptFile, bundleUserFile, bundleGroupFile, bundleGroupMemberFile,
+	}, files, nil
+}
+
+func writeZipBundle(w io.Writer, snap *contactsSnapshot) error {
+	names, files, err := bundleFiles(snap)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarBundle(w io.Writer, snap *contactsSnapshot, compress bool) error {
+	names, files, err := bundleFiles(snap)
+	if err != nil {
+		return err
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExportContactBundle(t *testing.T) {
+	source, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer source.Close()
+
+	expected, err := allContacts(context.TODO(), source)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for _, name := range []string{"bundle.json", "bundle.yaml.gz", "bundle.zip", "bundle.tar", "bundle.tgz"} {
+		f := filepath.Join(dir, name)
+		require.NoError(t, ExportContactBundle(context.TODO(), source, f), name)
+
+		store, err := NewContactBundleStore(f, WithReloadInterval(0))
+		require.NoError(t, err, name)
+
+		actual, err := allContacts(context.TODO(), store)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected.depts, actual.depts, name)
+		assert.Equal(t, expected.users, actual.users, name)
+		assert.Equal(t, expected.groups, actual.groups, name)
+		assert.Equal(t, expected.groupMembers, actual.groupMembers, name)
+	}
+
+	// 导出后不留下临时文件
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 5)
+}
+
+// noDeptUsersStore 部门下没有用户, 只能通过UserLister获取用户
+type noDeptUsersStore struct {
+	*contactsFS
+}
+
+func (s *noDeptUsersStore) ListUsersInDepartment(context.Context, spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	return &spec.PagingUsers{Data: []*spec.User{}}, nil
+}
+
+func Test_ExportContactBundle_userLister(t *testing.T) {
+	source, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer source.Close()
+
+	f := filepath.Join(t.TempDir(), "bundle.json")
+	require.NoError(t, ExportContactBundle(context.TODO(), &noDeptUsersStore{source}, f))
+	store, err := NewContactBundleStore(f, WithReloadInterval(0))
+	require.NoError(t, err)
+
+	users, _, err := store.(UserLister).ListAllUsers(context.TODO(), 0, 100)
+	require.NoError(t, err)
+	assert.Len(t, users, 13)
+}
+
+func writeTestZip(t *testing.T, files map[string]string) string {
+	f := filepath.Join(t.TempDir(), "bundle.zip")
+	out, err := os.Create(f)
+	require.NoError(t, err)
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return f
+}
+
+func Test_contactsBundle_errors(t *testing.T) {
+	// sha256("[]")
+	const emptySum = "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+	manifest := func(userSum string) string {
+		return `{"version": 1,
+			"departments": {"file": "d.json", "sha256": "` + emptySum + `"},
+			"users": {"file": "u.json", "sha256": "` + userSum + `"},
+			"groups": {"file": "g.json", "sha256": "` + emptySum + `"},
+			"group_users": {"file": "gu.json", "sha256": "` + emptySum + `"}}`
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		f := writeTestZip(t, map[string]string{
+			"manifest.json": manifest(emptySum),
+			"d.json":        "[]", "u.json": "[]", "g.json": "[]", "gu.json": "[]",
+		})
+		snap, err := (&contactsBundle{file: f}).read()
+		require.NoError(t, err)
+		assert.Empty(t, snap.users)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		f := writeTestZip(t, map[string]string{
+			"manifest.json": manifest(emptySum),
+			"d.json":        "[]", "u.json": `[{"id": "uid-1"}]`, "g.json": "[]", "gu.json": "[]",
+		})
+		_, err := (&contactsBundle{file: f}).read()
+		assert.ErrorContains(t, err, "bundle.zip:u.json: sha256 mismatch")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		f := writeTestZip(t, map[string]string{
+			"manifest.json": manifest(emptySum),
+			"d.json":        "[]", "g.json": "[]", "gu.json": "[]",
+		})
+		_, err := (&contactsBundle{file: f}).read()
+		assert.ErrorContains(t, err, "missing u.json")
+	})
+
+	t.Run("manifest not first in tar", func(t *testing.T) {
+		f := filepath.Join(t.TempDir(), "bundle.tar")
+		out, err := os.Create(f)
+		require.NoError(t, err)
+		tw := tar.NewWriter(out)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "d.json", Size: 2, Mode: 0o644, Typeflag: tar.TypeReg}))
+		_, err = tw.Write([]byte("[]"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, out.Close())
+
+		_, err = (&contactsBundle{file: f}).read()
+		assert.ErrorContains(t, err, "manifest.json must be the first file")
+	})
+
+	t.Run("dot-prefixed names in tar", func(t *testing.T) {
+		// tar -C dir -cf bundle.tar .
+		f := filepath.Join(t.TempDir(), "bundle.tar")
+		out, err := os.Create(f)
+		require.NoError(t, err)
+		tw := tar.NewWriter(out)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./", Mode: 0o755, Typeflag: tar.TypeDir}))
+		for _, entry := range [][2]string{
+			{"./manifest.json", manifest(emptySum)},
+			{"./d.json", "[]"}, {"./u.json", "[]"}, {"./g.json", "[]"}, {"./gu.json", "[]"},
+		} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Name: entry[0], Size: int64(len(entry[1])), Mode: 0o644, Typeflag: tar.TypeReg,
+			}))
+			_, err = tw.Write([]byte(entry[1]))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, out.Close())
+
+		snap, err := (&contactsBundle{file: f}).read()
+		require.NoError(t, err)
+		assert.Empty(t, snap.users)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		f := writeTestFile(t, "bundle.json", `{"version": 2}`)
+		_, err := (&contactsBundle{file: f}).read()
+		assert.ErrorContains(t, err, "unsupported bundle version 2")
+	})
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+)
+
+// ChangeFeedStore 可选接口, 支持增量同步的ContactStore可以实现该接口.
+// 实现后, 服务会提供增量同步接口, 并在.well-known中返回其地址
+type ChangeFeedStore interface {
+	// Changes 返回自token对应的版本以来的变更, 以及下一次请求使用的token.
+	// ctx中带有数据版本(见SnapshotVersion)时, 返回到该版本为止的变更, 分页时各页使用同一个版本;
+	// token为空时只返回当前的token, 客户端应在全量同步前获取;
+	// token已失效时返回ErrChangeTokenNotFound, 客户端应重新全量同步
+	Changes(ctx context.Context, token string) (*ChangeSet, error)
+}
+
+// ListChangesRequest 增量同步的请求参数
+type ListChangesRequest struct {
+	spec.PagingParam
+	Token string `query:"token"`
+}
+
+// ErrChangeTokenNotFound 增量同步的token非法或已失效
+var ErrChangeTokenNotFound = errors.New("change token not found or expired, full sync required")
+
+// 增量同步的token非法或已失效时返回的错误码
+const errInvalidChangeToken = "invalid_change_token"
+
+// ChangeSet 两个版本之间的变更
+type ChangeSet struct {
+	// 下一次请求使用的token, 应在获取全部分页后使用
+	Token string `json:"token"`
+	// 是否还有下一页, 以及获取下一页的cursor
+	HasNext bool   `json:"has_next"`
+	Cursor  string `json:"cursor"`
+
+	Departments EntityChanges[*spec.Department] `json:"departments"`
+	Users       EntityChanges[*spec.User]       `json:"users"`
+	Groups      EntityChanges[*spec.Group]      `json:"groups"`
+	Memberships MembershipChanges               `json:"memberships"`
+}
+
+// EntityChanges 部门/用户/group的变更
+type EntityChanges[T any] struct {
+	Created []T `json:"created"`
+	Updated []T `json:"updated"`
+	// 被删除的id
+	Deleted []string `json:"deleted"`
+}
+
+// MembershipChanges group成员的变更, 每个(group, user)最多出现一次
+type MembershipChanges struct {
+	Added   []Membership `json:"added"`
+	Removed []Membership `json:"removed"`
+}
+
+// Membership group与成员的关系
+type Membership struct {
+	Group string `json:"group"`
+	User  string `json:"user"`
+}
+
+func newChangeSet(token string) *ChangeSet {
+	return &ChangeSet{
+		Token:       token,
+		Departments: newEntityChanges[*spec.Department](),
+		Users:       newEntityChanges[*spec.User](),
+		Groups:      newEntityChanges[*spec.Group](),
+		Memberships: MembershipChanges{Added: []Membership{}, Removed: []Membership{}},
+	}
+}
+
+func newEntityChanges[T any]() EntityChanges[T] {
+	return EntityChanges[T]{Created: []T{}, Updated: []T{}, Deleted: []string{}}
+}
+
+func (s *Server) listChanges(c echo.Context) error {
+	store := s.getContactStore(c)
+	feed, ok := store.(ChangeFeedStore)
+	if !ok {
+		return s.returnJSONError(c, 404, spec.ErrInvalidRequest,
+			errors.New("incremental sync is not supported"))
+	}
+
+	req := ListChangesRequest{}
+	if err := c.Bind(&req); err != nil {
+		return s.returnBadRequest(c, err)
+	}
+
+	// 各页使用同一个数据版本, cursor中记录已返回的变更数
+	pager := s.newPager(c, store, url.Values{"token": {req.Token}})
+	cursor, err := pager.unwrap(req.Cursor)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	offset := 0
+	if cursor != "" {
+		if offset, err = strconv.Atoi(cursor); err != nil {
+			return s.returnStoreError(c, &cursorError{reason: "malformed"})
+		}
+	}
+
+	data, err := feed.Changes(pager.context(), req.Token)
+	if errors.Is(err, ErrChangeTokenNotFound) {
+		return s.returnJSONError(c, 400, errInvalidChangeToken, err)
+	}
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+
+	page := data.page(offset, req.GetSize())
+	page.Cursor = pager.wrap(page.Cursor)
+	return c.JSON(200, page)
+}
+
+// page 返回从offset开始的最多size条变更, 依次为部门, 用户, group以及group成员的变更
+func (cs *ChangeSet) page(offset, size int) *ChangeSet {
+	p := newChangeSet(cs.Token)
+	skip, limit := offset, size
+	p.Departments.Created = append(p.Departments.Created, pageOf(cs.Departments.Created, &skip, &limit)...)
+	p.Departments.Updated = append(p.Departments.Updated, pageOf(cs.Departments.Updated, &skip, &limit)...)
+	p.Departments.Deleted = append(p.Departments.Deleted, pageOf(cs.Departments.Deleted, &skip, &limit)...)
+	p.Users.Created = append(p.Users.Created, pageOf(cs.Users.Created, &skip, &limit)...)
+	p.Users.Updated = append(p.Users.Updated, pageOf(cs.Users.Updated, &skip, &limit)...)
+	p.Users.Deleted = append(p.Users.Deleted, pageOf(cs.Users.Deleted, &skip, &limit)...)
+	p.Groups.Created = append(p.Groups.Created, pageOf(cs.Groups.Created, &skip, &limit)...)
+	p.Groups.Updated = append(p.Groups.Updated, pageOf(cs.Groups.Updated, &skip, &limit)...)
+	p.Groups.Deleted = append(p.Groups.Deleted, pageOf(cs.Groups.Deleted, &skip, &limit)...)
+	p.Memberships.Added = append(p.Memberships.Added, pageOf(cs.Memberships.Added, &skip, &limit)...)
+	p.Memberships.Removed = append(p.Memberships.Removed, pageOf(cs.Memberships.Removed, &skip, &limit)...)
+
+	// 还有未返回的变更
+	if offset+size < cs.len() {
+		p.HasNext = true
+		p.Cursor = strconv.Itoa(offset + size)
+	}
+	return p
+}
+
+// len 变更的总数
+func (cs *ChangeSet) len() int {
+	return len(cs.Departments.Created) + len(cs.Departments.Updated) + len(cs.Departments.Deleted) +
+		len(cs.Users.Created) + len(cs.Users.Updated) + len(cs.Users.Deleted) +
+		len(cs.Groups.Created) + len(cs.Groups.Updated) + len(cs.Groups.Deleted) +
+		len(cs.Memberships.Added) + len(cs.Memberships.Removed)
+}
+
+// pageOf 跳过items中的前skip条后, 返回最多limit条, 并扣减skip和limit
+func pageOf[T any](items []T, skip, limit *int) []T {
+	if *skip >= len(items) {
+		*skip -= len(items)
+		return nil
+	}
+	items = items[*skip:]
+	*skip = 0
+	items = items[:min(len(items), *limit)]
+	*limit -= len(items)
+	return items
+}
+
+// 保留最近多少个版本的摘要, 更早的token将失效
+const maxDigests = 32
+
+// 缓存最近多少次计算的变更
+const maxCachedChanges = 8
+
+// changeKey 变更的起止版本
+type changeKey struct {
+	from, to string
+}
+
+// snapshotDigest 快照的摘要, 用于计算两个版本之间的变更, 不保留完整数据
+type snapshotDigest struct {
+	// id -> 数据内容的hash
+	depts  map[string]uint64
+	users  map[string]uint64
+	groups map[string]uint64
+
+	members map[Membership]struct{}
+}
+
+func newSnapshotDigest(snap *contactsSnapshot) *snapshotDigest {
+	d := &snapshotDigest{
+		depts:   make(map[string]uint64, len(snap.depts)),
+		users:   make(map[string]uint64, len(snap.users)),
+		groups:  make(map[string]uint64, len(snap.groups)),
+		members: map[Membership]struct{}{},
+	}
+	for _, item := range snap.depts {
+		d.depts[item.ID] = contentHash(item)
+	}
+	for _, item := range snap.users {
+		d.users[item.ID] = contentHash(item)
+	}
+	for _, item := range snap.groups {
+		d.groups[item.ID] = contentHash(item)
+	}
+	for _, m := range snap.groupMembers {
+		for _, member := range m.Members {
+			d.members[Membership{Group: m.ID, User: member}] = struct{}{}
+		}
+	}
+	return d
+}
+
+func contentHash(v any) uint64 {
+	b, _ := json.Marshal(v)
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// recordDigest 记录快照的摘要, 只保留最近maxDigests个版本
+func (c *contactsFS) recordDigest(snap *contactsSnapshot) {
+	digest := newSnapshotDigest(snap)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.digests[snap.version]; !found {
+		c.digestOrder = append(c.digestOrder, snap.version)
+	}
+	c.digests[snap.version] = digest
+
+	for len(c.digestOrder) > maxDigests {
+		delete(c.digests, c.digestOrder[0])
+		c.digestOrder = c.digestOrder[1:]
+	}
+}
+
+// Changes 实现ChangeFeedStore接口, 通过对比token对应版本与当前版本(或ctx中的版本)的摘要得到变更.
+// 结果按起止版本缓存, 分页获取时各页共用; 注: 返回的ChangeSet不能修改
+func (c *contactsFS) Changes(ctx context.Context, token string) (*ChangeSet, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" || token == snap.version {
+		return newChangeSet(snap.version), nil
+	}
+
+	key := changeKey{from: token, to: snap.version}
+	c.mu.Lock()
+	cached := c.changes[key]
+	from, found := c.digests[token]
+	to := c.digests[snap.version]
+	c.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	if !found || to == nil {
+		return nil, ErrChangeTokenNotFound
+	}
+
+	changes := diffDigests(snap, from, to)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.changes[key]; !found {
+		c.changeOrder = append(c.changeOrder, key)
+	}
+	c.changes[key] = changes
+	for len(c.changeOrder) > maxCachedChanges {
+		delete(c.changes, c.changeOrder[0])
+		c.changeOrder = c.changeOrder[1:]
+	}
+	return changes, nil
+}
+
+// diffDigests 对比两个版本的摘要, 得到从from到to(即snap)的变更
+func diffDigests(snap *contactsSnapshot, from, to *snapshotDigest) *ChangeSet {
+	changes := newChangeSet(snap.version)
+
+	diffEntities(&changes.Departments, from.depts, to.depts, snap.depts,
+		func(d *spec.Department) string { return d.ID })
+	diffEntities(&changes.Users, from.users, to.users, snap.users,
+		func(u *spec.User) string { return u.ID })
+	diffEntities(&changes.Groups, from.groups, to.groups, snap.groups,
+		func(g *spec.Group) string { return g.ID })
+
+	// 摘要中的成员关系已去重, 同一group下重复的成员只记录一次
+	changes.Memberships.Added = diffMemberships(from.members, to.members)
+	changes.Memberships.Removed = diffMemberships(to.members, from.members)
+
+	return changes
+}
+
+// diffMemberships 返回在to中而不在from中的成员关系, 按group和user排序
+func diffMemberships(from, to map[Membership]struct{}) []Membership {
+	diff := []Membership{}
+	for m := range to {
+		if _, found := from[m]; !found {
+			diff = append(diff, m)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		a, b := diff[i], diff[j]
+		return a.Group < b.Group || (a.Group == b.Group && a.User < b.User)
+	})
+	return diff
+}
+
+// diffEntities 对比两个版本的摘要, 新增和修改的数据按当前版本中的顺序返回, 删除的id按字典序返回
+func diffEntities[T any](changes *EntityChanges[T], from, to map[string]uint64, current []T, id func(T) string) {
+	for _, item := range current {
+		old, found := from[id(item)]
+		switch {
+		case !found:
+			changes.Created = append(changes.Created, item)
+		case old != to[id(item)]:
+			changes.Updated = append(changes.Updated, item)
+		}
+	}
+
+	for id := range from {
+		if _, found := to[id]; !found {
+			changes.Deleted = append(changes.Deleted, id)
+		}
+	}
+	sort.Strings(changes.Deleted)
+}
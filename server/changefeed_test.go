@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contactsFS_Changes(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	// 全量同步前获取token
+	first, err := store.Changes(context.TODO(), "")
+	require.NoError(t, err)
+	assert.Equal(t, store.Version(), first.Token)
+	assert.Empty(t, first.Users.Created)
+
+	require.NoError(t, os.WriteFile(dept, []byte(`[
+		{"id": "1", "parent": "", "name": "中国", "order": 1},
+		{"id": "1.1", "parent": "1", "name": "北京市", "order": 1}
+	]`), 0o600))
+	require.NoError(t, os.WriteFile(user, []byte(`[
+		{"id": "uid-1", "username": "user1", "email": "user1@example.com", "name": "user 1", "status": 1, "main_department": "1"},
+		{"id": "uid-new", "name": "new", "main_department": "1.1"}
+	]`), 0o600))
+	require.NoError(t, os.WriteFile(groupMembers, []byte(`[
+		{"id": "1", "members": ["uid-1", "uid-new", "uid-new"]}
+	]`), 0o600))
+	require.NoError(t, store.reload())
+
+	changes, err := store.Changes(context.TODO(), first.Token)
+	require.NoError(t, err)
+	assert.Equal(t, store.Version(), changes.Token)
+
+	assert.Empty(t, changes.Departments.Created)
+	require.Len(t, changes.Departments.Updated, 1)
+	assert.Equal(t, "北京市", changes.Departments.Updated[0].Name)
+	assert.Equal(t, []string{"1.1.1", "1.1.2", "1.1.3", "1.2", "1.2.1", "1.2.2", "1.2.3", "1.3", "1.3.1"},
+		changes.Departments.Deleted)
+
+	require.Len(t, changes.Users.Created, 1)
+	assert.Equal(t, "uid-new", changes.Users.Created[0].ID)
+	assert.Empty(t, changes.Users.Updated)
+	assert.Len(t, changes.Users.Deleted, 12)
+
+	// 重复的成员只记录一次
+	assert.Equal(t, []Membership{{Group: "1", User: "uid-new"}}, changes.Memberships.Added)
+	assert.Contains(t, changes.Memberships.Removed, Membership{Group: "1", User: "uid-1.1"})
+
+	// 同一版本之间的变更只计算一次
+	again, err := store.Changes(context.TODO(), first.Token)
+	require.NoError(t, err)
+	assert.Same(t, changes, again)
+
+	// 已是最新版本
+	latest, err := store.Changes(context.TODO(), changes.Token)
+	require.NoError(t, err)
+	assert.Empty(t, latest.Users.Created)
+
+	_, err = store.Changes(context.TODO(), "unknown")
+	assert.ErrorIs(t, err, ErrChangeTokenNotFound)
+}
+
+func Test_listChanges_paging(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+	e := New(0, WithContactStore(store)).newEcho()
+
+	get := func(query string) *ChangeSet {
+		req := httptest.NewRequest("GET", "/v1/changes?"+query, nil)
+		req.Header.Set("Authorization", "Bearer any")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, 200, rec.Code, rec.Body.String())
+		data := &ChangeSet{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), data))
+		return data
+	}
+
+	first := get("")
+	require.NoError(t, os.WriteFile(user, []byte(`[
+		{"id": "uid-1", "username": "user1", "email": "user1@example.com", "name": "user 1", "status": 1, "main_department": "1"}
+	]`), 0o600))
+	require.NoError(t, os.WriteFile(groupMembers, []byte(`[{"id": "1", "members": ["uid-1"]}]`), 0o600))
+	require.NoError(t, store.reload())
+	all, err := store.Changes(context.TODO(), first.Token)
+	require.NoError(t, err)
+
+	// 分页获取, 期间数据发生变化时, 各页仍使用同一个版本
+	deleted, removed := []string{}, []Membership{}
+	query := "size=5&token=" + first.Token
+	for pages := 0; ; pages++ {
+		page := get(query)
+		assert.Equal(t, all.Token, page.Token)
+		assert.LessOrEqual(t, page.len(), 5)
+		deleted = append(deleted, page.Users.Deleted...)
+		removed = append(removed, page.Memberships.Removed...)
+		if !page.HasNext {
+			assert.Empty(t, page.Cursor)
+			assert.Equal(t, (all.len()+4)/5-1, pages)
+			break
+		}
+		if pages == 0 {
+			require.NoError(t, os.WriteFile(groupMembers, []byte(`[]`), 0o600))
+			require.NoError(t, store.reload())
+		}
+		query = "size=5&token=" + first.Token + "&cursor=" + page.Cursor
+	}
+	assert.Equal(t, all.Users.Deleted, deleted)
+	assert.Equal(t, all.Memberships.Removed, removed)
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client 注册的client. client_secret只保存bcrypt hash, 不保存明文
+type Client struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// client_secret的bcrypt hash, 见HashSecret
+	SecretHash string `json:"secret_hash"`
+	// 是否启用, 停用的client不能申请token, 已颁发的token也随即失效
+	Enabled bool `json:"enabled"`
+	// 允许申请的scope, 为空时为DefaultScopes
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// 过期时间, 为空时永不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// 鉴权方式, 为空时为AuthMethodClientSecretPost. 设置后只能使用该方式鉴权
+	AuthMethod string `json:"token_endpoint_auth_method,omitempty"`
+	// private_key_jwt: 校验client assertion的公钥(JWK Set)
+	JWKS json.RawMessage `json:"jwks,omitempty"`
+	// tls_client_auth: 客户端证书的subject DN(RFC 4514格式, 如"CN=hr-sync,O=Example"),
+	// 或SAN中的DNS名、email、URI或IP之一, 至少设置一个
+	TLSSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSSAN       string `json:"tls_client_auth_san,omitempty"`
+}
+
+func (c *Client) authMethod() string {
+	if c.AuthMethod == "" {
+		return AuthMethodClientSecretPost
+	}
+	return c.AuthMethod
+}
+
+// matchCertificate 客户端证书的subject DN或SAN是否与client注册的一致
+func (c *Client) matchCertificate(cert *x509.Certificate) bool {
+	if c.TLSSubjectDN != "" && cert.Subject.String() == c.TLSSubjectDN {
+		return true
+	}
+	if c.TLSSAN == "" {
+		return false
+	}
+
+	sans := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return slices.Contains(sans, c.TLSSAN)
+}
+
+// Active client是否启用且未过期
+func (c *Client) Active(now time.Time) bool {
+	return c.Enabled && (c.ExpiresAt == nil || now.Before(*c.ExpiresAt))
+}
+
+// ClientRegistry client的存储
+type ClientRegistry interface {
+	// GetClient 返回client, 不存在时返回ErrClientNotFound
+	GetClient(ctx context.Context, id string) (*Client, error)
+	// ListClients 返回全部client, 按id排序
+	ListClients(ctx context.Context) ([]*Client, error)
+	// SaveClient 新增或整体替换client
+	SaveClient(ctx context.Context, client *Client) error
+}
+
+// ErrClientNotFound client不存在
+var ErrClientNotFound = errors.New("client not found")
+
+// HashSecret 返回client_secret的bcrypt hash
+func HashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// GenerateSecret 生成随机的client_secret(256位)
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// client不存在时用于比较的hash, 使client不存在与secret错误的耗时相同
+var dummySecretHash, _ = bcrypt.GenerateFromPassword([]byte("dummy secret"), bcrypt.DefaultCost)
+
+// authenticateClient 校验client_id/client_secret, secret使用bcrypt比较(耗时与内容无关).
+// 任何原因校验失败都返回相同的错误, 不泄露client是否存在
+func authenticateClient(ctx context.Context, registry ClientRegistry, clientid, secret string) (*Client, error) {
+	errInvalid := errors.New("invalid client id or client secret")
+
+	client, err := registry.GetClient(ctx, clientid)
+	if errors.Is(err, ErrClientNotFound) {
+		_ = bcrypt.CompareHashAndPassword(dummySecretHash, []byte(secret))
+		return nil, errInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) != nil {
+		return nil, errInvalid
+	}
+	if !client.Active(time.Now()) || client.authMethod() != AuthMethodClientSecretPost {
+		return nil, errInvalid
+	}
+	return client, nil
+}
+
+// NewMemoryClientRegistry 内存中的ClientRegistry, 用于测试或由代码注册client
+func NewMemoryClientRegistry(clients ...*Client) ClientRegistry {
+	r := &memoryClients{clients: map[string]*Client{}}
+	for _, c := range clients {
+		r.clients[c.ID] = c
+	}
+	return r
+}
+
+// interface compliance
+var (
+	_ ClientRegistry = (*memoryClients)(nil)
+	_ ClientRegistry = (*fileClients)(nil)
+)
+
+type memoryClients struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+// GetClient implements ClientRegistry.
+func (r *memoryClients) GetClient(_ context.Context, id string) (*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if c, found := r.clients[id]; found {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrClientNotFound, id)
+}
+
+// ListClients implements ClientRegistry.
+func (r *memoryClients) ListClients(context.Context) ([]*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	slices.SortFunc(clients, compareClientID)
+	return clients, nil
+}
+
+// SaveClient implements ClientRegistry.
+func (r *memoryClients) SaveClient(_ context.Context, client *Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := *client
+	r.clients[c.ID] = &c
+	return nil
+}
+
+// NewFileClientRegistry 保存在文件中的ClientRegistry, 文件格式同通讯录文件(JSON/YAML数组等, 根据扩展名判断).
+// 文件不存在时为空, 保存时创建; 文件被其他进程(如命令行工具)修改后, 下次读取时重新加载
+func NewFileClientRegistry(file string) (ClientRegistry, error) {
+	r := &fileClients{file: file}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type fileClients struct {
+	file string
+
+	mu      sync.Mutex
+	stamp   fileStamp
+	clients []*Client
+}
+
+// load 文件发生变化时重新加载
+func (r *fileClients) load() ([]*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *fileClients) loadLocked() ([]*Client, error) {
+	stamp := statFile(r.file)
+	if r.clients != nil && stamp.equal(r.stamp) {
+		return r.clients, nil
+	}
+
+	clients, err := newJSONFileStore[*Client](r.file).read()
+	if errors.Is(err, os.ErrNotExist) {
+		clients, err = []*Client{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.clients, r.stamp = clients, stamp
+	return clients, nil
+}
+
+// GetClient implements ClientRegistry.
+func (r *fileClients) GetClient(_ context.Context, id string) (*Client, error) {
+	clients, err := r.load()
+	if err != nil {
+		return nil, &UnavailableError{Source: r.file, Err: err}
+	}
+
+	if i := slices.IndexFunc(clients, func(c *Client) bool { return c.ID == id }); i >= 0 {
+		return clients[i], nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrClientNotFound, id)
+}
+
+// ListClients implements ClientRegistry.
+func (r *fileClients) ListClients(context.Context) ([]*Client, error) {
+	clients, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return slices.SortedFunc(slices.Values(clients), compareClientID), nil
+}
+
+// SaveClient implements ClientRegistry.
+func (r *fileClients) SaveClient(_ context.Context, client *Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, err := r.loadLocked()
+	if err != nil {
+		return err
+	}
+
+	c := *client
+	clients := slices.Clone(current)
+	if i := slices.IndexFunc(clients, func(item *Client) bool { return item.ID == c.ID }); i >= 0 {
+		clients[i] = &c
+	} else {
+		clients = append(clients, &c)
+	}
+
+	if err := writeFileAtomic(r.file, func(w io.Writer) error {
+		return encodeFile(r.file, w, clients)
+	}); err != nil {
+		return err
+	}
+	r.clients, r.stamp = clients, statFile(r.file)
+	return nil
+}
+
+func compareClientID(a, b *Client) int {
+	return strings.Compare(a.ID, b.ID)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLClientSchema SQL client registry使用的表结构(以SQLite/PostgreSQL的语法为例).
+// 时间保存为unix秒, expires_at为NULL时永不过期; scopes以空格分隔; jwks为JSON文本
+const SQLClientSchema = `
+CREATE TABLE clients (
+	id          VARCHAR(64)   PRIMARY KEY,
+	name        VARCHAR(255)  NOT NULL DEFAULT '',
+	secret_hash VARCHAR(255)  NOT NULL DEFAULT '',
+	enabled     BOOLEAN       NOT NULL DEFAULT TRUE,
+	scopes      VARCHAR(1024) NOT NULL DEFAULT '',
+	created_at  BIGINT        NOT NULL,
+	expires_at  BIGINT,
+	auth_method VARCHAR(32)   NOT NULL DEFAULT '',
+	jwks        TEXT,
+	tls_subject VARCHAR(1024) NOT NULL DEFAULT '',
+	tls_san     VARCHAR(1024) NOT NULL DEFAULT ''
+);
+`
+
+// NewSQLClientRegistry 保存在关系型数据库中的ClientRegistry, 表结构见SQLClientSchema.
+// 可以与WithContactSQLStore使用同一个数据库, 选项同WithContactSQLStore
+func NewSQLClientRegistry(db *sql.DB, opts ...SQLStoreOption) ClientRegistry {
+	return &sqlClients{contactsSQL: newContactsSQL(db, opts...)}
+}
+
+// sqlClients 复用contactsSQL的连接与参数占位符配置
+type sqlClients struct {
+	*contactsSQL
+}
+
+// interface compliance
+var _ ClientRegistry = (*sqlClients)(nil)
+
+const selectClients = `SELECT id, name, secret_hash, enabled, scopes, created_at, expires_at,
+	auth_method, jwks, tls_subject, tls_san FROM clients`
+
+// GetClient implements ClientRegistry.
+func (r *sqlClients) GetClient(ctx context.Context, id string) (*Client, error) {
+	rows, err := r.query(ctx, selectClients+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := scanClients(rows)
+	if err != nil {
+		return nil, r.unavailable(err)
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrClientNotFound, id)
+	}
+	return clients[0], nil
+}
+
+// ListClients implements ClientRegistry.
+func (r *sqlClients) ListClients(ctx context.Context) ([]*Client, error) {
+	rows, err := r.query(ctx, selectClients+` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := scanClients(rows)
+	if err != nil {
+		return nil, r.unavailable(err)
+	}
+	return clients, nil
+}
+
+// SaveClient implements ClientRegistry.
+func (r *sqlClients) SaveClient(ctx context.Context, client *Client) error {
+	var expires sql.NullInt64
+	if client.ExpiresAt != nil {
+		expires = sql.NullInt64{Int64: client.ExpiresAt.Unix(), Valid: true}
+	}
+	scopes := strings.Join(client.Scopes, " ")
+	var jwks sql.NullString
+	if len(client.JWKS) > 0 {
+		jwks = sql.NullString{String: string(client.JWKS), Valid: true}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return r.unavailable(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, r.rebind(
+		`UPDATE clients SET name = ?, secret_hash = ?, enabled = ?, scopes = ?, created_at = ?, expires_at = ?,
+			auth_method = ?, jwks = ?, tls_subject = ?, tls_san = ? WHERE id = ?`),
+		client.Name, client.SecretHash, client.Enabled, scopes, client.CreatedAt.Unix(), expires,
+		client.AuthMethod, jwks, client.TLSSubjectDN, client.TLSSAN, client.ID)
+	if err != nil {
+		return r.unavailable(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return r.unavailable(err)
+	}
+	if n == 0 {
+		if _, err := tx.ExecContext(ctx, r.rebind(
+			`INSERT INTO clients (id, name, secret_hash, enabled, scopes, created_at, expires_at,
+				auth_method, jwks, tls_subject, tls_san) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			client.ID, client.Name, client.SecretHash, client.Enabled, scopes, client.CreatedAt.Unix(), expires,
+			client.AuthMethod, jwks, client.TLSSubjectDN, client.TLSSAN); err != nil {
+			return r.unavailable(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return r.unavailable(err)
+	}
+	return nil
+}
+
+func scanClients(rows *sql.Rows) ([]*Client, error) {
+	defer rows.Close()
+
+	data := []*Client{}
+	for rows.Next() {
+		c := &Client{}
+		var scopes string
+		var created int64
+		var expires sql.NullInt64
+		var jwks sql.NullString
+		if err := rows.Scan(&c.ID, &c.Name, &c.SecretHash, &c.Enabled, &scopes, &created, &expires,
+			&c.AuthMethod, &jwks, &c.TLSSubjectDN, &c.TLSSAN); err != nil {
+			return nil, err
+		}
+		if jwks.Valid {
+			c.JWKS = json.RawMessage(jwks.String)
+		}
+		c.Scopes = strings.Fields(scopes)
+		c.CreatedAt = time.Unix(created, 0)
+		if expires.Valid {
+			t := time.Unix(expires.Int64, 0)
+			c.ExpiresAt = &t
+		}
+		data = append(data, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
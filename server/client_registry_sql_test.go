@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func Test_sqlClients(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(SQLClientSchema)
+	require.NoError(t, err)
+
+	registry := NewSQLClientRegistry(db)
+	_, err = registry.GetClient(context.TODO(), "c1")
+	assert.ErrorIs(t, err, ErrClientNotFound)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	c1 := mustNewClient("c1", "secret", []string{ScopeDeptsRead, ScopeUsersRead})
+	c1.ExpiresAt = &expires
+	require.NoError(t, registry.SaveClient(context.TODO(), c1))
+	require.NoError(t, registry.SaveClient(context.TODO(), mustNewClient("c0", "secret", nil)))
+
+	got, err := authenticateClient(context.TODO(), registry, "c1", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, c1.Scopes, got.Scopes)
+	assert.True(t, expires.Equal(*got.ExpiresAt))
+
+	// 更新
+	got.Enabled = false
+	require.NoError(t, registry.SaveClient(context.TODO(), got))
+	_, err = authenticateClient(context.TODO(), registry, "c1", "secret")
+	assert.Error(t, err)
+
+	clients, err := registry.ListClients(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, "c0", clients[0].ID)
+	assert.Nil(t, clients[0].ExpiresAt)
+	assert.Empty(t, clients[0].Scopes)
+	assert.False(t, clients[1].Enabled)
+}
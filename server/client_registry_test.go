@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fileClients(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.json")
+
+	// 文件不存在时为空
+	registry, err := NewFileClientRegistry(file)
+	require.NoError(t, err)
+	_, err = registry.GetClient(context.TODO(), "c1")
+	assert.ErrorIs(t, err, ErrClientNotFound)
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, registry.SaveClient(context.TODO(), mustNewClient("c2", "secret", nil)))
+	require.NoError(t, registry.SaveClient(context.TODO(), &Client{
+		ID: "c1", Name: "hr", SecretHash: "hash", Enabled: true,
+		Scopes: []string{ScopeUsersRead}, CreatedAt: time.Now(), ExpiresAt: &expires,
+	}))
+
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), `"secret"`)
+
+	// 其他进程读取到相同的数据
+	other, err := NewFileClientRegistry(file)
+	require.NoError(t, err)
+	clients, err := other.ListClients(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, "c1", clients[0].ID)
+	assert.Equal(t, []string{ScopeUsersRead}, clients[0].Scopes)
+	assert.True(t, expires.Equal(*clients[0].ExpiresAt))
+
+	// 其他进程修改后重新加载
+	c1 := *clients[0]
+	c1.Enabled = false
+	// name变长, 文件大小随之变化, 不依赖修改时间的精度
+	c1.Name = "hr sync"
+	require.NoError(t, other.SaveClient(context.TODO(), &c1))
+	got, err := registry.GetClient(context.TODO(), "c1")
+	require.NoError(t, err)
+	assert.False(t, got.Enabled)
+	assert.Equal(t, "hr sync", got.Name)
+
+	// 无法解析的文件
+	require.NoError(t, os.WriteFile(file, []byte("{"), 0o600))
+	_, err = NewFileClientRegistry(file)
+	assert.Error(t, err)
+}
+
+func Test_authenticateClient(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	disabled := mustNewClient("disabled", "secret", nil)
+	disabled.Enabled = false
+	expired := mustNewClient("expired", "secret", nil)
+	expired.ExpiresAt = &past
+	registry := NewMemoryClientRegistry(mustNewClient("ok", "secret", nil), disabled, expired)
+
+	c, err := authenticateClient(context.TODO(), registry, "ok", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", c.ID)
+
+	for _, tc := range []struct{ id, secret string }{
+		{"ok", "wrong"},
+		{"unknown", "secret"},
+		{"disabled", "secret"},
+		{"expired", "secret"},
+	} {
+		_, err := authenticateClient(context.TODO(), registry, tc.id, tc.secret)
+		// 不泄露失败的原因
+		assert.EqualError(t, err, "invalid client id or client secret", tc.id)
+	}
+}
+
+func Test_jwtAuthnStore_registry(t *testing.T) {
+	registry := NewMemoryClientRegistry(mustNewClient("c1", "secret", nil))
+	store := newTestJWTAuthnStore(t, registry)
+
+	tok, err := store.Auth(context.TODO(), "c1", "secret")
+	require.NoError(t, err)
+	sub, err := store.Verify(context.TODO(), tok.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "c1", sub)
+
+	// 停用后已颁发的token随即失效
+	c, err := registry.GetClient(context.TODO(), "c1")
+	require.NoError(t, err)
+	c1 := *c
+	c1.Enabled = false
+	require.NoError(t, registry.SaveClient(context.TODO(), &c1))
+	_, err = store.Verify(context.TODO(), tok.AccessToken)
+	assert.Error(t, err)
+
+	// 轮换secret后, 之前的secret不能再申请token
+	hash, err := HashSecret("new secret")
+	require.NoError(t, err)
+	c1.Enabled, c1.SecretHash = true, hash
+	require.NoError(t, registry.SaveClient(context.TODO(), &c1))
+	_, err = store.Auth(context.TODO(), "c1", "secret")
+	assert.Error(t, err)
+	_, err = store.Auth(context.TODO(), "c1", "new secret")
+	assert.NoError(t, err)
+}
+
+func Test_GenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	require.NoError(t, err)
+	b, err := GenerateSecret()
+	require.NoError(t, err)
+	assert.Len(t, a, 43)
+	assert.NotEqual(t, a, b)
+	assert.False(t, strings.ContainsAny(a, "+/="))
+}
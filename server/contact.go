@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -9,16 +11,66 @@ import (
 )
 
 func (s *Server) listDepts(c echo.Context) error {
+	// 指定了parent或recursive=true时按部门树查询, recursive=false时与不带参数相同
+	recursive := false
+	if v := c.QueryParam("recursive"); v != "" {
+		var err error
+		if recursive, err = strconv.ParseBool(v); err != nil {
+			return s.returnBadRequest(c, fmt.Errorf("invalid recursive %q", v))
+		}
+	}
+	if c.QueryParam("parent") != "" || recursive {
+		return s.listSubDepts(c)
+	}
+
 	req := spec.ListDepatmentRequest{}
 	if err := c.Bind(&req); err != nil {
 		return s.returnBadRequest(c, err)
 	}
 
-	data, err := s.getContactStore(c).
-		ListDepartments(c.Request().Context(), req)
+	store := s.getContactStore(c)
+	pager := s.newPager(c, store, nil)
+	cursor, err := pager.unwrap(req.Cursor)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	req.Cursor = cursor
+
+	data, err := store.ListDepartments(pager.context(), req)
 	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	data.Cursor = pager.wrap(data.Cursor)
+	return c.JSON(200, spec.ListDepartmentResponse{PagingDepartments: *data})
+}
+
+// listSubDepts 分页获取parent的下级部门, recursive=true时返回全部子孙部门
+func (s *Server) listSubDepts(c echo.Context) error {
+	req := ListSubDepartmentsRequest{}
+	if err := c.Bind(&req); err != nil {
 		return s.returnBadRequest(c, err)
 	}
+
+	store := s.getContactStore(c)
+	tree, ok := store.(DepartmentTreeStore)
+	if !ok {
+		return s.returnTreeNotSupported(c)
+	}
+
+	pager := s.newPager(c, store, url.Values{
+		"parent": {req.Parent}, "recursive": {strconv.FormatBool(req.Recursive)},
+	})
+	cursor, err := pager.unwrap(req.Cursor)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	req.Cursor = cursor
+
+	data, err := tree.ListSubDepartments(pager.context(), req)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	data.Cursor = pager.wrap(data.Cursor)
 	return c.JSON(200, spec.ListDepartmentResponse{PagingDepartments: *data})
 }
 
@@ -57,7 +109,7 @@ func (s *Server) searchDept(c echo.Context) error {
 	data, err := s.getContactStore(c).
 		SearchDepartment(c.Request().Context(), keyword)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
 	}
 
 	return c.JSON(200, &spec.SearchDepartmentResponse{Data: data})
@@ -72,10 +124,42 @@ func (s *Server) listUsersInDept(c echo.Context) error {
 		return s.returnBadRequest(c, err)
 	}
 
-	data, err := s.getContactStore(c).ListUsersInDepartment(c.Request().Context(), req)
+	// recursive=true时返回部门及其全部子孙部门下的用户
+	recursive := false
+	if v := c.QueryParam("recursive"); v != "" {
+		var err error
+		if recursive, err = strconv.ParseBool(v); err != nil {
+			return s.returnBadRequest(c, fmt.Errorf("invalid recursive %q", v))
+		}
+	}
+
+	store := s.getContactStore(c)
+	tree, ok := store.(DepartmentTreeStore)
+	if recursive && !ok {
+		return s.returnTreeNotSupported(c)
+	}
+
+	filter := url.Values{"dept": {req.DepartmentID}}
+	if recursive {
+		filter.Set("recursive", "true")
+	}
+	pager := s.newPager(c, store, filter)
+	cursor, err := pager.unwrap(req.Cursor)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
+	}
+	req.Cursor = cursor
+
+	var data *spec.PagingUsers
+	if recursive {
+		data, err = tree.ListUsersInSubtree(pager.context(), req)
+	} else {
+		data, err = store.ListUsersInDepartment(pager.context(), req)
 	}
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	data.Cursor = pager.wrap(data.Cursor)
 	return c.JSON(200, spec.ListUsersInDepartmentResponse{PagingUsers: *data})
 }
 
@@ -92,7 +176,7 @@ func (s *Server) serarchUser(c echo.Context) error {
 	data, err := s.getContactStore(c).
 		SearchUser(c.Request().Context(), keyword)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
 	}
 
 	return c.JSON(200, &spec.SearchUserResponse{Data: data})
@@ -104,11 +188,19 @@ func (s *Server) listGroups(c echo.Context) error {
 		return s.returnBadRequest(c, err)
 	}
 
-	data, err := s.getContactStore(c).
-		ListGroups(c.Request().Context(), req)
+	store := s.getContactStore(c)
+	pager := s.newPager(c, store, nil)
+	cursor, err := pager.unwrap(req.Cursor)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
+	}
+	req.Cursor = cursor
+
+	data, err := store.ListGroups(pager.context(), req)
+	if err != nil {
+		return s.returnStoreError(c, err)
 	}
+	data.Cursor = pager.wrap(data.Cursor)
 	return c.JSON(200, spec.ListGroupResponse{PagingGroups: *data})
 }
 
@@ -127,7 +219,7 @@ func (s *Server) searchGroup(c echo.Context) error {
 	data, err := s.getContactStore(c).
 		SearchGroup(c.Request().Context(), keyword)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
 	}
 
 	if data == nil {
@@ -145,20 +237,34 @@ func (s *Server) listUsersInGroup(c echo.Context) error {
 		return s.returnBadRequest(c, err)
 	}
 
-	data, err := s.getContactStore(c).ListUsersInGroup(c.Request().Context(), req)
+	store := s.getContactStore(c)
+	pager := s.newPager(c, store, url.Values{"group": {req.Group}})
+	cursor, err := pager.unwrap(req.Cursor)
 	if err != nil {
-		return s.returnBadRequest(c, err)
+		return s.returnStoreError(c, err)
 	}
+	req.Cursor = cursor
+
+	data, err := store.ListUsersInGroup(pager.context(), req)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	data.Cursor = pager.wrap(data.Cursor)
 	return c.JSON(200, spec.ListGroupMembershipResponse{
 		Members: *data,
 	})
 }
 
+// getContactStore 返回请求使用的ContactStore, 请求者设置了访问策略时, 按策略过滤返回的数据
 func (s *Server) getContactStore(c echo.Context) ContactStore {
-	store := c.Get("_store_")
-	if store == nil {
-		return s.contacts
+	store := s.contacts
+	if v := c.Get("_store_"); v != nil {
+		store = v.(ContactStore)
 	}
 
-	return store.(ContactStore)
+	clientid, _ := c.Get(contextClientIDKey).(string)
+	if policy, ok := s.policies[clientid]; ok {
+		return newScopedStore(store, policy, s.deptParents)
+	}
+	return store
 }
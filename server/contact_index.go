@@ -0,0 +1,122 @@
+package server
+
+import (
+	"sync"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// contactsIndex 加载时为每个快照建立的索引, 使分页请求的耗时只与单页数量相关
+type contactsIndex struct {
+	deptByID map[string]*spec.Department
+	userByID map[string]*spec.User
+
+	// 部门id -> 直属用户(主部门或其他部门为该部门), 保持文件中的顺序
+	deptUsers map[string][]*spec.User
+	// group id -> 成员的用户id列表, 保持文件中的顺序
+	members map[string][]string
+
+	// 部门树: 部门id -> 直属下级部门, 保持文件中的顺序; 根部门的key为空字符串
+	children map[string][]*spec.Department
+	// 先序遍历的全部部门, 每个部门的子孙部门是其中连续的一段: preorder[pos+1:end]
+	preorder []*spec.Department
+	pos, end map[string]int
+
+	// 部门id -> 部门及子孙部门下去重后的用户, 首次请求时生成
+	subtree sync.Map
+}
+
+func newContactsIndex(snap *contactsSnapshot) *contactsIndex {
+	idx := &contactsIndex{
+		deptByID:  make(map[string]*spec.Department, len(snap.depts)),
+		userByID:  make(map[string]*spec.User, len(snap.users)),
+		deptUsers: map[string][]*spec.User{},
+		members:   map[string][]string{},
+		children:  map[string][]*spec.Department{},
+		preorder:  make([]*spec.Department, 0, len(snap.depts)),
+		pos:       make(map[string]int, len(snap.depts)),
+		end:       make(map[string]int, len(snap.depts)),
+	}
+
+	for _, d := range snap.depts {
+		idx.deptByID[d.ID] = d
+		idx.children[d.Parent] = append(idx.children[d.Parent], d)
+	}
+	// 加载时已校验部门树中没有环, 且上级部门都存在
+	idx.walk("")
+
+	for _, u := range snap.users {
+		idx.userByID[u.ID] = u
+
+		idx.deptUsers[u.MainDepartmentID] = append(idx.deptUsers[u.MainDepartmentID], u)
+		for i, other := range u.OtherDepartmentsID {
+			// 同一个部门只添加一次
+			if other == u.MainDepartmentID || containsBefore(u.OtherDepartmentsID, i, other) {
+				continue
+			}
+			idx.deptUsers[other] = append(idx.deptUsers[other], u)
+		}
+	}
+
+	for _, m := range snap.groupMembers {
+		idx.members[m.ID] = append(idx.members[m.ID], m.Members...)
+	}
+
+	return idx
+}
+
+func (idx *contactsIndex) walk(parent string) {
+	for _, d := range idx.children[parent] {
+		idx.pos[d.ID] = len(idx.preorder)
+		idx.preorder = append(idx.preorder, d)
+		idx.walk(d.ID)
+		idx.end[d.ID] = len(idx.preorder)
+	}
+}
+
+// descendants 按先序返回部门的全部子孙部门, id为空时返回全部部门
+func (idx *contactsIndex) descendants(id string) []*spec.Department {
+	if id == "" {
+		return idx.preorder
+	}
+	end, found := idx.end[id]
+	if !found {
+		return nil
+	}
+	return idx.preorder[idx.pos[id]+1 : end]
+}
+
+// subtreeUsers 返回部门及其子孙部门下的用户, 按部门的先序排列, 每个用户只出现一次
+func (idx *contactsIndex) subtreeUsers(id string) []*spec.User {
+	if users, ok := idx.subtree.Load(id); ok {
+		return users.([]*spec.User)
+	}
+
+	end, found := idx.end[id]
+	if !found {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	users := []*spec.User{}
+	for _, d := range idx.preorder[idx.pos[id]:end] {
+		for _, u := range idx.deptUsers[d.ID] {
+			if !seen[u.ID] {
+				seen[u.ID] = true
+				users = append(users, u)
+			}
+		}
+	}
+	idx.subtree.Store(id, users)
+	return users
+}
+
+// containsBefore s[:i]中是否包含v
+func containsBefore(s []string, i int, v string) bool {
+	for _, item := range s[:i] {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contactsIndex(t *testing.T) {
+	snap := &contactsSnapshot{
+		depts: []*spec.Department{{ID: "1"}, {ID: "2"}},
+		users: []*spec.User{
+			{ID: "u1", MainDepartmentID: "1"},
+			{ID: "u2", MainDepartmentID: "2", OtherDepartmentsID: []string{"1", "2", "1"}},
+			{ID: "u3", MainDepartmentID: "1"},
+		},
+		groupMembers: []*groupMembership{
+			{ID: "g1", Members: []string{"u1"}},
+			{ID: "g1", Members: []string{"u3"}},
+		},
+	}
+	idx := newContactsIndex(snap)
+
+	ids := func(users []*spec.User) []string {
+		result := []string{}
+		for _, u := range users {
+			result = append(result, u.ID)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"u1", "u2", "u3"}, ids(idx.deptUsers["1"]))
+	assert.Equal(t, []string{"u2"}, ids(idx.deptUsers["2"]))
+	assert.Equal(t, []string{"u1", "u3"}, idx.members["g1"])
+	assert.Same(t, snap.users[1], idx.userByID["u2"])
+	assert.Same(t, snap.depts[0], idx.deptByID["1"])
+}
+
+// newBenchmarkContactsFS 生成depts个部门, 每个部门users个用户的store
+func newBenchmarkContactsFS(depts, users int) *contactsFS {
+	snap := &contactsSnapshot{}
+	for i := 0; i < depts; i++ {
+		deptid := "d-" + strconv.Itoa(i)
+		snap.depts = append(snap.depts, &spec.Department{ID: deptid, Name: deptid})
+		for j := 0; j < users; j++ {
+			userid := deptid + "-u-" + strconv.Itoa(j)
+			snap.users = append(snap.users, &spec.User{ID: userid, Name: userid, MainDepartmentID: deptid})
+		}
+	}
+	snap.idx = newContactsIndex(snap)
+
+	store := &contactsFS{}
+	store.current.Store(snap)
+	return store
+}
+
+// 分页获取一个部门下的全部用户, 200个部门共20万用户
+func Benchmark_contactsFS_ListUsersInDepartment(b *testing.B) {
+	store := newBenchmarkContactsFS(200, 1000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := spec.ListUsersInDepatmentRequest{
+			DepartmentID: "d-100",
+			PagingParam:  spec.PagingParam{Size: 100},
+		}
+		for {
+			page, err := store.ListUsersInDepartment(context.TODO(), req)
+			require.NoError(b, err)
+			if !page.HasNext {
+				break
+			}
+			req.Cursor = page.Cursor
+		}
+	}
+}
+
+// 与Benchmark_contactsFS_ListUsersInDepartment相同的数据, 使用建立索引之前的线性扫描方式作为对比
+func Benchmark_contactsFS_ListUsersInDepartment_linear(b *testing.B) {
+	store := newBenchmarkContactsFS(200, 1000)
+	snap, _ := store.snapshot(context.TODO())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cursor, deptid := 0, "d-100"
+		for cursor != -1 {
+			all := []*spec.User{}
+			for _, user := range snap.users {
+				if deptid == user.MainDepartmentID || slices.Contains(user.OtherDepartmentsID, deptid) {
+					all = append(all, user)
+				}
+			}
+			_, cursor = sublist(all, cursor, 100)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// MutableContactStore 可选接口, 支持修改通讯录的ContactStore可以实现该接口.
+// 实现后, 服务会在/v1/admin下提供管理接口, 仅包含ScopeAdmin的token可以调用(见WithAdminClients).
+// 修改后的数据应满足与加载文件时相同的完整性校验, 否则返回*ValidationError
+type MutableContactStore interface {
+	ContactStore
+
+	// 部门不存在时返回ErrNotFound; 创建时id已存在返回ErrConflict, 下同
+	GetDepartment(ctx context.Context, id string) (*spec.Department, error)
+	CreateDepartment(ctx context.Context, dept *spec.Department) error
+	UpdateDepartment(ctx context.Context, dept *spec.Department) error
+	DeleteDepartment(ctx context.Context, id string) error
+
+	GetUser(ctx context.Context, id string) (*spec.User, error)
+	CreateUser(ctx context.Context, user *spec.User) error
+	UpdateUser(ctx context.Context, user *spec.User) error
+	// 同时从所在的group中移除
+	DeleteUser(ctx context.Context, id string) error
+
+	GetGroup(ctx context.Context, id string) (*spec.Group, error)
+	CreateGroup(ctx context.Context, group *spec.Group) error
+	UpdateGroup(ctx context.Context, group *spec.Group) error
+	// 同时删除group的成员关系
+	DeleteGroup(ctx context.Context, id string) error
+
+	// 添加group成员, 已是成员的用户被忽略
+	AddGroupMembers(ctx context.Context, group string, users []string) error
+	// 移除group成员, 不是成员的用户被忽略
+	RemoveGroupMembers(ctx context.Context, group string, users []string) error
+}
+
+// ErrConflict 要创建的部门/用户/group的id已存在
+var ErrConflict = errors.New("already exists")
+
+// writableSource 支持写回的数据来源
+type writableSource interface {
+	contactsSource
+	write(snap *contactsSnapshot) error
+}
+
+// interface compliance
+var _ MutableContactStore = (*contactsFS)(nil)
+
+// mutate 复制当前快照并修改, 校验通过后使新快照生效; 开启写回时先写回文件.
+// 快照中的数据在创建后不再修改, 因此fn只能替换或删除列表中的元素, 不能修改元素本身
+func (c *contactsFS) mutate(fn func(snap *contactsSnapshot) error) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	current, err := c.snapshot(context.Background())
+	if err != nil {
+		return err
+	}
+
+	snap := &contactsSnapshot{
+		depts:        slices.Clone(current.depts),
+		users:        slices.Clone(current.users),
+		groups:       slices.Clone(current.groups),
+		groupMembers: slices.Clone(current.groupMembers),
+		stamps:       current.stamps,
+	}
+	if err := fn(snap); err != nil {
+		return err
+	}
+	if report := validateContacts(snap); !report.OK() {
+		return &ValidationError{Report: report}
+	}
+
+	if c.writeBack {
+		if err := c.source.(writableSource).write(snap); err != nil {
+			return &UnavailableError{Source: "contacts file store", Err: err}
+		}
+		// 写回后文件的状态与快照一致, 不会触发重新加载
+		snap.stamps = c.source.stamps()
+		snap.version = stampsVersion(snap.stamps)
+	} else {
+		c.mutations++
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", current.version, c.mutations)))
+		snap.version = hex.EncodeToString(h[:8])
+	}
+	snap.idx = newContactsIndex(snap)
+
+	c.install(snap)
+	return nil
+}
+
+// GetDepartment implements MutableContactStore.
+func (c *contactsFS) GetDepartment(ctx context.Context, id string) (*spec.Department, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d, found := snap.idx.deptByID[id]; found {
+		return d, nil
+	}
+	return nil, fmt.Errorf("department %q %w", id, ErrNotFound)
+}
+
+// CreateDepartment implements MutableContactStore.
+func (c *contactsFS) CreateDepartment(_ context.Context, dept *spec.Department) error {
+	d := *dept
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return create(&snap.depts, &d, departmentID, "department")
+	})
+}
+
+// UpdateDepartment implements MutableContactStore.
+func (c *contactsFS) UpdateDepartment(_ context.Context, dept *spec.Department) error {
+	d := *dept
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return update(snap.depts, &d, departmentID, "department")
+	})
+}
+
+// DeleteDepartment implements MutableContactStore.
+// 部门下还有子部门或用户时, 无法通过完整性校验
+func (c *contactsFS) DeleteDepartment(_ context.Context, id string) error {
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return remove(&snap.depts, id, departmentID, "department")
+	})
+}
+
+// GetUser implements MutableContactStore.
+func (c *contactsFS) GetUser(ctx context.Context, id string) (*spec.User, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if u, found := snap.idx.userByID[id]; found {
+		return u, nil
+	}
+	return nil, fmt.Errorf("user %q %w", id, ErrNotFound)
+}
+
+// CreateUser implements MutableContactStore.
+func (c *contactsFS) CreateUser(_ context.Context, user *spec.User) error {
+	u := copyUser(user)
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return create(&snap.users, u, userID, "user")
+	})
+}
+
+// UpdateUser implements MutableContactStore.
+func (c *contactsFS) UpdateUser(_ context.Context, user *spec.User) error {
+	u := copyUser(user)
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return update(snap.users, u, userID, "user")
+	})
+}
+
+// DeleteUser implements MutableContactStore.
+func (c *contactsFS) DeleteUser(_ context.Context, id string) error {
+	return c.mutate(func(snap *contactsSnapshot) error {
+		if err := remove(&snap.users, id, userID, "user"); err != nil {
+			return err
+		}
+		for i, m := range snap.groupMembers {
+			if slices.Contains(m.Members, id) {
+				snap.groupMembers[i] = &groupMembership{ID: m.ID, Members: without(m.Members, id)}
+			}
+		}
+		return nil
+	})
+}
+
+// GetGroup implements MutableContactStore.
+func (c *contactsFS) GetGroup(ctx context.Context, id string) (*spec.Group, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if i := slices.IndexFunc(snap.groups, func(g *spec.Group) bool { return g.ID == id }); i >= 0 {
+		return snap.groups[i], nil
+	}
+	return nil, fmt.Errorf("group %q %w", id, ErrNotFound)
+}
+
+// CreateGroup implements MutableContactStore.
+func (c *contactsFS) CreateGroup(_ context.Context, group *spec.Group) error {
+	g := *group
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return create(&snap.groups, &g, groupID, "group")
+	})
+}
+
+// UpdateGroup implements MutableContactStore.
+func (c *contactsFS) UpdateGroup(_ context.Context, group *spec.Group) error {
+	g := *group
+	return c.mutate(func(snap *contactsSnapshot) error {
+		return update(snap.groups, &g, groupID, "group")
+	})
+}
+
+// DeleteGroup implements MutableContactStore.
+func (c *contactsFS) DeleteGroup(_ context.Context, id string) error {
+	return c.mutate(func(snap *contactsSnapshot) error {
+		if err := remove(&snap.groups, id, groupID, "group"); err != nil {
+			return err
+		}
+		snap.groupMembers = slices.DeleteFunc(snap.groupMembers, func(m *groupMembership) bool { return m.ID == id })
+		return nil
+	})
+}
+
+// AddGroupMembers implements MutableContactStore.
+func (c *contactsFS) AddGroupMembers(_ context.Context, group string, users []string) error {
+	return c.mutate(func(snap *contactsSnapshot) error {
+		if !slices.ContainsFunc(snap.groups, func(g *spec.Group) bool { return g.ID == group }) {
+			return fmt.Errorf("group %q %w", group, ErrNotFound)
+		}
+
+		i := slices.IndexFunc(snap.groupMembers, func(m *groupMembership) bool { return m.ID == group })
+		if i < 0 {
+			snap.groupMembers = append(snap.groupMembers, &groupMembership{ID: group})
+			i = len(snap.groupMembers) - 1
+		}
+
+		members := slices.Clone(snap.groupMembers[i].Members)
+		for _, u := range users {
+			if !slices.Contains(members, u) {
+				members = append(members, u)
+			}
+		}
+		snap.groupMembers[i] = &groupMembership{ID: group, Members: members}
+		return nil
+	})
+}
+
+// RemoveGroupMembers implements MutableContactStore.
+func (c *contactsFS) RemoveGroupMembers(_ context.Context, group string, users []string) error {
+	return c.mutate(func(snap *contactsSnapshot) error {
+		if !slices.ContainsFunc(snap.groups, func(g *spec.Group) bool { return g.ID == group }) {
+			return fmt.Errorf("group %q %w", group, ErrNotFound)
+		}
+
+		for i, m := range snap.groupMembers {
+			if m.ID != group {
+				continue
+			}
+			members := m.Members
+			for _, u := range users {
+				members = without(members, u)
+			}
+			snap.groupMembers[i] = &groupMembership{ID: group, Members: members}
+		}
+		return nil
+	})
+}
+
+func departmentID(d *spec.Department) string { return d.ID }
+func userID(u *spec.User) string             { return u.ID }
+func groupID(g *spec.Group) string           { return g.ID }
+
+// create 在列表末尾添加, id已存在时返回ErrConflict
+func create[T any](list *[]T, item T, id func(T) string, kind string) error {
+	if slices.ContainsFunc(*list, func(v T) bool { return id(v) == id(item) }) {
+		return fmt.Errorf("%s %q %w", kind, id(item), ErrConflict)
+	}
+	*list = append(*list, item)
+	return nil
+}
+
+// update 替换id相同的元素, 保持原有的顺序
+func update[T any](list []T, item T, id func(T) string, kind string) error {
+	i := slices.IndexFunc(list, func(v T) bool { return id(v) == id(item) })
+	if i < 0 {
+		return fmt.Errorf("%s %q %w", kind, id(item), ErrNotFound)
+	}
+	list[i] = item
+	return nil
+}
+
+func remove[T any](list *[]T, target string, id func(T) string, kind string) error {
+	i := slices.IndexFunc(*list, func(v T) bool { return id(v) == target })
+	if i < 0 {
+		return fmt.Errorf("%s %q %w", kind, target, ErrNotFound)
+	}
+	*list = slices.Delete(*list, i, i+1)
+	return nil
+}
+
+// without 返回去掉v之后的新列表, 不修改s
+func without(s []string, v string) []string {
+	return slices.DeleteFunc(slices.Clone(s), func(item string) bool { return item == v })
+}
+
+// copyUser 深拷贝用户, 包括指针字段, 修改拷贝不会影响快照中的数据
+func copyUser(user *spec.User) *spec.User {
+	u := *user
+	for _, p := range []**string{&u.Username, &u.Email, &u.Mobile, &u.EmployeeNumber, &u.Position} {
+		if *p != nil {
+			*p = spec.Pointer(**p)
+		}
+	}
+	u.OtherDepartmentsID = slices.Clone(user.OtherDepartmentsID)
+	return &u
+}
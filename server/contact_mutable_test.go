@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contactsFS_mutate(t *testing.T) {
+	store, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.TODO()
+	version := storeVersion(store)
+
+	require.NoError(t, store.CreateDepartment(ctx, &spec.Department{ID: "1.4", Parent: "1", Name: "广东"}))
+	require.NoError(t, store.CreateUser(ctx, &spec.User{ID: "uid-10", Name: "user 10", MainDepartmentID: "1.4"}))
+	require.NoError(t, store.AddGroupMembers(ctx, "7", []string{"uid-10", "uid-1"}))
+	assert.NotEqual(t, version, storeVersion(store))
+
+	users, err := store.ListUsersInDepartment(ctx, spec.ListUsersInDepatmentRequest{DepartmentID: "1.4"})
+	require.NoError(t, err)
+	require.Len(t, users.Data, 1)
+	assert.Equal(t, "uid-10", users.Data[0].ID)
+
+	members, err := allGroupMembers(ctx, store, "7")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-10", "uid-1"}, members)
+
+	// 删除用户时, 同时从group中移除
+	require.NoError(t, store.DeleteUser(ctx, "uid-10"))
+	members, err = allGroupMembers(ctx, store, "7")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-1"}, members)
+
+	require.NoError(t, store.DeleteGroup(ctx, "7"))
+	_, err = store.GetGroup(ctx, "7")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, store.CreateDepartment(ctx, &spec.Department{ID: "1", Name: "dup"}), ErrConflict)
+	assert.ErrorIs(t, store.UpdateUser(ctx, &spec.User{ID: "notexists", MainDepartmentID: "1"}), ErrNotFound)
+	assert.ErrorIs(t, store.AddGroupMembers(ctx, "notexists", []string{"uid-1"}), ErrNotFound)
+
+	// 未通过完整性校验时, 数据保持不变
+	version = storeVersion(store)
+	var invalid *ValidationError
+	require.ErrorAs(t, store.CreateDepartment(ctx, &spec.Department{ID: "x", Parent: "notexists"}), &invalid)
+	require.ErrorAs(t, store.UpdateUser(ctx, &spec.User{ID: "uid-1", MainDepartmentID: "notexists"}), &invalid)
+	require.ErrorAs(t, store.DeleteDepartment(ctx, "1.1"), &invalid)
+	require.ErrorAs(t, store.AddGroupMembers(ctx, "1", []string{"notexists"}), &invalid)
+	assert.Equal(t, version, storeVersion(store))
+
+	u, err := store.GetUser(ctx, "uid-1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", u.MainDepartmentID)
+}
+
+func Test_contactsFS_writeBack(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(0), WithWriteBack())
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.TODO()
+	require.NoError(t, store.UpdateDepartment(ctx, &spec.Department{ID: "1.3", Parent: "1", Name: "辽宁省", Order: 3}))
+	require.NoError(t, store.CreateUser(ctx, &spec.User{
+		ID: "uid-10", Name: "user 10", Email: spec.Pointer("user10@example.com"), MainDepartmentID: "1.3",
+	}))
+	require.NoError(t, store.RemoveGroupMembers(ctx, "1", []string{"uid-1.1"}))
+
+	// 写回后文件与快照一致, 不需要重新加载
+	assert.False(t, store.changed())
+
+	reloaded, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(0))
+	require.NoError(t, err)
+	defer reloaded.Close()
+
+	d, err := reloaded.GetDepartment(ctx, "1.3")
+	require.NoError(t, err)
+	assert.Equal(t, "辽宁省", d.Name)
+
+	u, err := reloaded.GetUser(ctx, "uid-10")
+	require.NoError(t, err)
+	assert.Equal(t, "user10@example.com", *u.Email)
+
+	members, err := allGroupMembers(ctx, reloaded, "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-1"}, members)
+
+	// 任一文件写入失败时不修改任何文件
+	dir := filepath.Join(t.TempDir(), "members")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	moved := filepath.Join(dir, "group-users.json")
+	require.NoError(t, os.Rename(groupMembers, moved))
+	partial, err := newContactsFS(dept, user, group, moved, WithReloadInterval(0), WithWriteBack())
+	require.NoError(t, err)
+	defer partial.Close()
+	before, err := os.ReadFile(dept)
+	require.NoError(t, err)
+
+	require.NoError(t, os.RemoveAll(dir))
+	var unavailable *UnavailableError
+	require.ErrorAs(t, partial.UpdateDepartment(ctx, &spec.Department{ID: "1.3", Parent: "1", Name: "辽宁"}), &unavailable)
+	after, err := os.ReadFile(dept)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	tmps, err := filepath.Glob(filepath.Join(filepath.Dir(dept), ".*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmps)
+
+	// CSV文件不支持写回
+	_, err = newContactsFSFromSource(newContactsCSV(writeTestFile(t, "users.csv", "id,name\n"), CSVMapping{}), WithWriteBack())
+	assert.ErrorContains(t, err, "does not support write back")
+}
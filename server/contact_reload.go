@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 通讯录文件重新加载的次数
+var contactsReloads = expvar.NewInt("contacts_file_reloads")
+
+const (
+	defaultReloadInterval = 5 * time.Second
+	defaultSnapshotTTL    = 30 * time.Minute
+)
+
+// FileStoreOption 通讯录文件存储可接受的配置选项
+type FileStoreOption func(c *contactsFS)
+
+// WithReloadInterval 设置检查文件变化的间隔, <=0 表示不检查(即不会热加载)
+func WithReloadInterval(d time.Duration) FileStoreOption {
+	return func(c *contactsFS) {
+		c.interval = d
+	}
+}
+
+// WithSnapshotTTL 设置重新加载后旧数据的保留时间, 默认30分钟.
+// 保留期间, 基于旧数据的分页cursor仍可继续翻页; 每次访问都会重新计时
+func WithSnapshotTTL(ttl time.Duration) FileStoreOption {
+	return func(c *contactsFS) {
+		c.snapshotTTL = ttl
+	}
+}
+
+// WithWriteBack 通过管理接口修改通讯录后, 把数据写回文件(见MutableContactStore).
+// 未开启时修改只保存在内存中, 文件发生变化重新加载后丢失; CSV文件不支持写回
+func WithWriteBack() FileStoreOption {
+	return func(c *contactsFS) {
+		c.writeBack = true
+	}
+}
+
+func newContactsFS(dept, user, group, groupMembers string, opts ...FileStoreOption) (*contactsFS, error) {
+	return newContactsFSFromSource(newContactFiles(dept, user, group, groupMembers), opts...)
+}
+
+func newContactsFSFromSource(source contactsSource, opts ...FileStoreOption) (*contactsFS, error) {
+	c := &contactsFS{
+		source: source,
+
+		retained:    map[string]*retainedSnapshot{},
+		snapshotTTL: defaultSnapshotTTL,
+		digests:     map[string]*snapshotDigest{},
+		changes:     map[changeKey]*ChangeSet{},
+
+		interval: defaultReloadInterval,
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if _, ok := source.(writableSource); c.writeBack && !ok {
+		return nil, fmt.Errorf("contacts: %T does not support write back", source)
+	}
+
+	snap, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.current.Store(snap)
+	c.recordDigest(snap)
+
+	if c.interval > 0 {
+		go c.watch()
+	}
+
+	return c, nil
+}
+
+// snapshot 返回请求指定版本(见SnapshotVersion)的数据快照, 未指定时返回当前生效的快照.
+// 同一个请求内应只调用一次, 以保证读到的4个文件数据是一致的
+func (c *contactsFS) snapshot(ctx context.Context) (*contactsSnapshot, error) {
+	current := c.current.Load()
+	if current == nil {
+		return nil, &UnavailableError{Source: "contacts file store", Err: errors.New("data not loaded")}
+	}
+
+	version := SnapshotVersion(ctx)
+	if version == "" || version == current.version {
+		return current, nil
+	}
+	return c.retainedSnapshot(version)
+}
+
+// Version 实现VersionedStore接口, 返回当前数据快照的版本
+func (c *contactsFS) Version() string {
+	snap, err := c.snapshot(context.Background())
+	if err != nil {
+		return ""
+	}
+	return snap.version
+}
+
+// retainedSnapshot 已被替换但仍在保留期内的快照
+type retainedSnapshot struct {
+	snap *contactsSnapshot
+	// 最后一次访问的时间
+	used time.Time
+}
+
+// retain 保留被替换的快照
+func (c *contactsFS) retain(snap *contactsSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictLocked()
+	c.retained[snap.version] = &retainedSnapshot{snap: snap, used: time.Now()}
+}
+
+func (c *contactsFS) retainedSnapshot(version string) (*contactsSnapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictLocked()
+	found, ok := c.retained[version]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	found.used = time.Now()
+	return found.snap, nil
+}
+
+// evictLocked 清理超过保留时间未被访问的快照, 调用方需持有c.mu
+func (c *contactsFS) evictLocked() {
+	for version, r := range c.retained {
+		if time.Since(r.used) > c.snapshotTTL {
+			delete(c.retained, version)
+		}
+	}
+}
+
+// Close 停止检查文件变化
+func (c *contactsFS) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	return nil
+}
+
+func (c *contactsFS) watch() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if c.changed() {
+				if err := c.reload(); err != nil {
+					log.Printf("contacts: reload failed, keep serving the previous data: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// changed 判断自上次加载以来, 是否有文件发生了变化
+func (c *contactsFS) changed() bool {
+	snap, err := c.snapshot(context.Background())
+	if err != nil {
+		return true
+	}
+
+	current := c.source.stamps()
+	if len(current) != len(snap.stamps) {
+		return true
+	}
+	for i := range current {
+		if !current[i].equal(snap.stamps[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload 重新加载全部文件, 任一文件加载失败时保留原有数据
+func (c *contactsFS) reload() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	snap, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	c.install(snap)
+	contactsReloads.Add(1)
+	log.Printf("contacts: reloaded %d departments, %d users, %d groups, %d group memberships",
+		len(snap.depts), len(snap.users), len(snap.groups), len(snap.groupMembers))
+
+	return nil
+}
+
+// install 使新的快照生效, 并保留被替换的快照
+func (c *contactsFS) install(snap *contactsSnapshot) {
+	c.recordDigest(snap)
+	if old := c.current.Swap(snap); old != nil && old.version != snap.version {
+		c.retain(old)
+	}
+}
+
+// load 加载并校验全部文件, 生成新的数据快照并建立索引
+func (c *contactsFS) load() (*contactsSnapshot, error) {
+	snap, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if report := validateContacts(snap); !report.OK() {
+		return nil, &ValidationError{Report: report}
+	}
+	snap.idx = newContactsIndex(snap)
+
+	return snap, nil
+}
+
+// read 读取全部文件, 并根据读取前各文件的状态生成数据版本
+func (c *contactsFS) read() (*contactsSnapshot, error) {
+	stamps := c.source.stamps()
+
+	snap, err := c.source.read()
+	if err != nil {
+		return nil, err
+	}
+	snap.stamps = stamps
+	snap.version = stampsVersion(stamps)
+
+	return snap, nil
+}
+
+// stampsVersion 根据各文件的修改时间和大小生成数据版本, 文件未变化时重启服务版本不变
+func stampsVersion(stamps []fileStamp) string {
+	h := sha256.New()
+	for _, stamp := range stamps {
+		fmt.Fprintf(h, "%d:%d;", stamp.modTime.UnixNano(), stamp.size)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyTestdata 把testdata下的通讯录文件复制到临时目录, 返回4个文件的路径
+func copyTestdata(t *testing.T) (dept, user, group, groupMembers string) {
+	dir := t.TempDir()
+	files := []string{"departments.json", "users.json", "groups.json", "group-users.json"}
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join("testdata", f))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), content, 0o600))
+	}
+
+	return filepath.Join(dir, files[0]), filepath.Join(dir, files[1]),
+		filepath.Join(dir, files[2]), filepath.Join(dir, files[3])
+}
+
+func Test_contactsFS_reload(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	before, err := store.snapshot(context.TODO())
+	require.NoError(t, err)
+	assert.False(t, store.changed())
+
+	// 写入非法内容, 重新加载失败, 继续使用原有数据
+	require.NoError(t, os.WriteFile(user, []byte(`[{"id": `), 0o600))
+	assert.True(t, store.changed())
+	assert.Error(t, store.reload())
+	after, err := store.snapshot(context.TODO())
+	require.NoError(t, err)
+	assert.Same(t, before, after)
+
+	require.NoError(t, os.WriteFile(user,
+		[]byte(`[{"id": "uid-new", "name": "new", "main_department": "1"}]`), 0o600))
+	require.NoError(t, os.WriteFile(groupMembers, []byte(`[{"id": "1", "members": ["uid-new"]}]`), 0o600))
+	require.NoError(t, store.reload())
+	assert.False(t, store.changed())
+
+	users, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "1",
+		PagingParam:  spec.PagingParam{Size: 10},
+	})
+	require.NoError(t, err)
+	assert.Len(t, users.Data, 1)
+	assert.Equal(t, "uid-new", users.Data[0].ID)
+}
+
+func Test_contactsFS_watch(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers, WithReloadInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer store.Close()
+
+	before := contactsReloads.Value()
+	require.NoError(t, os.WriteFile(groupMembers, []byte(`[{"id": "1", "members": ["uid-1"]}]`), 0o600))
+
+	assert.Eventually(t, func() bool {
+		snap, err := store.snapshot(context.TODO())
+		return err == nil && len(snap.groupMembers) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Greater(t, contactsReloads.Value(), before)
+}
+
+func Test_contactsFS_retainedSnapshot(t *testing.T) {
+	dept, user, group, groupMembers := copyTestdata(t)
+	store, err := newContactsFS(dept, user, group, groupMembers,
+		WithReloadInterval(0), WithSnapshotTTL(time.Hour))
+	require.NoError(t, err)
+	defer store.Close()
+
+	before := store.Version()
+	require.NoError(t, os.WriteFile(groupMembers, []byte(`[{"id": "1", "members": ["uid-1"]}]`), 0o600))
+	require.NoError(t, store.reload())
+	assert.NotEqual(t, before, store.Version())
+
+	// 基于旧版本继续翻页, 仍然返回旧数据
+	ctx := withSnapshotVersion(context.TODO(), before)
+	members, err := store.ListUsersInGroup(ctx, spec.ListGroupMembershipRequest{
+		Group:       "2",
+		PagingParam: spec.PagingParam{Size: 10},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-2", "uid-2.1"}, members.Data)
+
+	// 超过保留时间
+	store.snapshotTTL = 0
+	_, err = store.ListUsersInGroup(ctx, spec.ListGroupMembershipRequest{
+		Group:       "2",
+		PagingParam: spec.PagingParam{Size: 10},
+	})
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
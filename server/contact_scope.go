@@ -0,0 +1,548 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// ClientPolicy 限制client可以访问的通讯录数据, 各项为空时不限制
+type ClientPolicy struct {
+	// 允许访问的部门子树的根部门id, 包括根部门本身及其全部子孙部门.
+	// 根部门的上级部门不在范围内时, 返回的根部门parent为空, 即返回的部门是一棵(或几棵)完整的树;
+	// 用户的主部门不在范围内时, 以第一个在范围内的其他部门作为主部门
+	Departments []string
+	// 允许访问的group id
+	Groups []string
+	// 隐藏的用户字段, 为JSON字段名: username, email, mobile, employee_number, position
+	HiddenUserFields []string
+}
+
+// WithClientPolicy 设置client的访问策略, 未设置策略的client可以访问全部数据.
+// 设置了策略的client不能使用增量同步和管理接口.
+// HiddenUserFields中有不支持的字段时, Start返回错误
+func WithClientPolicy(clientID string, policy ClientPolicy) Option {
+	for _, f := range policy.HiddenUserFields {
+		if _, ok := hideUserField[f]; !ok {
+			return withError(fmt.Errorf("client %q: unsupported hidden user field %q", clientID, f))
+		}
+	}
+
+	return func(srv *Server) {
+		if srv.policies == nil {
+			srv.policies = map[string]*ClientPolicy{}
+		}
+		srv.policies[clientID] = &policy
+	}
+}
+
+// 可以隐藏的用户字段
+var hideUserField = map[string]func(u *spec.User){
+	"username":        func(u *spec.User) { u.Username = nil },
+	"email":           func(u *spec.User) { u.Email = nil },
+	"mobile":          func(u *spec.User) { u.Mobile = nil },
+	"employee_number": func(u *spec.User) { u.EmployeeNumber = nil },
+	"position":        func(u *spec.User) { u.Position = nil },
+}
+
+// newScopedStore 按client的访问策略过滤store返回的数据, 每个请求创建一个.
+// parents在各请求间共用, 为空时每个请求重新加载部门的上级关系
+func newScopedStore(store ContactStore, policy *ClientPolicy, parents *deptParentsCache) ContactStore {
+	scoped := &scopedStore{
+		store:        store,
+		policy:       policy,
+		roots:        map[string]bool{},
+		groups:       map[string]bool{},
+		cache:        map[string]bool{},
+		parentsCache: parents,
+	}
+	for _, id := range policy.Departments {
+		scoped.roots[id] = true
+	}
+	for _, id := range policy.Groups {
+		scoped.groups[id] = true
+	}
+
+	if tree, ok := store.(DepartmentTreeStore); ok {
+		return &scopedTreeStore{scopedStore: scoped, tree: tree}
+	}
+	return scoped
+}
+
+type scopedStore struct {
+	store  ContactStore
+	policy *ClientPolicy
+
+	roots  map[string]bool
+	groups map[string]bool
+
+	// 部门id -> 是否在范围内
+	cache map[string]bool
+	// 部门id -> 上级部门id, 仅当store不支持部门树查询时使用, 首次使用时从parentsCache获取
+	parents      map[string]string
+	parentsCache *deptParentsCache
+	// 范围内的用户id, store未实现ContactGetter时首次过滤group成员时获取
+	visibleUsers map[string]bool
+}
+
+// interface compliance
+var (
+	_ ContactStore   = (*scopedStore)(nil)
+	_ VersionedStore = (*scopedStore)(nil)
+	_ ContactGetter  = (*scopedStore)(nil)
+)
+
+// Version implements VersionedStore.
+func (s *scopedStore) Version() string {
+	return storeVersion(s.store)
+}
+
+// ListDepartments implements ContactStore.
+func (s *scopedStore) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
+	*spec.PagingDepartments, error,
+) {
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingDepartments, error) {
+		req.Cursor = cursor
+		return s.store.ListDepartments(ctx, req)
+	}, func(d *spec.Department) (*spec.Department, bool, error) {
+		return s.department(ctx, d)
+	})
+}
+
+// SearchDepartment implements ContactStore.
+func (s *scopedStore) SearchDepartment(ctx context.Context, kw string) ([]*spec.Department, error) {
+	data, err := s.store.SearchDepartment(ctx, kw)
+	if err != nil {
+		return nil, err
+	}
+	return filterList(data, func(d *spec.Department) (*spec.Department, bool, error) {
+		return s.department(ctx, d)
+	})
+}
+
+// ListUsersInDepartment implements ContactStore.
+func (s *scopedStore) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	if err := s.checkDepartment(ctx, req.DepartmentID); err != nil {
+		return nil, err
+	}
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingUsers, error) {
+		req.Cursor = cursor
+		return s.store.ListUsersInDepartment(ctx, req)
+	}, func(u *spec.User) (*spec.User, bool, error) {
+		return s.user(ctx, u)
+	})
+}
+
+// SearchUser implements ContactStore.
+func (s *scopedStore) SearchUser(ctx context.Context, kw string) ([]*spec.User, error) {
+	data, err := s.store.SearchUser(ctx, kw)
+	if err != nil {
+		return nil, err
+	}
+	return filterList(data, func(u *spec.User) (*spec.User, bool, error) {
+		return s.user(ctx, u)
+	})
+}
+
+// ListGroups implements ContactStore.
+func (s *scopedStore) ListGroups(ctx context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingGroups, error) {
+		req.Cursor = cursor
+		return s.store.ListGroups(ctx, req)
+	}, func(g *spec.Group) (*spec.Group, bool, error) {
+		return g, s.groupInScope(g.ID), nil
+	})
+}
+
+// SearchGroup implements ContactStore.
+func (s *scopedStore) SearchGroup(ctx context.Context, kw string) ([]*spec.Group, error) {
+	data, err := s.store.SearchGroup(ctx, kw)
+	if err != nil {
+		return nil, err
+	}
+	return filterList(data, func(g *spec.Group) (*spec.Group, bool, error) {
+		return g, s.groupInScope(g.ID), nil
+	})
+}
+
+// ListUsersInGroup implements ContactStore.
+// 限制了部门且store支持按id获取用户(如通讯录文件存储)时, 不返回范围外的成员
+func (s *scopedStore) ListUsersInGroup(ctx context.Context, req spec.ListGroupMembershipRequest) (
+	*spec.PagingResult[string], error,
+) {
+	if !s.groupInScope(req.Group) {
+		return nil, fmt.Errorf("group %q %w", req.Group, ErrNotFound)
+	}
+
+	getter, ok := s.store.(ContactGetter)
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingResult[string], error) {
+		req.Cursor = cursor
+		return s.store.ListUsersInGroup(ctx, req)
+	}, func(id string) (string, bool, error) {
+		if len(s.roots) == 0 {
+			return id, true, nil
+		}
+		if !ok {
+			visible, err := s.visibleUserIDs(ctx)
+			return id, visible[id], err
+		}
+		u, err := getter.GetUser(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return id, false, nil
+		}
+		if err != nil {
+			return id, false, err
+		}
+		_, visible, err := s.user(ctx, u)
+		return id, visible, err
+	})
+}
+
+// visibleUserIDs 遍历范围内的部门, 返回其中全部用户的id; store不支持按id获取用户时使用
+func (s *scopedStore) visibleUserIDs(ctx context.Context) (map[string]bool, error) {
+	if s.visibleUsers != nil {
+		return s.visibleUsers, nil
+	}
+
+	depts, err := allDepartments(ctx, s.store)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{}
+	for _, d := range depts {
+		ok, err := s.inScope(ctx, d.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		req := spec.ListUsersInDepatmentRequest{
+			DepartmentID: d.ID,
+			PagingParam:  spec.PagingParam{Size: walkPageSize},
+		}
+		for {
+			data, err := s.store.ListUsersInDepartment(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range data.Data {
+				visible[u.ID] = true
+			}
+			if !data.HasNext {
+				break
+			}
+			req.Cursor = data.Cursor
+		}
+	}
+	s.visibleUsers = visible
+	return visible, nil
+}
+
+// GetUser implements ContactGetter, 用户不在范围内时返回ErrNotFound
+func (s *scopedStore) GetUser(ctx context.Context, id string) (*spec.User, error) {
+	u, err := getUser(ctx, s.store, id)
+	if err != nil {
+		return nil, err
+	}
+	scoped, visible, err := s.user(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, fmt.Errorf("user %q %w", id, ErrNotFound)
+	}
+	return scoped, nil
+}
+
+// GetGroup implements ContactGetter, group不在范围内时返回ErrNotFound
+func (s *scopedStore) GetGroup(ctx context.Context, id string) (*spec.Group, error) {
+	if !s.groupInScope(id) {
+		return nil, fmt.Errorf("group %q %w", id, ErrNotFound)
+	}
+	return getGroup(ctx, s.store, id)
+}
+
+func (s *scopedStore) groupInScope(id string) bool {
+	return len(s.groups) == 0 || s.groups[id]
+}
+
+// checkDepartment 部门不在范围内时返回ErrNotFound, 与部门不存在相同
+func (s *scopedStore) checkDepartment(ctx context.Context, id string) error {
+	ok, err := s.inScope(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("department %q %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// inScope 部门或其任一上级部门是否为允许访问的根部门
+func (s *scopedStore) inScope(ctx context.Context, id string) (bool, error) {
+	if len(s.roots) == 0 {
+		return true, nil
+	}
+	if id == "" {
+		return false, nil
+	}
+	if ok, found := s.cache[id]; found {
+		return ok, nil
+	}
+
+	chain, err := s.ancestors(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	ok := slices.ContainsFunc(append(chain, id), func(a string) bool { return s.roots[a] })
+	s.cache[id] = ok
+	return ok, nil
+}
+
+// ancestors 返回部门的全部上级部门id, 部门不存在时返回空
+func (s *scopedStore) ancestors(ctx context.Context, id string) ([]string, error) {
+	if tree, ok := s.store.(DepartmentTreeStore); ok {
+		depts, err := tree.ListAncestors(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return deptIDs(depts), nil
+	}
+
+	if s.parents == nil {
+		version := SnapshotVersion(ctx)
+		if version == "" {
+			version = storeVersion(s.store)
+		}
+		parents, err := s.parentsCache.load(ctx, s.store, version)
+		if err != nil {
+			return nil, err
+		}
+		s.parents = parents
+	}
+
+	chain := []string{}
+	for p := s.parents[id]; p != "" && len(chain) < len(s.parents); p = s.parents[p] {
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// 缓存的部门上级关系的最大版本数
+const maxCachedParents = 4
+
+// deptParentsCache 按数据版本缓存部门id -> 上级部门id, 供不支持部门树查询的store在各请求间共用.
+// store没有版本(未实现VersionedStore)时不缓存, 每个请求重新加载
+type deptParentsCache struct {
+	mu       sync.Mutex
+	versions map[string]map[string]string
+	order    []string
+}
+
+func newDeptParentsCache() *deptParentsCache {
+	return &deptParentsCache{versions: map[string]map[string]string{}}
+}
+
+// load 返回指定版本的部门上级关系, 不在缓存中时遍历该版本的全部部门
+func (c *deptParentsCache) load(ctx context.Context, store ContactStore, version string) (map[string]string, error) {
+	cached := c != nil && version != ""
+	if cached {
+		c.mu.Lock()
+		parents, found := c.versions[version]
+		c.mu.Unlock()
+		if found {
+			return parents, nil
+		}
+	}
+
+	depts, err := allDepartments(withSnapshotVersion(ctx, version), store)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[string]string, len(depts))
+	for _, d := range depts {
+		parents[d.ID] = d.Parent
+	}
+
+	if cached {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, found := c.versions[version]; !found {
+			c.versions[version] = parents
+			c.order = append(c.order, version)
+			if len(c.order) > maxCachedParents {
+				delete(c.versions, c.order[0])
+				c.order = c.order[1:]
+			}
+		}
+	}
+	return parents, nil
+}
+
+// department 部门不在范围内时返回false; 上级部门不在范围内时, 返回parent为空的拷贝
+func (s *scopedStore) department(ctx context.Context, d *spec.Department) (*spec.Department, bool, error) {
+	ok, err := s.inScope(ctx, d.ID)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if len(s.roots) > 0 && d.Parent != "" {
+		parentOK, err := s.inScope(ctx, d.Parent)
+		if err != nil {
+			return nil, false, err
+		}
+		if !parentOK {
+			root := *d
+			root.Parent = ""
+			return &root, true, nil
+		}
+	}
+	return d, true, nil
+}
+
+// user 用户的所有部门都不在范围内时返回false; 否则返回去掉范围外的部门以及隐藏字段后的拷贝
+func (s *scopedStore) user(ctx context.Context, u *spec.User) (*spec.User, bool, error) {
+	depts := []string{}
+	for _, id := range append([]string{u.MainDepartmentID}, u.OtherDepartmentsID...) {
+		ok, err := s.inScope(ctx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok && !slices.Contains(depts, id) {
+			depts = append(depts, id)
+		}
+	}
+	if len(s.roots) > 0 && len(depts) == 0 {
+		return nil, false, nil
+	}
+	if len(s.roots) == 0 && len(s.policy.HiddenUserFields) == 0 {
+		return u, true, nil
+	}
+
+	scoped := copyUser(u)
+	if len(s.roots) > 0 {
+		scoped.MainDepartmentID = depts[0]
+		scoped.OtherDepartmentsID = depts[1:]
+		if len(scoped.OtherDepartmentsID) == 0 {
+			scoped.OtherDepartmentsID = nil
+		}
+	}
+	for _, f := range s.policy.HiddenUserFields {
+		hideUserField[f](scoped)
+	}
+	return scoped, true, nil
+}
+
+// scopedTreeStore store支持部门树查询时, 同样按访问策略过滤
+type scopedTreeStore struct {
+	*scopedStore
+	tree DepartmentTreeStore
+}
+
+// interface compliance
+var _ DepartmentTreeStore = (*scopedTreeStore)(nil)
+
+// ListSubDepartments implements DepartmentTreeStore.
+// Parent为空时从允许访问的根部门开始
+func (s *scopedTreeStore) ListSubDepartments(ctx context.Context, req ListSubDepartmentsRequest) (
+	*spec.PagingDepartments, error,
+) {
+	keep := func(d *spec.Department) (*spec.Department, bool, error) {
+		return s.department(ctx, d)
+	}
+	if req.Parent == "" && !req.Recursive && len(s.roots) > 0 {
+		// 范围内的根部门可能在部门树的任意位置, 遍历整棵树
+		req.Recursive = true
+		keep = func(d *spec.Department) (*spec.Department, bool, error) {
+			d, ok, err := s.department(ctx, d)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			return d, d.Parent == "", nil
+		}
+	}
+	if req.Parent != "" {
+		if err := s.checkDepartment(ctx, req.Parent); err != nil {
+			return nil, err
+		}
+	}
+
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingDepartments, error) {
+		req.Cursor = cursor
+		return s.tree.ListSubDepartments(ctx, req)
+	}, keep)
+}
+
+// ListUsersInSubtree implements DepartmentTreeStore.
+func (s *scopedTreeStore) ListUsersInSubtree(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	if err := s.checkDepartment(ctx, req.DepartmentID); err != nil {
+		return nil, err
+	}
+	return filterPage(req.Cursor, func(cursor string) (*spec.PagingUsers, error) {
+		req.Cursor = cursor
+		return s.tree.ListUsersInSubtree(ctx, req)
+	}, func(u *spec.User) (*spec.User, bool, error) {
+		return s.user(ctx, u)
+	})
+}
+
+// ListAncestors implements DepartmentTreeStore.
+// 只返回范围内的上级部门
+func (s *scopedTreeStore) ListAncestors(ctx context.Context, id string) ([]*spec.Department, error) {
+	if err := s.checkDepartment(ctx, id); err != nil {
+		return nil, err
+	}
+	data, err := s.tree.ListAncestors(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return filterList(data, func(d *spec.Department) (*spec.Department, bool, error) {
+		return s.department(ctx, d)
+	})
+}
+
+// filterPage 获取一页数据并过滤, 过滤后为空时继续获取下一页, 返回的数据不超过一页
+func filterPage[T any](cursor string, list func(cursor string) (*spec.PagingResult[T], error),
+	keep func(T) (T, bool, error),
+) (*spec.PagingResult[T], error) {
+	for {
+		page, err := list(cursor)
+		if err != nil {
+			return nil, err
+		}
+		data, err := filterList(page.Data, keep)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 || !page.HasNext {
+			return &spec.PagingResult[T]{HasNext: page.HasNext, Cursor: page.Cursor, Data: data}, nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+func filterList[T any](list []T, keep func(T) (T, bool, error)) ([]T, error) {
+	data := make([]T, 0, len(list))
+	for _, item := range list {
+		item, ok, err := keep(item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			data = append(data, item)
+		}
+	}
+	return data, nil
+}
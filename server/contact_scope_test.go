@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nonTreeStore 隐藏contactsFS的DepartmentTreeStore等可选接口
+type nonTreeStore struct {
+	ContactStore
+}
+
+func Test_scopedStore(t *testing.T) {
+	fs, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer fs.Close()
+
+	policy := &ClientPolicy{
+		Departments:      []string{"1.1", "1.2.3"},
+		Groups:           []string{"2", "4"},
+		HiddenUserFields: []string{"email"},
+	}
+
+	for name, inner := range map[string]ContactStore{"tree": fs, "nontree": &nonTreeStore{fs}} {
+		ctx := context.TODO()
+		store := newScopedStore(inner, policy, nil)
+
+		depts, err := allDepartments(ctx, store)
+		require.NoError(t, err, name)
+		assert.Equal(t, []string{"1.1", "1.1.1", "1.1.2", "1.1.3", "1.2.3"}, deptIDs(depts), name)
+		// 范围内的根部门parent为空
+		assert.Empty(t, depts[0].Parent, name)
+		assert.Equal(t, "1.1", depts[1].Parent, name)
+
+		ids := []string{}
+		require.NoError(t, walkUsers(ctx, store, func(u *spec.User) bool {
+			ids = append(ids, u.ID)
+			assert.Nil(t, u.Email, name)
+			assert.NotNil(t, u.Username, name)
+			return true
+		}), name)
+		assert.Equal(t, []string{"uid-2", "uid-2.1", "uid-4", "uid-5", "uid-6", "uid-9"}, ids, name)
+
+		_, err = store.ListUsersInDepartment(ctx, spec.ListUsersInDepatmentRequest{DepartmentID: "1"})
+		assert.ErrorIs(t, err, ErrNotFound, name)
+
+		found, err := store.SearchUser(ctx, "user1")
+		require.NoError(t, err, name)
+		assert.Empty(t, found, name)
+
+		groups, err := allGroups(ctx, store)
+		require.NoError(t, err, name)
+		assert.Len(t, groups, 2, name)
+
+		_, err = store.ListUsersInGroup(ctx, spec.ListGroupMembershipRequest{Group: "1"})
+		assert.ErrorIs(t, err, ErrNotFound, name)
+	}
+
+	// 原始数据不受影响
+	u, err := fs.GetUser(context.TODO(), "uid-2")
+	require.NoError(t, err)
+	assert.NotNil(t, u.Email)
+}
+
+func Test_scopedStore_groupMembers(t *testing.T) {
+	fs, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer fs.Close()
+
+	policy := &ClientPolicy{Departments: []string{"1.1"}, Groups: []string{"1", "2"}}
+	// nontree不支持按id获取用户, 遍历范围内的部门判断成员是否可见
+	for name, inner := range map[string]ContactStore{"getter": fs, "nontree": &nonTreeStore{fs}} {
+		ctx := context.TODO()
+		store := newScopedStore(inner, policy, nil)
+
+		members, err := allGroupMembers(ctx, store, "1")
+		require.NoError(t, err, name)
+		assert.Empty(t, members, name)
+
+		members, err = allGroupMembers(ctx, store, "2")
+		require.NoError(t, err, name)
+		assert.Equal(t, []string{"uid-2", "uid-2.1"}, members, name)
+	}
+}
+
+// countingDeptStore 有版本但不支持部门树查询的store, 记录遍历部门的次数
+type countingDeptStore struct {
+	ContactStore
+	fs     *contactsFS
+	listed int
+}
+
+func (s *countingDeptStore) Version() string {
+	return s.fs.Version()
+}
+
+func (s *countingDeptStore) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
+	*spec.PagingDepartments, error,
+) {
+	s.listed++
+	return s.fs.ListDepartments(ctx, req)
+}
+
+func Test_scopedStore_parentsCache(t *testing.T) {
+	fs, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer fs.Close()
+
+	ctx := context.TODO()
+	inner := &countingDeptStore{ContactStore: &nonTreeStore{fs}, fs: fs}
+	cache := newDeptParentsCache()
+	policy := &ClientPolicy{Departments: []string{"1.1"}}
+	list := func(dept string) error {
+		store := newScopedStore(inner, policy, cache)
+		_, err := store.ListUsersInDepartment(ctx, spec.ListUsersInDepatmentRequest{DepartmentID: dept})
+		return err
+	}
+
+	require.NoError(t, list("1.1.1"))
+	listed := inner.listed
+	assert.Positive(t, listed)
+
+	// 同一版本的后续请求使用缓存
+	assert.ErrorIs(t, list("1.2.1"), ErrNotFound)
+	require.NoError(t, list("1.1.2"))
+	assert.Equal(t, listed, inner.listed)
+
+	// 数据变化后重新加载
+	require.NoError(t, fs.CreateDepartment(ctx, &spec.Department{ID: "1.1.4", Parent: "1.1", Name: "新部门"}))
+	require.NoError(t, list("1.1.4"))
+	assert.Greater(t, inner.listed, listed)
+}
+
+func Test_scopedStore_tree(t *testing.T) {
+	fs, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer fs.Close()
+
+	ctx := context.TODO()
+	store := newScopedStore(fs, &ClientPolicy{Departments: []string{"1.1", "1.2.3"}}, nil).(DepartmentTreeStore)
+
+	roots, err := store.ListSubDepartments(ctx, ListSubDepartmentsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1", "1.2.3"}, deptIDs(roots.Data))
+
+	_, err = store.ListSubDepartments(ctx, ListSubDepartmentsRequest{Parent: "1.2"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	ancestors, err := store.ListAncestors(ctx, "1.1.2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1"}, deptIDs(ancestors))
+	assert.Empty(t, ancestors[0].Parent)
+
+	users, err := store.ListUsersInSubtree(ctx, spec.ListUsersInDepatmentRequest{DepartmentID: "1.1"})
+	require.NoError(t, err)
+	assert.Len(t, users.Data, 5)
+}
+
+func Test_clientPolicy(t *testing.T) {
+	fs, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer fs.Close()
+
+	// allowAnyAs的client_id为any_client
+	e := New(0, WithContactStore(fs),
+		WithClientPolicy("any_client", ClientPolicy{Groups: []string{"3"}, HiddenUserFields: []string{"mobile", "email"}}),
+	).newEcho()
+	get := func(target string) (int, map[string]any) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer any")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	status, body := get("/v1/groups")
+	require.Equal(t, 200, status)
+	require.Len(t, body["data"], 1)
+
+	status, _ = get("/v1/groups/users?group=1")
+	assert.Equal(t, 404, status)
+
+	_, body = get("/v1/users?dept_id=1")
+	user := body["data"].([]any)[0].(map[string]any)
+	assert.Equal(t, "user1", user["username"])
+	assert.NotContains(t, user, "email")
+
+	// 设置了策略的client不能使用增量同步
+	status, _ = get("/v1/changes")
+	assert.Equal(t, 404, status)
+
+	assert.ErrorContains(t, New(0, WithClientPolicy("c", ClientPolicy{HiddenUserFields: []string{"name"}})).Err(),
+		"unsupported hidden user field")
+}
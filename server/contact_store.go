@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	spec "github.com/idaaser/syncspecv1"
 )
@@ -17,14 +20,23 @@ func WithContactStore(store ContactStore) Option {
 	}
 }
 
-// WithContactFileStore 通讯录文件格式的存储
-func WithContactFileStore(dept, user, group, groupMembers string) Option {
-	return WithContactStore(&contactsFS{
-		dept:        newJSONFileStore[*spec.Department](dept),
-		user:        newJSONFileStore[*spec.User](user),
-		group:       newJSONFileStore[*spec.Group](group),
-		groupMember: newJSONFileStore[*groupMembership](groupMembers),
-	})
+// WithContactFileStore 通讯录文件格式的存储, 见NewContactFileStore.
+// 任一文件读取或解析失败时, Start返回该错误(包含文件名以及出错的行号和列号)
+func WithContactFileStore(dept, user, group, groupMembers string, opts ...FileStoreOption) Option {
+	store, err := NewContactFileStore(dept, user, group, groupMembers, opts...)
+	if err != nil {
+		return withError(err)
+	}
+	return WithContactStore(store)
+}
+
+// NewContactFileStore 创建通讯录文件格式的存储, 并加载全部文件, 也可以通过WithContactStore使用.
+// 文件可以是JSON, YAML或JSON Lines格式, 也可以用gzip压缩, 根据扩展名判断;
+// 默认每隔5秒检查一次文件的修改时间和大小, 发生变化时重新加载全部文件.
+// 任一文件读取或解析失败时返回错误, 解析失败的错误中包含文件名以及出错的行号和列号;
+// 数据未通过完整性校验时返回*ValidationError, 详见ValidateContactFiles
+func NewContactFileStore(dept, user, group, groupMembers string, opts ...FileStoreOption) (ContactStore, error) {
+	return newContactsFS(dept, user, group, groupMembers, opts...)
 }
 
 // ContactStore 部门&用户存储
@@ -48,6 +60,28 @@ type ContactStore interface {
 	ListUsersInGroup(context.Context, spec.ListGroupMembershipRequest) (*spec.PagingResult[string], error)
 }
 
+// 部门/用户/group不存在时返回的错误码
+const errNotFound = "not_found"
+
+// ErrNotFound 请求的部门/用户/group不存在
+var ErrNotFound = errors.New("not found")
+
+// UnavailableError 通讯录数据无法加载(如文件损坏、上游服务不可用)时, ContactStore应返回的错误.
+// 接口会对应返回5xx错误, 而不是返回空数据
+type UnavailableError struct {
+	// 数据来源, 如文件名
+	Source string
+	Err    error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("contact data unavailable: %s: %v", e.Source, e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
 // nopcs 不返回任何数据的ContactStore. 注: 仅用于测试
 type nopcs struct{}
 
@@ -97,23 +131,70 @@ type groupMembership struct {
 }
 
 type contactsFS struct {
-	dept        *jsonFS[*spec.Department]
-	user        *jsonFS[*spec.User]
-	group       *jsonFS[*spec.Group]
-	groupMember *jsonFS[*groupMembership]
+	source contactsSource
+
+	// 当前生效的数据快照, 重新加载时整体替换
+	current atomic.Pointer[contactsSnapshot]
+
+	// 已被替换的快照, 在有效期内仍可通过分页cursor中的版本访问
+	mu          sync.Mutex
+	retained    map[string]*retainedSnapshot
+	snapshotTTL time.Duration
+
+	// 最近几个版本的摘要, 用于增量同步
+	digests     map[string]*snapshotDigest
+	digestOrder []string
+	// 最近计算的变更, 同一次增量同步的各页不必重新对比摘要
+	changes     map[changeKey]*ChangeSet
+	changeOrder []changeKey
+
+	// 修改数据以及重新加载时持有, 保证基于最新的快照修改
+	writeMu sync.Mutex
+	// 修改后是否写回文件, 以及未写回时已修改的次数
+	writeBack bool
+	mutations int
+
+	// 检查文件变化的间隔, <=0 表示不检查
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// contactsSnapshot 某一时刻通讯录文件的完整数据, 创建后不再修改
+type contactsSnapshot struct {
+	depts        []*spec.Department
+	users        []*spec.User
+	groups       []*spec.Group
+	groupMembers []*groupMembership
+
+	// 加载时各文件的状态, 用于判断文件是否发生了变化
+	stamps []fileStamp
+	// 数据版本, 编码在返回给客户端的分页cursor中
+	version string
+
+	idx *contactsIndex
 }
 
 // interface compliance
-var _ ContactStore = (*contactsFS)(nil)
+var (
+	_ ContactStore  = (*contactsFS)(nil)
+	_ ContactGetter = (*contactsFS)(nil)
+	_ UserLister    = (*contactsFS)(nil)
+)
 
 // ListGroups implements ContactStore.
-func (c *contactsFS) ListGroups(_ context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+func (c *contactsFS) ListGroups(ctx context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	cursor, err := intCursor(req.Cursor).int()
 	if err != nil {
 		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
 	}
 
-	data, next := c.group.sublist(cursor, req.GetSize())
+	data, next := sublist(snap.groups, cursor, req.GetSize())
 	return &spec.PagingGroups{
 		HasNext: next != -1,
 		Cursor: func() string {
@@ -130,19 +211,18 @@ func (c *contactsFS) ListGroups(_ context.Context, req spec.ListGroupRequest) (*
 func (c *contactsFS) ListUsersInGroup(ctx context.Context, req spec.ListGroupMembershipRequest) (
 	*spec.PagingResult[string], error,
 ) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	groupid := req.Group
 	cursor, err := intCursor(req.Cursor).int()
 	if err != nil {
 		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
 	}
 
-	all := []string{}
-	for _, membership := range c.groupMember.load() {
-		if groupid == membership.ID {
-			all = append(all, membership.Members...)
-		}
-	}
-	data, next := sublist(all, cursor, req.GetSize())
+	data, next := sublist(snap.idx.members[groupid], cursor, req.GetSize())
 
 	return &spec.PagingResult[string]{
 		HasNext: next != -1,
@@ -157,14 +237,19 @@ func (c *contactsFS) ListUsersInGroup(ctx context.Context, req spec.ListGroupMem
 }
 
 // SearchGroup implements ContactStore.
-func (c *contactsFS) SearchGroup(_ context.Context, kw string) ([]*spec.Group, error) {
+func (c *contactsFS) SearchGroup(ctx context.Context, kw string) ([]*spec.Group, error) {
 	if kw = strings.TrimSpace(kw); kw == "" {
 		return []*spec.Group{}, nil
 	}
 
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	kw = strings.ToLower(kw)
 	data := []*spec.Group{}
-	for _, item := range c.group.load() {
+	for _, item := range snap.groups {
 		if strings.Contains(strings.ToLower(item.Name), kw) ||
 			strings.Contains(strings.ToLower(item.ID), kw) {
 			data = append(data, item)
@@ -181,12 +266,17 @@ func (c *contactsFS) SearchGroup(_ context.Context, kw string) ([]*spec.Group, e
 func (c *contactsFS) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
 	*spec.PagingDepartments, error,
 ) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	cursor, err := intCursor(req.Cursor).int()
 	if err != nil {
 		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
 	}
 
-	data, next := c.dept.sublist(cursor, req.GetSize())
+	data, next := sublist(snap.depts, cursor, req.GetSize())
 	return &spec.PagingDepartments{
 		HasNext: next != -1,
 		Cursor: func() string {
@@ -203,19 +293,18 @@ func (c *contactsFS) ListDepartments(ctx context.Context, req spec.ListDepatment
 func (c *contactsFS) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
 	*spec.PagingUsers, error,
 ) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	deptid := req.DepartmentID
 	cursor, err := intCursor(req.Cursor).int()
 	if err != nil {
 		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
 	}
 
-	all := []*spec.User{}
-	for _, user := range c.user.load() {
-		if deptid == user.MainDepartmentID || slices.Contains(user.OtherDepartmentsID, deptid) {
-			all = append(all, user)
-		}
-	}
-	data, next := sublist(all, cursor, req.GetSize())
+	data, next := sublist(snap.idx.deptUsers[deptid], cursor, req.GetSize())
 
 	return &spec.PagingUsers{
 		HasNext: next != -1,
@@ -229,14 +318,29 @@ func (c *contactsFS) ListUsersInDepartment(ctx context.Context, req spec.ListUse
 	}, nil
 }
 
+// ListAllUsers implements UserLister, 按文件中的顺序返回
+func (c *contactsFS) ListAllUsers(ctx context.Context, offset, limit int) ([]*spec.User, int, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, _ := sublist(snap.users, offset, limit)
+	return data, len(snap.users), nil
+}
+
 // SearchDepartment implements ContactStore.
 func (c *contactsFS) SearchDepartment(ctx context.Context, kw string) ([]*spec.Department, error) {
 	if kw = strings.TrimSpace(kw); kw == "" {
 		return []*spec.Department{}, nil
 	}
 
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	data := []*spec.Department{}
-	for _, item := range c.dept.load() {
+	for _, item := range snap.depts {
 		if strings.EqualFold(item.Name, kw) || strings.EqualFold(item.ID, kw) {
 			data = append(data, item)
 		}
@@ -249,11 +353,16 @@ func (c *contactsFS) SearchDepartment(ctx context.Context, kw string) ([]*spec.D
 }
 
 // SearchUser implements ContactStore.
-func (c *contactsFS) SearchUser(_ context.Context, kw string) ([]*spec.User, error) {
+func (c *contactsFS) SearchUser(ctx context.Context, kw string) ([]*spec.User, error) {
 	if kw = strings.TrimSpace(kw); kw == "" {
 		return []*spec.User{}, nil
 	}
 
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	data := []*spec.User{}
 	lower := strings.ToLower
 	eq := func(s, chars string) bool {
@@ -262,7 +371,7 @@ func (c *contactsFS) SearchUser(_ context.Context, kw string) ([]*spec.User, err
 	eqp := func(p *string, chars string) bool {
 		return strings.Contains(lower(safes(p)), lower(chars))
 	}
-	for _, item := range c.user.load() {
+	for _, item := range snap.users {
 		if eq(item.Name, kw) || eq(item.ID, kw) ||
 			eqp(item.Username, kw) || eqp(item.Email, kw) ||
 			eqp(item.Mobile, kw) || eqp(item.EmployeeNumber, kw) {
@@ -289,5 +398,12 @@ func (c intCursor) int() (int, error) {
 	if c == "" {
 		return 0, nil
 	}
-	return strconv.Atoi(string(c))
+	i, err := strconv.Atoi(string(c))
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("negative cursor %d", i)
+	}
+	return i, nil
 }
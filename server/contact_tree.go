@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+)
+
+// DepartmentTreeStore 可选接口, 支持按部门树查询的ContactStore可以实现该接口.
+// 实现后, /v1/depts支持parent和recursive参数, /v1/users支持recursive参数,
+// 并提供/v1/depts/ancestors接口, 下游应用可以只同步部门树的一个分支
+type DepartmentTreeStore interface {
+	// ListSubDepartments 分页返回指定部门的直属下级部门, Recursive为true时按先序返回全部子孙部门.
+	// Parent为空时从根部门开始; 部门不存在时返回ErrNotFound
+	ListSubDepartments(ctx context.Context, req ListSubDepartmentsRequest) (*spec.PagingDepartments, error)
+
+	// ListUsersInSubtree 分页返回指定部门及其全部子孙部门下的用户, 每个用户只返回一次
+	ListUsersInSubtree(ctx context.Context, req spec.ListUsersInDepatmentRequest) (*spec.PagingUsers, error)
+
+	// ListAncestors 返回指定部门的全部上级部门, 从根部门开始, 不包括该部门本身
+	ListAncestors(ctx context.Context, id string) ([]*spec.Department, error)
+}
+
+// ListSubDepartmentsRequest 分页获取下级部门的请求
+type ListSubDepartmentsRequest struct {
+	spec.PagingParam
+	Parent    string `query:"parent"`
+	Recursive bool   `query:"recursive"`
+}
+
+// interface compliance
+var _ DepartmentTreeStore = (*contactsFS)(nil)
+
+// ListSubDepartments implements DepartmentTreeStore.
+func (c *contactsFS) ListSubDepartments(ctx context.Context, req ListSubDepartmentsRequest) (
+	*spec.PagingDepartments, error,
+) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := snap.idx.deptByID[req.Parent]; req.Parent != "" && !found {
+		return nil, fmt.Errorf("department %q %w", req.Parent, ErrNotFound)
+	}
+
+	cursor, err := intCursor(req.Cursor).int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
+	}
+
+	depts := snap.idx.children[req.Parent]
+	if req.Recursive {
+		depts = snap.idx.descendants(req.Parent)
+	}
+
+	data, next := sublist(depts, cursor, req.GetSize())
+	return &spec.PagingDepartments{
+		HasNext: next != -1,
+		Cursor: func() string {
+			if next == -1 {
+				return ""
+			}
+			return strconv.Itoa(next)
+		}(),
+		Data: data,
+	}, nil
+}
+
+// ListUsersInSubtree implements DepartmentTreeStore.
+func (c *contactsFS) ListUsersInSubtree(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := snap.idx.deptByID[req.DepartmentID]; !found {
+		return nil, fmt.Errorf("department %q %w", req.DepartmentID, ErrNotFound)
+	}
+
+	cursor, err := intCursor(req.Cursor).int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
+	}
+
+	data, next := sublist(snap.idx.subtreeUsers(req.DepartmentID), cursor, req.GetSize())
+	return &spec.PagingUsers{
+		HasNext: next != -1,
+		Cursor: func() string {
+			if next == -1 {
+				return ""
+			}
+			return strconv.Itoa(next)
+		}(),
+		Data: data,
+	}, nil
+}
+
+// ListAncestors implements DepartmentTreeStore.
+func (c *contactsFS) ListAncestors(ctx context.Context, id string) ([]*spec.Department, error) {
+	snap, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d, found := snap.idx.deptByID[id]
+	if !found {
+		return nil, fmt.Errorf("department %q %w", id, ErrNotFound)
+	}
+
+	// 加载时已校验部门树中没有环
+	ancestors := []*spec.Department{}
+	for p := snap.idx.deptByID[d.Parent]; p != nil; p = snap.idx.deptByID[p.Parent] {
+		ancestors = append(ancestors, p)
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+	return ancestors, nil
+}
+
+func deptIDs(depts []*spec.Department) []string {
+	ids := make([]string, 0, len(depts))
+	for _, d := range depts {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+type listAncestorsResponse struct {
+	Data []*spec.Department `json:"data"`
+}
+
+func (s *Server) listAncestors(c echo.Context) error {
+	tree, ok := s.getContactStore(c).(DepartmentTreeStore)
+	if !ok {
+		return s.returnTreeNotSupported(c)
+	}
+
+	id := c.QueryParam("dept_id")
+	if id == "" {
+		return s.returnBadRequest(c, fmt.Errorf("missing dept_id"))
+	}
+
+	data, err := tree.ListAncestors(c.Request().Context(), id)
+	if err != nil {
+		return s.returnStoreError(c, err)
+	}
+	return c.JSON(200, listAncestorsResponse{Data: data})
+}
+
+func (s *Server) returnTreeNotSupported(c echo.Context) error {
+	return s.returnJSONError(c, 400, spec.ErrInvalidRequest,
+		fmt.Errorf("hierarchical department queries are not supported"))
+}
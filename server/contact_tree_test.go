@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contactsFS_tree(t *testing.T) {
+	store, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.TODO()
+
+	data, err := store.ListSubDepartments(ctx, ListSubDepartmentsRequest{Parent: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1", "1.2", "1.3"}, deptIDs(data.Data))
+
+	data, err = store.ListSubDepartments(ctx, ListSubDepartmentsRequest{Parent: "1.1", Recursive: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1", "1.1.2", "1.1.3"}, deptIDs(data.Data))
+
+	// 先序遍历, 上级部门总在下级部门之前
+	data, err = store.ListSubDepartments(ctx, ListSubDepartmentsRequest{
+		Recursive: true, PagingParam: spec.PagingParam{Size: 5},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "1.1", "1.1.1", "1.1.2", "1.1.3"}, deptIDs(data.Data))
+	assert.True(t, data.HasNext)
+
+	_, err = store.ListSubDepartments(ctx, ListSubDepartmentsRequest{Parent: "notexists"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	users, err := store.ListUsersInSubtree(ctx, spec.ListUsersInDepatmentRequest{DepartmentID: "1.1"})
+	require.NoError(t, err)
+	ids := []string{}
+	for _, u := range users.Data {
+		ids = append(ids, u.ID)
+	}
+	assert.Equal(t, []string{"uid-2", "uid-2.1", "uid-4", "uid-5", "uid-6"}, ids)
+
+	ancestors, err := store.ListAncestors(ctx, "1.1.2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "1.1"}, deptIDs(ancestors))
+
+	ancestors, err = store.ListAncestors(ctx, "1")
+	require.NoError(t, err)
+	assert.Empty(t, ancestors)
+}
+
+func Test_listDepts_tree(t *testing.T) {
+	store, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	defer store.Close()
+
+	e := New(0, WithContactStore(store)).newEcho()
+	get := func(target string) (int, map[string]any) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer any")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+	ids := func(body map[string]any) []string {
+		ids := []string{}
+		for _, item := range body["data"].([]any) {
+			ids = append(ids, item.(map[string]any)["id"].(string))
+		}
+		return ids
+	}
+
+	status, body := get("/v1/depts?parent=1.2&recursive=true&size=2")
+	require.Equal(t, 200, status)
+	assert.Equal(t, []string{"1.2.1", "1.2.2"}, ids(body))
+
+	// cursor不能用于其他parent
+	cursor := body["cursor"].(string)
+	status, _ = get("/v1/depts?parent=1.1&recursive=true&cursor=" + cursor)
+	assert.Equal(t, 400, status)
+	_, body = get("/v1/depts?parent=1.2&recursive=true&cursor=" + cursor)
+	assert.Equal(t, []string{"1.2.3"}, ids(body))
+
+	_, body = get("/v1/users?dept_id=1.2&recursive=true")
+	assert.Equal(t, []string{"uid-3", "uid-3.1", "uid-7", "uid-8", "uid-9"}, ids(body))
+
+	_, body = get("/v1/depts/ancestors?dept_id=1.3.1")
+	assert.Equal(t, []string{"1", "1.3"}, ids(body))
+
+	// 没有parent时, recursive=false与不带参数相同, 返回全部部门
+	status, body = get("/v1/depts?recursive=false")
+	require.Equal(t, 200, status)
+	assert.Len(t, ids(body), 11)
+	status, _ = get("/v1/depts?recursive=maybe")
+	assert.Equal(t, 400, status)
+
+	status, body = get("/v1/depts?parent=notexists")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, errNotFound, body["code"])
+
+	// ContactStore不支持部门树查询
+	e = New(0).newEcho()
+	status, _ = get("/v1/users?dept_id=1&recursive=true")
+	assert.Equal(t, 400, status)
+}
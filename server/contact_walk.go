@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// 遍历ContactStore时每页的大小
+const walkPageSize = 100
+
+// ContactGetter 可选接口, 支持按id获取用户和group的ContactStore可以实现该接口(通讯录文件存储已实现).
+// 实现后, SCIM的/Users/{id}和/Groups/{id}不再遍历全部数据
+type ContactGetter interface {
+	// GetUser 返回指定的用户, 不存在时返回ErrNotFound
+	GetUser(ctx context.Context, id string) (*spec.User, error)
+	// GetGroup 返回指定的group, 不存在时返回ErrNotFound
+	GetGroup(ctx context.Context, id string) (*spec.Group, error)
+}
+
+// UserLister 可选接口, 支持按固定顺序分页返回全部用户的ContactStore可以实现该接口(通讯录文件存储已实现).
+// 实现后, SCIM的/Users不再遍历全部部门
+type UserLister interface {
+	// ListAllUsers 返回从offset(从0开始)开始的最多limit个用户, 以及用户总数
+	ListAllUsers(ctx context.Context, offset, limit int) ([]*spec.User, int, error)
+}
+
+// allDepartments 分页遍历ContactStore中的全部部门
+func allDepartments(ctx context.Context, store ContactStore) ([]*spec.Department, error) {
+	depts := []*spec.Department{}
+	req := spec.ListDepatmentRequest{Size: walkPageSize}
+	for {
+		data, err := store.ListDepartments(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		depts = append(depts, data.Data...)
+		if !data.HasNext {
+			return depts, nil
+		}
+		req.Cursor = data.Cursor
+	}
+}
+
+// walkUsers 依次处理全部用户(按id去重), fn返回false时停止.
+// store实现了UserLister时直接分页, 否则遍历全部部门
+func walkUsers(ctx context.Context, store ContactStore, fn func(*spec.User) bool) error {
+	if lister, ok := store.(UserLister); ok {
+		for offset := 0; ; offset += walkPageSize {
+			users, total, err := lister.ListAllUsers(ctx, offset, walkPageSize)
+			if err != nil {
+				return err
+			}
+			for _, u := range users {
+				if !fn(u) {
+					return nil
+				}
+			}
+			if len(users) == 0 || offset+len(users) >= total {
+				return nil
+			}
+		}
+	}
+
+	depts, err := allDepartments(ctx, store)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, d := range depts {
+		req := spec.ListUsersInDepatmentRequest{
+			DepartmentID: d.ID,
+			PagingParam:  spec.PagingParam{Size: walkPageSize},
+		}
+		for {
+			data, err := store.ListUsersInDepartment(ctx, req)
+			if err != nil {
+				return err
+			}
+			for _, u := range data.Data {
+				if seen[u.ID] {
+					continue
+				}
+				seen[u.ID] = true
+				if !fn(u) {
+					return nil
+				}
+			}
+			if !data.HasNext {
+				break
+			}
+			req.Cursor = data.Cursor
+		}
+	}
+	return nil
+}
+
+// walkGroups 分页依次处理全部group, fn返回false时停止
+func walkGroups(ctx context.Context, store ContactStore, fn func(*spec.Group) bool) error {
+	req := spec.ListGroupRequest{Size: walkPageSize}
+	for {
+		data, err := store.ListGroups(ctx, req)
+		if err != nil {
+			return err
+		}
+		for _, g := range data.Data {
+			if !fn(g) {
+				return nil
+			}
+		}
+		if !data.HasNext {
+			return nil
+		}
+		req.Cursor = data.Cursor
+	}
+}
+
+// getUser store实现了ContactGetter时直接获取, 否则遍历全部用户查找; 不存在时返回ErrNotFound
+func getUser(ctx context.Context, store ContactStore, id string) (*spec.User, error) {
+	if getter, ok := store.(ContactGetter); ok {
+		return getter.GetUser(ctx, id)
+	}
+
+	var found *spec.User
+	err := walkUsers(ctx, store, func(u *spec.User) bool {
+		if u.ID == id {
+			found = u
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("user %q %w", id, ErrNotFound)
+	}
+	return found, nil
+}
+
+// getGroup store实现了ContactGetter时直接获取, 否则遍历全部group查找; 不存在时返回ErrNotFound
+func getGroup(ctx context.Context, store ContactStore, id string) (*spec.Group, error) {
+	if getter, ok := store.(ContactGetter); ok {
+		return getter.GetGroup(ctx, id)
+	}
+
+	var found *spec.Group
+	err := walkGroups(ctx, store, func(g *spec.Group) bool {
+		if g.ID == id {
+			found = g
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("group %q %w", id, ErrNotFound)
+	}
+	return found, nil
+}
+
+// allGroups 分页遍历ContactStore中的全部group
+func allGroups(ctx context.Context, store ContactStore) ([]*spec.Group, error) {
+	groups := []*spec.Group{}
+	req := spec.ListGroupRequest{Size: walkPageSize}
+	for {
+		data, err := store.ListGroups(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, data.Data...)
+		if !data.HasNext {
+			return groups, nil
+		}
+		req.Cursor = data.Cursor
+	}
+}
+
+// allGroupMembers 分页遍历group下的全部用户id
+func allGroupMembers(ctx context.Context, store ContactStore, group string) ([]string, error) {
+	members := []string{}
+	req := spec.ListGroupMembershipRequest{Group: group, PagingParam: spec.PagingParam{Size: walkPageSize}}
+	for {
+		data, err := store.ListUsersInGroup(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, data.Data...)
+		if !data.HasNext {
+			return members, nil
+		}
+		req.Cursor = data.Cursor
+	}
+}
+
+// allContacts 在同一个数据版本上遍历ContactStore中的全部数据
+func allContacts(ctx context.Context, store ContactStore) (*contactsSnapshot, error) {
+	ctx = withSnapshotVersion(ctx, storeVersion(store))
+
+	depts, err := allDepartments(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	users := []*spec.User{}
+	if err := walkUsers(ctx, store, func(u *spec.User) bool {
+		users = append(users, u)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	groups, err := allGroups(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	groupMembers := make([]*groupMembership, 0, len(groups))
+	for _, g := range groups {
+		members, err := allGroupMembers(ctx, store, g.ID)
+		if err != nil {
+			return nil, err
+		}
+		groupMembers = append(groupMembers, &groupMembership{ID: g.ID, Members: members})
+	}
+
+	return &contactsSnapshot{
+		depts:        depts,
+		users:        users,
+		groups:       groups,
+		groupMembers: groupMembers,
+	}, nil
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// CSVMapping CSV/TSV文件中的列(表头)与用户字段的对应关系, 列名不区分大小写.
+// 为空的字段使用默认的列名, 文件中不存在的列会被忽略, 但必须包含ID和Name对应的列
+type CSVMapping struct {
+	ID             string // 默认为id
+	Name           string // 默认为name
+	Username       string // 默认为username
+	Email          string // 默认为email
+	Mobile         string // 默认为mobile
+	EmployeeNumber string // 默认为employee_number
+	Position       string // 默认为position
+	// 是否在职, 可以为true/false, 1/0, yes/no, 是/否, 为空时表示在职; 默认为active
+	Active string
+
+	// 主部门的路径, 如"中国/北京/朝阳", 路径中的各级部门会自动生成, 部门id为完整路径; 默认为department
+	Department string
+	// 其他部门的路径, 多值; 默认为other_departments
+	OtherDepartments string
+	// 用户所属的group名称, 多值, group id即为名称; 默认为groups
+	Groups string
+
+	// 多值列中各个值的分隔符, 默认为";"
+	ValueSeparator string
+	// 部门路径中上下级部门的分隔符, 默认为"/"
+	PathSeparator string
+	// 列的分隔符, 默认根据扩展名判断: .tsv为tab, 其他为逗号
+	Comma rune
+}
+
+func (m CSVMapping) withDefaults(file string) CSVMapping {
+	set := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	set(&m.ID, "id")
+	set(&m.Name, "name")
+	set(&m.Username, "username")
+	set(&m.Email, "email")
+	set(&m.Mobile, "mobile")
+	set(&m.EmployeeNumber, "employee_number")
+	set(&m.Position, "position")
+	set(&m.Active, "active")
+	set(&m.Department, "department")
+	set(&m.OtherDepartments, "other_departments")
+	set(&m.Groups, "groups")
+	set(&m.ValueSeparator, ";")
+	set(&m.PathSeparator, "/")
+
+	if m.Comma == 0 {
+		m.Comma = ','
+		if strings.EqualFold(filepath.Ext(file), ".tsv") {
+			m.Comma = '\t'
+		}
+	}
+	return m
+}
+
+// WithContactCSVStore 通讯录CSV/TSV文件格式的存储, 见NewContactCSVStore. 文件读取或解析失败时, Start返回该错误
+func WithContactCSVStore(file string, mapping CSVMapping, opts ...FileStoreOption) Option {
+	store, err := NewContactCSVStore(file, mapping, opts...)
+	if err != nil {
+		return withError(err)
+	}
+	return WithContactStore(store)
+}
+
+// NewContactCSVStore 创建通讯录CSV/TSV文件格式的存储, 并加载文件, 也可以通过WithContactStore使用.
+// 文件的第一行为表头, 每一行为一个用户; 部门和group由用户所在的部门路径和group名称生成.
+// 与NewContactFileStore相同, 文件变化时自动重新加载.
+// 文件读取或解析失败时返回错误, 解析失败的错误中包含文件名以及出错的行号和列号;
+// 数据未通过完整性校验时返回*ValidationError
+func NewContactCSVStore(file string, mapping CSVMapping, opts ...FileStoreOption) (ContactStore, error) {
+	return newContactsFSFromSource(newContactsCSV(file, mapping), opts...)
+}
+
+func newContactsCSV(file string, mapping CSVMapping) *contactsCSV {
+	return &contactsCSV{file: file, mapping: mapping.withDefaults(file)}
+}
+
+// contactsCSV 每行一个用户的CSV/TSV文件
+type contactsCSV struct {
+	file    string
+	mapping CSVMapping
+}
+
+func (s *contactsCSV) stamps() []fileStamp {
+	return []fileStamp{statFile(s.file)}
+}
+
+func (s *contactsCSV) read() (*contactsSnapshot, error) {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// 跳过Excel导出的文件开头的UTF-8 BOM
+	br := bufio.NewReader(f)
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		_, _ = br.Discard(3)
+	}
+
+	r := csv.NewReader(br)
+	r.Comma = s.mapping.Comma
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, s.parseError(err, 1, 1)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{s.mapping.ID, s.mapping.Name} {
+		if _, found := columns[strings.ToLower(required)]; !found {
+			return nil, s.parseError(fmt.Errorf("missing column %q", required), 1, 1)
+		}
+	}
+
+	snap := &contactsSnapshot{
+		users:        []*spec.User{},
+		groups:       []*spec.Group{},
+		groupMembers: []*groupMembership{},
+	}
+	paths := map[string]bool{}
+	groups := map[string]*groupMembership{}
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, s.parseError(err, 0, 0)
+		}
+
+		row := csvRow{record: record, columns: columns}
+		line, _ := r.FieldPos(0)
+
+		user := &spec.User{
+			ID:             row.get(s.mapping.ID),
+			Name:           row.get(s.mapping.Name),
+			Username:       optionalString(row.get(s.mapping.Username)),
+			Email:          optionalString(row.get(s.mapping.Email)),
+			Mobile:         optionalString(row.get(s.mapping.Mobile)),
+			EmployeeNumber: optionalString(row.get(s.mapping.EmployeeNumber)),
+			Position:       optionalString(row.get(s.mapping.Position)),
+		}
+
+		active, ok := parseActive(row.get(s.mapping.Active))
+		if !ok {
+			_, column := r.FieldPos(columns[strings.ToLower(s.mapping.Active)])
+			return nil, s.parseError(fmt.Errorf("invalid %s %q", s.mapping.Active, row.get(s.mapping.Active)),
+				line, column)
+		}
+		user.Active = active
+
+		user.MainDepartmentID = s.path(row.get(s.mapping.Department))
+		if user.MainDepartmentID != "" {
+			paths[user.MainDepartmentID] = true
+		}
+		for _, v := range s.values(row.get(s.mapping.OtherDepartments)) {
+			if p := s.path(v); p != "" && p != user.MainDepartmentID {
+				user.OtherDepartmentsID = append(user.OtherDepartmentsID, p)
+				paths[p] = true
+			}
+		}
+
+		for _, name := range s.values(row.get(s.mapping.Groups)) {
+			m, found := groups[name]
+			if !found {
+				m = &groupMembership{ID: name, Members: []string{}}
+				groups[name] = m
+				snap.groups = append(snap.groups, &spec.Group{ID: name, Name: name})
+				snap.groupMembers = append(snap.groupMembers, m)
+			}
+			m.Members = append(m.Members, user.ID)
+		}
+
+		snap.users = append(snap.users, user)
+	}
+
+	snap.depts = synthesizeDepartments(paths, s.mapping.PathSeparator)
+	return snap, nil
+}
+
+// path 规范化部门路径: 去掉各级部门名称前后的空白以及空的层级
+func (s *contactsCSV) path(v string) string {
+	parts := []string{}
+	for _, part := range strings.Split(v, s.mapping.PathSeparator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, s.mapping.PathSeparator)
+}
+
+// values 拆分多值列
+func (s *contactsCSV) values(v string) []string {
+	values := []string{}
+	for _, item := range strings.Split(v, s.mapping.ValueSeparator) {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+func (s *contactsCSV) parseError(err error, line, column int) error {
+	var csvErr *csv.ParseError
+	if errors.As(err, &csvErr) {
+		return &parseError{file: s.file, line: csvErr.Line, column: csvErr.Column, err: csvErr.Err}
+	}
+	return &parseError{file: s.file, line: line, column: column, err: err}
+}
+
+type csvRow struct {
+	record  []string
+	columns map[string]int
+}
+
+// get 返回指定列的值, 列不存在时返回空
+func (r csvRow) get(column string) string {
+	i, found := r.columns[strings.ToLower(column)]
+	if !found || i >= len(r.record) {
+		return ""
+	}
+	return strings.TrimSpace(r.record[i])
+}
+
+func parseActive(v string) (bool, bool) {
+	switch strings.ToLower(v) {
+	case "", "1", "true", "yes", "y", "active", "是", "在职":
+		return true, true
+	case "0", "false", "no", "n", "inactive", "否", "离职":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	f := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(f, []byte(content), 0o600))
+	return f
+}
+
+func Test_contactsCSV_read(t *testing.T) {
+	// Excel导出的文件: 带BOM, 中文表头
+	f := writeTestFile(t, "users.csv", "\xef\xbb\xbf"+
+		"工号,姓名,邮箱,在职,部门,兼职部门,群组\n"+
+		"u1,张三,zhangsan@example.com,是,中国/北京/朝阳,中国/上海,研发;全员\n"+
+		"u2,李四,,否, 中国 / 北京 ,,全员\n"+
+		`u3,"王五, Jr.",,,,中国/北京/朝阳;中国/上海,`+"\n")
+
+	snap, err := newContactsCSV(f, CSVMapping{
+		ID:               "工号",
+		Name:             "姓名",
+		Email:            "邮箱",
+		Active:           "在职",
+		Department:       "部门",
+		OtherDepartments: "兼职部门",
+		Groups:           "群组",
+	}).read()
+	require.NoError(t, err)
+
+	assert.Equal(t, []*spec.Department{
+		{ID: "中国", Name: "中国"},
+		{ID: "中国/上海", Parent: "中国", Name: "上海"},
+		{ID: "中国/北京", Parent: "中国", Name: "北京"},
+		{ID: "中国/北京/朝阳", Parent: "中国/北京", Name: "朝阳"},
+	}, snap.depts)
+
+	require.Len(t, snap.users, 3)
+	assert.Equal(t, &spec.User{
+		ID:                 "u1",
+		Name:               "张三",
+		Email:              spec.Pointer("zhangsan@example.com"),
+		Active:             true,
+		MainDepartmentID:   "中国/北京/朝阳",
+		OtherDepartmentsID: []string{"中国/上海"},
+	}, snap.users[0])
+	assert.False(t, snap.users[1].Active)
+	assert.Equal(t, "中国/北京", snap.users[1].MainDepartmentID)
+	assert.Equal(t, "王五, Jr.", snap.users[2].Name)
+	assert.Equal(t, []string{"中国/北京/朝阳", "中国/上海"}, snap.users[2].OtherDepartmentsID)
+
+	assert.Equal(t, []*spec.Group{{ID: "研发", Name: "研发"}, {ID: "全员", Name: "全员"}}, snap.groups)
+	assert.Equal(t, []*groupMembership{
+		{ID: "研发", Members: []string{"u1"}},
+		{ID: "全员", Members: []string{"u1", "u2"}},
+	}, snap.groupMembers)
+}
+
+func Test_contactsCSV_tsv(t *testing.T) {
+	f := writeTestFile(t, "users.tsv", "id\tname\tdepartment\tgroups\n"+
+		"u1\tuser 1\ta|b\tg1,g2\n")
+
+	store, err := NewContactCSVStore(f, CSVMapping{PathSeparator: "|", ValueSeparator: ","},
+		WithReloadInterval(0))
+	require.NoError(t, err)
+
+	users, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "a|b",
+		PagingParam:  spec.PagingParam{Size: 10},
+	})
+	require.NoError(t, err)
+	require.Len(t, users.Data, 1)
+	assert.Equal(t, "user 1", users.Data[0].Name)
+
+	members, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "g2",
+		PagingParam: spec.PagingParam{Size: 10},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1"}, members.Data)
+}
+
+func Test_contactsCSV_errors(t *testing.T) {
+	t.Run("missing column", func(t *testing.T) {
+		f := writeTestFile(t, "users.csv", "id,email\nu1,a@example.com\n")
+		_, err := newContactsCSV(f, CSVMapping{}).read()
+		assert.ErrorContains(t, err, `users.csv:1:1: missing column "name"`)
+	})
+
+	t.Run("invalid active", func(t *testing.T) {
+		f := writeTestFile(t, "users.csv", "id,name,active\nu1,user 1,yes\nu2,user 2,maybe\n")
+		_, err := newContactsCSV(f, CSVMapping{}).read()
+		assert.ErrorContains(t, err, `users.csv:3:11: invalid active "maybe"`)
+	})
+
+	t.Run("bad quote", func(t *testing.T) {
+		f := writeTestFile(t, "users.csv", "id,name\nu1,\"user 1\n")
+		_, err := newContactsCSV(f, CSVMapping{}).read()
+		var parseErr *parseError
+		require.ErrorAs(t, err, &parseErr)
+		assert.Equal(t, 2, parseErr.line)
+	})
+
+	t.Run("duplicate id", func(t *testing.T) {
+		f := writeTestFile(t, "users.csv", "id,name\nu1,user 1\nu1,user 2\n")
+		_, err := NewContactCSVStore(f, CSVMapping{}, WithReloadInterval(0))
+		var validationErr *ValidationError
+		assert.ErrorAs(t, err, &validationErr)
+	})
+}
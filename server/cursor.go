@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 分页cursor非法(被篡改、用于其他列表、已过期或对应的数据版本已不存在)时返回的错误码
+const errInvalidCursor = "invalid_cursor"
+
+const defaultCursorTTL = 24 * time.Hour
+
+// WithCursorKey 设置签名分页cursor的密钥.
+// 未设置时每次启动随机生成, 即服务重启后之前返回的cursor将失效
+func WithCursorKey(key []byte) Option {
+	return func(srv *Server) {
+		srv.cursors.key = key
+	}
+}
+
+// WithCursorTTL 设置分页cursor的有效期, 默认24小时
+func WithCursorTTL(ttl time.Duration) Option {
+	return func(srv *Server) {
+		srv.cursors.ttl = ttl
+	}
+}
+
+// cursorError 客户端传入的分页cursor非法
+type cursorError struct {
+	reason string
+}
+
+func (e *cursorError) Error() string {
+	return "invalid cursor: " + e.reason
+}
+
+// VersionedStore 可选接口, 数据有版本(快照)的ContactStore可以实现该接口.
+// 版本会编码在分页cursor中, 后续的分页请求会通过SnapshotVersion(ctx)指定版本,
+// ContactStore应返回该版本的数据, 以保证分页过程中看到的数据是一致的;
+// 指定的版本已不存在时, 应返回ErrSnapshotNotFound
+type VersionedStore interface {
+	// Version 返回当前数据的版本
+	Version() string
+}
+
+// ErrSnapshotNotFound 请求指定的数据版本已不存在(过期)
+var ErrSnapshotNotFound = errors.New("snapshot not found or expired, restart from the first page")
+
+// 请求中指定数据版本的query参数, 以及返回当前数据版本的响应头.
+// 客户端在首页请求中带上之前请求返回的版本, 即可使部门、用户、group的全量同步看到同一时刻的数据
+const (
+	snapshotParam  = "snapshot"
+	snapshotHeader = "X-Snapshot-Version"
+)
+
+type snapshotKey struct{}
+
+// SnapshotVersion 返回请求指定的数据版本, 未指定时返回空字符串
+func SnapshotVersion(ctx context.Context) string {
+	v, _ := ctx.Value(snapshotKey{}).(string)
+	return v
+}
+
+func withSnapshotVersion(ctx context.Context, version string) context.Context {
+	if version == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, snapshotKey{}, version)
+}
+
+func storeVersion(store ContactStore) string {
+	if v, ok := store.(VersionedStore); ok {
+		return v.Version()
+	}
+	return ""
+}
+
+// cursorPayload 返回给客户端的cursor中包含的内容
+type cursorPayload struct {
+	// ContactStore生成的原始cursor
+	Raw string `json:"c"`
+	// 生成cursor时的数据版本
+	Version string `json:"v,omitempty"`
+	// cursor所属的列表, 包括请求路径和过滤条件
+	Scope string `json:"s"`
+	// 过期时间, unix时间戳(秒)
+	Expires int64 `json:"e"`
+}
+
+// cursorCodec 使用HMAC-SHA256签名的分页cursor编解码,
+// 格式为: base64url(payload).base64url(mac)
+type cursorCodec struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newCursorCodec() *cursorCodec {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &cursorCodec{key: key, ttl: defaultCursorTTL}
+}
+
+func (c *cursorCodec) encode(p cursorPayload) string {
+	p.Expires = time.Now().Add(c.ttl).Unix()
+	payload, _ := json.Marshal(p)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(c.mac(payload))
+}
+
+func (c *cursorCodec) decode(cursor string) (cursorPayload, error) {
+	p := cursorPayload{}
+	enc := base64.RawURLEncoding
+
+	encodedPayload, encodedMAC, found := strings.Cut(cursor, ".")
+	if !found {
+		return p, &cursorError{reason: "malformed"}
+	}
+	payload, err := enc.DecodeString(encodedPayload)
+	if err != nil {
+		return p, &cursorError{reason: "malformed"}
+	}
+	mac, err := enc.DecodeString(encodedMAC)
+	if err != nil {
+		return p, &cursorError{reason: "malformed"}
+	}
+
+	if !hmac.Equal(mac, c.mac(payload)) {
+		return p, &cursorError{reason: "signature mismatch"}
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return p, &cursorError{reason: "malformed"}
+	}
+	if time.Now().Unix() > p.Expires {
+		return p, &cursorError{reason: "expired"}
+	}
+
+	return p, nil
+}
+
+func (c *cursorCodec) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// pager 在ContactStore生成的原始cursor与返回给客户端的cursor之间转换,
+// 并把分页过程固定在同一个数据版本上
+type pager struct {
+	c     echo.Context
+	codec *cursorCodec
+
+	// cursor所属的列表, 包括请求路径和过滤条件(如部门id)
+	scope string
+	// 本次请求使用的数据版本:
+	// cursor中的版本, 或首页请求时客户端指定的版本, 或处理请求前的当前版本
+	version string
+}
+
+// newPager filter为列表的过滤条件, 编码后作为cursor的scope, 不同的过滤条件不会得到相同的scope
+func (s *Server) newPager(c echo.Context, store ContactStore, filter url.Values) *pager {
+	version := c.QueryParam(snapshotParam)
+	if version == "" {
+		version = storeVersion(store)
+	}
+
+	return &pager{
+		c:       c,
+		codec:   s.cursors,
+		scope:   c.Request().URL.Path + "?" + filter.Encode(),
+		version: version,
+	}
+}
+
+// unwrap 校验客户端传入的cursor, 返回ContactStore生成的原始cursor
+func (p *pager) unwrap(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	payload, err := p.codec.decode(cursor)
+	if err != nil {
+		return "", err
+	}
+	if payload.Scope != p.scope {
+		return "", &cursorError{reason: "issued for a different listing"}
+	}
+
+	p.version = payload.Version
+	return payload.Raw, nil
+}
+
+// context 返回调用ContactStore时使用的context, 其中包含本次请求使用的数据版本
+func (p *pager) context() context.Context {
+	return withSnapshotVersion(p.c.Request().Context(), p.version)
+}
+
+// wrap 把ContactStore生成的原始cursor编码为返回给客户端的cursor, 并在响应头中返回数据版本
+func (p *pager) wrap(raw string) string {
+	if p.version != "" {
+		p.c.Response().Header().Set(snapshotHeader, p.version)
+	}
+	if raw == "" {
+		return ""
+	}
+
+	return p.codec.encode(cursorPayload{
+		Raw:     raw,
+		Version: p.version,
+		Scope:   p.scope,
+	})
+}
+
+func isCursorError(err error) bool {
+	var cerr *cursorError
+	return errors.As(err, &cerr) || errors.Is(err, ErrSnapshotNotFound)
+}
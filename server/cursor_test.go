@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pager(t *testing.T) {
+	codec := newCursorCodec()
+	p := newTestPager(codec, "/v1/users?dept=1", "v1")
+
+	cursor := p.wrap("10")
+	assert.NotEqual(t, "10", cursor)
+	assert.Empty(t, p.wrap(""))
+
+	raw, err := p.unwrap(cursor)
+	require.NoError(t, err)
+	assert.Equal(t, "10", raw)
+
+	raw, err = p.unwrap("")
+	require.NoError(t, err)
+	assert.Empty(t, raw)
+
+	// 客户端伪造的cursor
+	_, err = p.unwrap("10")
+	assert.True(t, isCursorError(err))
+
+	// 篡改payload
+	payload, mac, _ := strings.Cut(cursor, ".")
+	_, err = p.unwrap(strings.ToUpper(payload[:4]) + payload[4:] + "." + mac)
+	assert.True(t, isCursorError(err))
+
+	// 其他服务(密钥不同)签发的cursor
+	foreign := newTestPager(newCursorCodec(), p.scope, p.version)
+	_, err = p.unwrap(foreign.wrap("10"))
+	assert.EqualError(t, err, "invalid cursor: signature mismatch")
+
+	// 用于其他列表
+	other := newTestPager(codec, "/v1/users?dept=2", p.version)
+	_, err = other.unwrap(cursor)
+	assert.EqualError(t, err, "invalid cursor: issued for a different listing")
+
+	// 数据版本已变化, 使用cursor中的版本
+	changed := newTestPager(codec, p.scope, "v2")
+	_, err = changed.unwrap(cursor)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", changed.version)
+
+	// 已过期
+	expired := newTestPager(&cursorCodec{key: codec.key, ttl: -time.Minute}, p.scope, p.version)
+	_, err = p.unwrap(expired.wrap("10"))
+	assert.EqualError(t, err, "invalid cursor: expired")
+}
+
+func Test_newPager_scope(t *testing.T) {
+	s := New(0)
+	scope := func(filter url.Values) string {
+		c := echo.New().NewContext(httptest.NewRequest("GET", "/v1/users", nil), httptest.NewRecorder())
+		return s.newPager(c, &nopcs{}, filter).scope
+	}
+
+	// id中包含&或=时, 不会与其他过滤条件的scope相同
+	assert.NotEqual(t,
+		scope(url.Values{"dept": {"1&recursive=true"}}),
+		scope(url.Values{"dept": {"1"}, "recursive": {"true"}}),
+	)
+	assert.Equal(t, "/v1/users?", scope(nil))
+}
+
+func newTestPager(codec *cursorCodec, scope, version string) *pager {
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	return &pager{c: c, codec: codec, scope: scope, version: version}
+}
@@ -1,40 +1,435 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
-	"sync"
+	"path/filepath"
+	"strings"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"gopkg.in/yaml.v3"
 )
 
-func newJSONFileStore[T any](f string) *jsonFS[T] {
-	return &jsonFS[T]{
-		file: f,
-		once: &sync.Once{},
+// contactsSource 通讯录数据的来源, 如4个JSON文件, 或者一个CSV文件
+type contactsSource interface {
+	// read 读取全部数据, 返回的快照中只包含数据
+	read() (*contactsSnapshot, error)
+	// stamps 返回各数据文件当前的状态, 用于判断文件是否发生了变化
+	stamps() []fileStamp
+}
+
+// contactFiles 部门/用户/group/group成员分别保存在4个JSON文件中
+type contactFiles struct {
+	dept        *jsonFS[*spec.Department]
+	user        *jsonFS[*spec.User]
+	group       *jsonFS[*spec.Group]
+	groupMember *jsonFS[*groupMembership]
+}
+
+func newContactFiles(dept, user, group, groupMembers string) *contactFiles {
+	return &contactFiles{
+		dept:        newJSONFileStore[*spec.Department](dept),
+		user:        newJSONFileStore[*spec.User](user),
+		group:       newJSONFileStore[*spec.Group](group),
+		groupMember: newJSONFileStore[*groupMembership](groupMembers),
+	}
+}
+
+func (f *contactFiles) read() (*contactsSnapshot, error) {
+	depts, err := f.dept.read()
+	if err != nil {
+		return nil, err
+	}
+	users, err := f.user.read()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := f.group.read()
+	if err != nil {
+		return nil, err
+	}
+	groupMembers, err := f.groupMember.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return &contactsSnapshot{
+		depts:        depts,
+		users:        users,
+		groups:       groups,
+		groupMembers: groupMembers,
+	}, nil
+}
+
+func (f *contactFiles) stamps() []fileStamp {
+	return []fileStamp{
+		f.dept.stamp(), f.user.stamp(), f.group.stamp(), f.groupMember.stamp(),
 	}
 }
 
+// write 按各文件的格式写回全部文件: 先写入全部临时文件, 都成功后再依次重命名, 写入失败时不修改任何文件
+func (f *contactFiles) write(snap *contactsSnapshot) error {
+	writes := []struct {
+		file  string
+		write func(w io.Writer) error
+	}{
+		{f.dept.file, func(w io.Writer) error { return encodeFile(f.dept.file, w, snap.depts) }},
+		{f.user.file, func(w io.Writer) error { return encodeFile(f.user.file, w, snap.users) }},
+		{f.group.file, func(w io.Writer) error { return encodeFile(f.group.file, w, snap.groups) }},
+		{f.groupMember.file, func(w io.Writer) error { return encodeFile(f.groupMember.file, w, snap.groupMembers) }},
+	}
+
+	tmps := make([]string, 0, len(writes))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, w := range writes {
+		tmp, err := stageFile(w.file, w.write)
+		if err != nil {
+			return err
+		}
+		tmps = append(tmps, tmp)
+	}
+
+	for i, w := range writes {
+		if err := os.Rename(tmps[i], w.file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newJSONFileStore[T any](f string) *jsonFS[T] {
+	return &jsonFS[T]{file: f}
+}
+
 type jsonFS[T any] struct {
 	file string
+}
 
-	once *sync.Once
-	data []T
+// read 读取并解析文件, 解析失败时返回的错误中包含出错的行号和列号, 支持的格式见decodeFile
+func (s *jsonFS[T]) read() ([]T, error) {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeFile[T](s.file, f)
+}
+
+// decodeFile 解析文件内容, name为文件名, 用于判断文件格式以及错误信息.
+// 根据扩展名判断文件格式:
+//   - .json: 数组
+//   - .yaml/.yml: 数组
+//   - .ndjson/.jsonl: 每行一个JSON对象, 逐行解析, 适合很大的文件
+//
+// 以上格式均可以再用gzip压缩, 如users.ndjson.gz
+func decodeFile[T any](name string, r io.Reader) ([]T, error) {
+	r, format, err := decompress(name, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == ".ndjson" || format == ".jsonl" {
+		return decodeJSONLines[T](name, r)
+	}
+
+	data := []T{}
+	if err := decodeDocument(name, format, r, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encodeFile 按扩展名把数据写为文件内容, 支持的格式同decodeFile
+func encodeFile[T any](name string, w io.Writer, data []T) error {
+	if strings.EqualFold(filepath.Ext(name), ".gz") {
+		gz := gzip.NewWriter(w)
+		if err := encodeFile(strings.TrimSuffix(name, filepath.Ext(name)), gz, data); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+
+	format := strings.ToLower(filepath.Ext(name))
+	if format != ".ndjson" && format != ".jsonl" {
+		return encodeDocument(w, format, data)
+	}
+	enc := json.NewEncoder(w)
+	for _, item := range data {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic 先写入同目录下的临时文件再重命名, 不会出现写了一半的文件; 保留原文件的权限
+func writeFileAtomic(file string, write func(w io.Writer) error) error {
+	tmp, err := stageFile(file, write)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, file)
 }
 
-func (s *jsonFS[T]) load() []T {
-	s.once.Do(func() {
-		if content, err := os.ReadFile(s.file); err == nil {
-			data := []T{}
-			if err := json.Unmarshal(content, &data); err == nil {
-				s.data = data
+// stageFile 写入file同目录下的临时文件并返回其路径, 由调用者重命名或删除; 失败时不保留临时文件
+func stageFile(file string, write func(w io.Writer) error) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return "", err
+	}
+
+	if fi, err := os.Stat(file); err == nil {
+		_ = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// decompress 文件名以.gz结尾时解压, 并返回去掉.gz后的扩展名(小写)
+func decompress(name string, r io.Reader) (io.Reader, string, error) {
+	if !strings.EqualFold(filepath.Ext(name), ".gz") {
+		return r, strings.ToLower(filepath.Ext(name)), nil
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, "", &parseError{file: name, err: err}
+	}
+	return gz, strings.ToLower(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name)))), nil
+}
+
+// decodeDocument 按扩展名把整个文件解析为一个JSON或YAML文档.
+// YAML先解析为节点, 再转换为JSON解析, 因此字段名与JSON文件相同; 类型错误时返回对应节点的行号和列号
+func decodeDocument(name, format string, r io.Reader, v any) error {
+	if format != ".yaml" && format != ".yml" {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, v); err != nil {
+			return newParseError(name, content, err)
+		}
+		return nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return &parseError{file: name, err: err}
+	}
+	if doc.Kind == 0 {
+		return nil
+	}
+	j := &yamlJSON{}
+	if err := j.write(&doc); err != nil {
+		return &parseError{file: name, line: j.last().Line, column: j.last().Column, err: err}
+	}
+	if err := json.Unmarshal(j.buf.Bytes(), v); err != nil {
+		perr := &parseError{file: name, err: err}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			if n := j.node(typeErr.Offset); n != nil {
+				perr.line, perr.column = n.Line, n.Column
+			}
+		}
+		return perr
+	}
+	return nil
+}
+
+// yamlJSON 把YAML节点转换为JSON, 并记录每个节点在JSON中的起始位置, 用于把JSON的错误位置对应到YAML节点
+type yamlJSON struct {
+	buf   bytes.Buffer
+	nodes []yamlNodeOffset
+}
+
+type yamlNodeOffset struct {
+	offset int64
+	node   *yaml.Node
+}
+
+func (j *yamlJSON) write(n *yaml.Node) error {
+	j.nodes = append(j.nodes, yamlNodeOffset{offset: int64(j.buf.Len()), node: n})
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			j.buf.WriteString("null")
+			return nil
+		}
+		return j.write(n.Content[0])
+	case yaml.AliasNode:
+		return j.write(n.Alias)
+	case yaml.SequenceNode:
+		j.buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				j.buf.WriteByte(',')
+			}
+			if err := j.write(item); err != nil {
+				return err
+			}
+		}
+		j.buf.WriteByte(']')
+		return nil
+	case yaml.MappingNode:
+		j.buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				j.buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			j.buf.Write(key)
+			j.buf.WriteByte(':')
+			if err := j.write(n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		j.buf.WriteByte('}')
+		return nil
+	default:
+		var scalar any
+		if err := n.Decode(&scalar); err != nil {
+			return err
+		}
+		content, err := json.Marshal(scalar)
+		if err != nil {
+			return err
+		}
+		j.buf.Write(content)
+		return nil
+	}
+}
+
+// node 返回读取offset个字节后出错时所在的节点, 即最后一个在offset之前开始的节点
+func (j *yamlJSON) node(offset int64) *yaml.Node {
+	var found *yaml.Node
+	for _, n := range j.nodes {
+		if n.offset >= offset {
+			break
+		}
+		found = n.node
+	}
+	return found
+}
+
+func (j *yamlJSON) last() *yaml.Node {
+	return j.nodes[len(j.nodes)-1].node
+}
+
+// decodeJSONLines 逐行解析, 除结果外只需要保存当前行的内容; 忽略空行
+func decodeJSONLines[T any](name string, r io.Reader) ([]T, error) {
+	br := bufio.NewReader(r)
+	data := []T{}
+	for line := 1; ; line++ {
+		content, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(content)) > 0 {
+			var item T
+			if err := json.Unmarshal(content, &item); err != nil {
+				perr := newParseError(name, content, err)
+				perr.line = line
+				perr.column = max(perr.column, 1)
+				return nil, perr
 			}
+			data = append(data, item)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
 		}
-	})
+	}
+}
+
+// stamp 返回文件当前的修改时间和大小, 用于判断文件是否发生了变化
+func (s *jsonFS[T]) stamp() fileStamp {
+	return statFile(s.file)
+}
+
+// statFile 返回文件当前的修改时间和大小, 文件不存在时返回空值
+func statFile(f string) fileStamp {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
 
-	return s.data
+type fileStamp struct {
+	modTime time.Time
+	size    int64
 }
 
-func (s *jsonFS[T]) sublist(start, size int) ([]T, int) {
-	return sublist(s.load(), start, size)
+func (a fileStamp) equal(b fileStamp) bool {
+	return a.modTime.Equal(b.modTime) && a.size == b.size
+}
+
+// parseError 文件内容解析失败的错误
+type parseError struct {
+	file string
+	// 出错的位置, 从1开始; 无法确定位置时为0
+	line, column int
+	err          error
+}
+
+func (e *parseError) Error() string {
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %v", e.file, e.err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.file, e.line, e.column, e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+func newParseError(file string, content []byte, err error) *parseError {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return &parseError{file: file, err: err}
+	}
+
+	line, column := position(content, offset)
+	return &parseError{file: file, line: line, column: column, err: err}
+}
+
+// position 计算读取offset个字节后出错时, 最后读取的字节所在的行号和列号(按字节计算), 均从1开始
+func position(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return line, max(column, 1)
 }
 
 func sublist[T any](s []T, start, size int) ([]T, int) {
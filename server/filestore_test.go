@@ -1,24 +1,155 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
 	"testing"
 
 	spec "github.com/idaaser/syncspecv1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_jsonfile_store(t *testing.T) {
 	{
 		store := newJSONFileStore[*spec.Department]("./testdata/departments.json")
-		data := store.load()
+		data, err := store.read()
+		assert.NoError(t, err)
 		assert.NotEmpty(t, data)
 		assert.Equal(t, "1", data[0].ID)
 	}
 
 	{
 		store := newJSONFileStore[*spec.User]("./testdata/users.json")
-		data := store.load()
+		data, err := store.read()
+		assert.NoError(t, err)
 		assert.NotEmpty(t, data)
 		assert.Equal(t, "uid-1", data[0].ID)
 	}
 }
+
+func Test_jsonfile_store_error(t *testing.T) {
+	dir := t.TempDir()
+
+	// 文件不存在
+	{
+		store := newJSONFileStore[*spec.User](filepath.Join(dir, "notexists.json"))
+		_, err := store.read()
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	// 语法错误, 第3行第5列缺少逗号
+	{
+		f := filepath.Join(dir, "syntax.json")
+		require.NoError(t, os.WriteFile(f, []byte("[\n  {\"id\": \"1\"}\n    {\"id\": \"2\"}\n]"), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+		assert.EqualError(t, err,
+			f+":3:5: invalid character '{' after array element")
+	}
+
+	// 类型错误
+	{
+		f := filepath.Join(dir, "type.json")
+		require.NoError(t, os.WriteFile(f, []byte("[\n  {\"id\": 1}\n]"), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+
+		var perr *parseError
+		require.ErrorAs(t, err, &perr)
+		assert.Equal(t, 2, perr.line)
+	}
+
+	// YAML的类型错误, 第3行第7列的id不是字符串
+	{
+		f := filepath.Join(dir, "type.yaml")
+		require.NoError(t, os.WriteFile(f, []byte("- id: uid-1\n  name: user 1\n- id: 2\n  name: user 2\n"), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+
+		var perr *parseError
+		require.ErrorAs(t, err, &perr)
+		assert.Equal(t, 3, perr.line)
+		assert.Equal(t, 7, perr.column)
+		assert.ErrorContains(t, err, f+":3:7: ")
+	}
+}
+
+func Test_jsonfile_store_formats(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		f := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(f, content, 0o600))
+		return f
+	}
+	gzipped := func(content string) []byte {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write([]byte(content))
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	yamlContent := `
+- id: uid-1
+  name: user 1
+  main_department: "1"
+  other_departments: ["2", "3"]
+- id: uid-2
+  name: user 2
+`
+	jsonLines := "{\"id\": \"uid-1\", \"name\": \"user 1\", \"main_department\": \"1\"}\n\n{\"id\": \"uid-2\", \"name\": \"user 2\"}"
+
+	for _, f := range []string{
+		write("users.yaml", []byte(yamlContent)),
+		write("users.yml.gz", gzipped(yamlContent)),
+		write("users.ndjson", []byte(jsonLines)),
+		write("users.jsonl.gz", gzipped(jsonLines)),
+		write("users.json.gz", gzipped(`[{"id": "uid-1", "name": "user 1", "main_department": "1"}, {"id": "uid-2"}]`)),
+	} {
+		data, err := newJSONFileStore[*spec.User](f).read()
+		require.NoError(t, err, f)
+		require.Len(t, data, 2, f)
+		assert.Equal(t, "uid-1", data[0].ID, f)
+		assert.Equal(t, "1", data[0].MainDepartmentID, f)
+		assert.Equal(t, "uid-2", data[1].ID, f)
+	}
+
+	data, err := newJSONFileStore[*spec.User](write("users.yaml", []byte(yamlContent))).read()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, data[0].OtherDepartmentsID)
+
+	// 空的YAML文件
+	data, err = newJSONFileStore[*spec.User](write("empty.yaml", nil)).read()
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func Test_jsonfile_store_formats_error(t *testing.T) {
+	dir := t.TempDir()
+
+	// JSON Lines的错误位置为出错的行
+	{
+		f := filepath.Join(dir, "users.ndjson")
+		require.NoError(t, os.WriteFile(f, []byte("{\"id\": \"1\"}\n{\"id\": \"2\"}\n{\"id\": 3}\n"), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+
+		var perr *parseError
+		require.ErrorAs(t, err, &perr)
+		assert.Equal(t, 3, perr.line)
+	}
+
+	{
+		f := filepath.Join(dir, "users.yaml")
+		require.NoError(t, os.WriteFile(f, []byte("- id: 1\n  name: [\n"), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+		assert.ErrorContains(t, err, f+": yaml:")
+	}
+
+	// 不是gzip格式
+	{
+		f := filepath.Join(dir, "users.json.gz")
+		require.NoError(t, os.WriteFile(f, []byte(`[{"id": "uid-1"}]`), 0o600))
+		_, err := newJSONFileStore[*spec.User](f).read()
+		assert.ErrorIs(t, err, gzip.ErrHeader)
+	}
+}
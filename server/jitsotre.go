@@ -35,8 +35,16 @@ type (
 // interface compliance
 var _ ContactStore = (*jitStore)(nil)
 
+// Version 实现VersionedStore接口, 不同参数生成的数据不同
+func (s *jitStore) Version() string {
+	return fmt.Sprintf("jit:%s:%d:%d", s.prefix, s.dept, s.user)
+}
+
 func (s *jitStore) ListDepartments(_ context.Context, req spec.ListDepatmentRequest) (*spec.PagingDepartments, error) {
-	paging := asindexBasedPaging(req)
+	paging, err := asindexBasedPaging(req)
+	if err != nil {
+		return nil, err
+	}
 	start, end := paging.start(), paging.end()
 	if start >= s.dept {
 		return &spec.PagingDepartments{HasNext: false}, nil
@@ -72,7 +80,10 @@ func (s *jitStore) SearchUser(context.Context, string) ([]*spec.User, error) {
 
 // 分页返回指定部门下的直属用户列表, 不包括子孙部门下的用户
 func (s *jitStore) ListUsersInDepartment(_ context.Context, req spec.ListUsersInDepatmentRequest) (*spec.PagingUsers, error) {
-	paging := asindexBasedPaging(req.PagingParam)
+	paging, err := asindexBasedPaging(req.PagingParam)
+	if err != nil {
+		return nil, err
+	}
 	start, end := paging.start(), paging.end()
 	if start >= s.user {
 		return &spec.PagingUsers{HasNext: false}, nil
@@ -160,17 +171,14 @@ func (p indexBasedPaging) end() int {
 	return p.start() + p.size - 1
 }
 
-func asindexBasedPaging(p spec.PagingParam) indexBasedPaging {
-	idx := 0
-	if p.Cursor != "" {
-		idx, _ = strconv.Atoi(p.Cursor)
-	}
-	if idx < 0 {
-		idx = 0
+func asindexBasedPaging(p spec.PagingParam) (indexBasedPaging, error) {
+	idx, err := intCursor(p.Cursor).int()
+	if err != nil {
+		return indexBasedPaging{}, fmt.Errorf("invalid cursor %q", p.Cursor)
 	}
 
 	return indexBasedPaging{
 		idx:  idx,
 		size: p.GetSize(),
-	}
+	}, nil
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPClientConfig 连接LDAP/AD服务的配置
+type LDAPClientConfig struct {
+	// 服务地址, 如ldap://ldap.example.com:389, ldaps://ldap.example.com:636
+	URL string
+	// 绑定的账号和密码, 为空时匿名访问
+	BindDN       string
+	BindPassword string
+	// 使用ldap://时通过StartTLS加密连接
+	StartTLS bool
+	// 自定义的TLS配置, 如信任自签名的CA
+	TLSConfig *tls.Config
+	// 单次请求的超时时间, 默认30秒
+	Timeout time.Duration
+}
+
+// NewLDAPSearcher 基于github.com/go-ldap/ldap实现的LDAPSearcher, 使用simple paged results control(RFC 2696)分页.
+// 创建时连接并绑定, 连接或绑定失败时返回错误.
+// 全部请求共用一个连接, 以保证分页的cookie在后续请求中有效; 连接断开后, 下一次请求时重新连接,
+// 此时之前返回的cookie失效, 需从首页重新获取
+func NewLDAPSearcher(cfg LDAPClientConfig) (LDAPSearcher, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ldap url %q", cfg.URL)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	c := &ldapClient{cfg: cfg}
+	if _, err := c.conn(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type ldapClient struct {
+	cfg LDAPClientConfig
+
+	mu     sync.Mutex
+	active *ldap.Conn
+}
+
+// SearchPage 实现了LDAPSearcher接口, BaseDN不存在时返回空的结果; 请求的超时时间由Timeout控制
+func (c *ldapClient) SearchPage(ctx context.Context, req LDAPSearchRequest, size int, cookie []byte) (
+	[]*LDAPEntry, []byte, error,
+) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	conn, err := c.conn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	search := ldap.NewSearchRequest(req.BaseDN, int(req.Scope), ldap.NeverDerefAliases, 0, 0, false,
+		req.Filter, req.Attributes, nil)
+	if size > 0 {
+		paging := ldap.NewControlPaging(uint32(size))
+		paging.SetCookie(cookie)
+		search.Controls = append(search.Controls, paging)
+	}
+
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return []*LDAPEntry{}, nil, nil
+	}
+	if err != nil {
+		c.release(conn)
+		return nil, nil, err
+	}
+
+	entries := make([]*LDAPEntry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entry := &LDAPEntry{DN: e.DN, Attributes: make(map[string][]string, len(e.Attributes))}
+		for _, attr := range e.Attributes {
+			entry.Attributes[attr.Name] = attr.Values
+		}
+		entries = append(entries, entry)
+	}
+
+	var next []byte
+	if paging, ok := ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok {
+		next = paging.Cookie
+	}
+	return entries, next, nil
+}
+
+// Close 关闭连接
+func (c *ldapClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active == nil {
+		return nil
+	}
+	err := c.active.Close()
+	c.active = nil
+	return err
+}
+
+// conn 返回当前的连接, 连接已断开时重新连接并绑定
+func (c *ldapClient) conn() (*ldap.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active != nil && !c.active.IsClosing() {
+		return c.active, nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, &UnavailableError{Source: "ldap " + c.cfg.URL, Err: err}
+	}
+	c.active = conn
+	return conn, nil
+}
+
+func (c *ldapClient) dial() (*ldap.Conn, error) {
+	opts := []ldap.DialOpt{}
+	if c.cfg.TLSConfig != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(c.cfg.TLSConfig))
+	}
+	conn, err := ldap.DialURL(c.cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.cfg.Timeout)
+
+	if c.cfg.StartTLS && strings.HasPrefix(c.cfg.URL, "ldap://") {
+		tlsConfig := c.cfg.TLSConfig
+		if tlsConfig == nil {
+			u, _ := url.Parse(c.cfg.URL)
+			tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if c.cfg.BindDN != "" {
+		if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// release 连接出错且已断开时丢弃, 下一次请求时重新连接
+func (c *ldapClient) release(conn *ldap.Conn) {
+	if !conn.IsClosing() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active == conn {
+		c.active = nil
+	}
+}
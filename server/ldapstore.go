@@ -0,0 +1,503 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// LDAPScope LDAP搜索的范围, 取值与RFC 4511一致
+type LDAPScope int
+
+const (
+	// LDAPScopeBase 只搜索BaseDN本身
+	LDAPScopeBase LDAPScope = 0
+	// LDAPScopeOneLevel 只搜索BaseDN的直接下级
+	LDAPScopeOneLevel LDAPScope = 1
+	// LDAPScopeSubtree 搜索BaseDN及其全部下级
+	LDAPScopeSubtree LDAPScope = 2
+)
+
+// LDAPSearchRequest LDAP搜索请求
+type LDAPSearchRequest struct {
+	BaseDN     string
+	Scope      LDAPScope
+	Filter     string
+	Attributes []string
+}
+
+// LDAPEntry LDAP搜索返回的条目
+type LDAPEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// first 返回属性的第一个值, 属性名不区分大小写
+func (e *LDAPEntry) first(attr string) string {
+	if values := e.values(attr); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (e *LDAPEntry) values(attr string) []string {
+	if strings.EqualFold(attr, "dn") {
+		return []string{e.DN}
+	}
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+// LDAPSearcher 执行LDAP搜索, 内置基于github.com/go-ldap/ldap的实现, 见NewLDAPSearcher.
+// 分页应使用simple paged results control(RFC 2696);
+// 由于cookie通常只在同一个连接内有效, 实现时需保证同一cookie的后续请求使用同一个连接
+type LDAPSearcher interface {
+	// SearchPage 搜索一页数据, cookie为上一页返回的cookie(首页为nil);
+	// size<=0表示不分页, 返回的cookie为空表示没有下一页
+	SearchPage(ctx context.Context, req LDAPSearchRequest, size int, cookie []byte) ([]*LDAPEntry, []byte, error)
+}
+
+// LDAPConfig LDAP目录与通讯录数据的映射关系.
+// 部门为BaseDN下(不含BaseDN本身)的组织单元, 部门id为其DN, 上级部门为DN中的上一级;
+// 用户的主部门为其DN中的上一级; 属性名为"dn"时取条目的DN
+type LDAPConfig struct {
+	BaseDN string
+
+	// 部门, 默认(objectClass=organizationalUnit), 名称属性默认ou
+	DepartmentFilter string
+	DepartmentName   string
+
+	// 用户, 默认(objectClass=inetOrgPerson)
+	UserFilter string
+	User       LDAPUserAttributes
+
+	// group, 默认(objectClass=groupOfNames), id和名称属性默认cn, 成员属性默认member(值为用户的DN)
+	GroupFilter string
+	GroupID     string
+	GroupName   string
+	GroupMember string
+}
+
+// LDAPUserAttributes 用户字段对应的LDAP属性, 为空的字段使用默认值
+type LDAPUserAttributes struct {
+	ID             string // 默认uid
+	Name           string // 默认cn
+	Username       string // 默认uid
+	Email          string // 默认mail
+	Mobile         string // 默认mobile
+	EmployeeNumber string // 默认employeeNumber
+	Position       string // 默认title
+}
+
+func (c *LDAPConfig) withDefaults() {
+	def := func(v *string, d string) {
+		if *v == "" {
+			*v = d
+		}
+	}
+	def(&c.DepartmentFilter, "(objectClass=organizationalUnit)")
+	def(&c.DepartmentName, "ou")
+	def(&c.UserFilter, "(objectClass=inetOrgPerson)")
+	def(&c.User.ID, "uid")
+	def(&c.User.Name, "cn")
+	def(&c.User.Username, "uid")
+	def(&c.User.Email, "mail")
+	def(&c.User.Mobile, "mobile")
+	def(&c.User.EmployeeNumber, "employeeNumber")
+	def(&c.User.Position, "title")
+	def(&c.GroupFilter, "(objectClass=groupOfNames)")
+	def(&c.GroupID, "cn")
+	def(&c.GroupName, "cn")
+	def(&c.GroupMember, "member")
+}
+
+// WithContactLDAPStore 使用LDAP/AD目录作为通讯录的存储
+func WithContactLDAPStore(searcher LDAPSearcher, cfg LDAPConfig) Option {
+	return WithContactStore(newContactsLDAP(searcher, cfg))
+}
+
+func newContactsLDAP(searcher LDAPSearcher, cfg LDAPConfig) *contactsLDAP {
+	cfg.withDefaults()
+	return &contactsLDAP{searcher: searcher, cfg: cfg}
+}
+
+type contactsLDAP struct {
+	searcher LDAPSearcher
+	cfg      LDAPConfig
+}
+
+// interface compliance
+var (
+	_ ContactStore = (*contactsLDAP)(nil)
+	_ io.Closer    = (*contactsLDAP)(nil)
+)
+
+// Close 实现了io.Closer接口, LDAPSearcher实现了io.Closer时关闭其连接
+func (s *contactsLDAP) Close() error {
+	if closer, ok := s.searcher.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ListDepartments implements ContactStore.
+func (s *contactsLDAP) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
+	*spec.PagingDepartments, error,
+) {
+	entries, next, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN: s.cfg.BaseDN,
+		Scope:  LDAPScopeSubtree,
+		Filter: s.cfg.DepartmentFilter,
+	}, req.GetSize(), req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.Department{}
+	for _, e := range entries {
+		if d := s.department(e); d != nil {
+			data = append(data, d)
+		}
+	}
+	return &spec.PagingDepartments{HasNext: next != "", Cursor: next, Data: data}, nil
+}
+
+// SearchDepartment implements ContactStore.
+func (s *contactsLDAP) SearchDepartment(ctx context.Context, kw string) ([]*spec.Department, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Department{}, nil
+	}
+
+	entries, _, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN: s.cfg.BaseDN,
+		Scope:  LDAPScopeSubtree,
+		Filter: "(&" + s.cfg.DepartmentFilter + substringFilter(kw, s.cfg.DepartmentName) + ")",
+	}, searchLimit, "")
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.Department{}
+	for _, e := range entries {
+		if d := s.department(e); d != nil {
+			data = append(data, d)
+		}
+	}
+	return data, nil
+}
+
+// ListUsersInDepartment implements ContactStore.
+// 部门id为部门的DN, 只返回该DN的直接下级用户; DN不在BaseDN之下时返回ErrNotFound
+func (s *contactsLDAP) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	if !s.underBase(req.DepartmentID) {
+		return nil, fmt.Errorf("department %q %w", req.DepartmentID, ErrNotFound)
+	}
+
+	entries, next, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN: req.DepartmentID,
+		Scope:  LDAPScopeOneLevel,
+		Filter: s.cfg.UserFilter,
+	}, req.GetSize(), req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.User{}
+	for _, e := range entries {
+		data = append(data, s.user(e))
+	}
+	return &spec.PagingUsers{HasNext: next != "", Cursor: next, Data: data}, nil
+}
+
+// SearchUser implements ContactStore.
+func (s *contactsLDAP) SearchUser(ctx context.Context, kw string) ([]*spec.User, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.User{}, nil
+	}
+
+	attrs := s.cfg.User
+	entries, _, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN: s.cfg.BaseDN,
+		Scope:  LDAPScopeSubtree,
+		Filter: "(&" + s.cfg.UserFilter + substringFilter(kw,
+			attrs.ID, attrs.Name, attrs.Username, attrs.Email, attrs.Mobile, attrs.EmployeeNumber) + ")",
+	}, searchLimit, "")
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.User{}
+	for _, e := range entries {
+		data = append(data, s.user(e))
+	}
+	return data, nil
+}
+
+// ListGroups implements ContactStore.
+func (s *contactsLDAP) ListGroups(ctx context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+	entries, next, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN:     s.cfg.BaseDN,
+		Scope:      LDAPScopeSubtree,
+		Filter:     s.cfg.GroupFilter,
+		Attributes: []string{s.cfg.GroupID, s.cfg.GroupName},
+	}, req.GetSize(), req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.Group{}
+	for _, e := range entries {
+		data = append(data, s.group(e))
+	}
+	return &spec.PagingGroups{HasNext: next != "", Cursor: next, Data: data}, nil
+}
+
+// SearchGroup implements ContactStore.
+func (s *contactsLDAP) SearchGroup(ctx context.Context, kw string) ([]*spec.Group, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Group{}, nil
+	}
+
+	entries, _, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN:     s.cfg.BaseDN,
+		Scope:      LDAPScopeSubtree,
+		Filter:     "(&" + s.cfg.GroupFilter + substringFilter(kw, s.cfg.GroupID, s.cfg.GroupName) + ")",
+		Attributes: []string{s.cfg.GroupID, s.cfg.GroupName},
+	}, searchLimit, "")
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*spec.Group{}
+	for _, e := range entries {
+		data = append(data, s.group(e))
+	}
+	return data, nil
+}
+
+// ListUsersInGroup implements ContactStore.
+// 成员保存在group条目的一个属性中, 按成员在属性中的位置分页
+func (s *contactsLDAP) ListUsersInGroup(ctx context.Context, req spec.ListGroupMembershipRequest) (
+	*spec.PagingResult[string], error,
+) {
+	cursor, err := intCursor(req.Cursor).int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
+	}
+
+	search := LDAPSearchRequest{
+		BaseDN:     s.cfg.BaseDN,
+		Scope:      LDAPScopeSubtree,
+		Filter:     "(&" + s.cfg.GroupFilter + equalityFilter(s.cfg.GroupID, req.Group) + ")",
+		Attributes: []string{s.cfg.GroupMember},
+	}
+	if strings.EqualFold(s.cfg.GroupID, "dn") {
+		if !s.underBase(req.Group) {
+			return nil, fmt.Errorf("group %q %w", req.Group, ErrNotFound)
+		}
+		search.BaseDN, search.Scope, search.Filter = req.Group, LDAPScopeBase, s.cfg.GroupFilter
+	}
+	entries, _, err := s.searchPage(ctx, search, 1, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return &spec.PagingResult[string]{Data: []string{}}, nil
+	}
+
+	members, next := sublist(entries[0].values(s.cfg.GroupMember), cursor, req.GetSize())
+	data, err := s.userIDs(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return &spec.PagingResult[string]{
+		HasNext: next != -1,
+		Cursor: func() string {
+			if next == -1 {
+				return ""
+			}
+			return strconv.Itoa(next)
+		}(),
+		Data: data,
+	}, nil
+}
+
+// searchPage 搜索一页数据, cursor为base64编码的paged results cookie
+func (s *contactsLDAP) searchPage(ctx context.Context, req LDAPSearchRequest, size int, cursor string) (
+	[]*LDAPEntry, string, error,
+) {
+	cookie, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	entries, next, err := s.searcher.SearchPage(ctx, req, size, cookie)
+	if err != nil {
+		return nil, "", &UnavailableError{Source: "ldap", Err: err}
+	}
+	return entries, base64.RawURLEncoding.EncodeToString(next), nil
+}
+
+// userIDs 根据成员的DN批量获取用户id, 以各DN的RDN组成一个过滤条件, 只搜索一次.
+// 按members的顺序返回, 不存在的用户以及BaseDN之外的DN被忽略
+func (s *contactsLDAP) userIDs(ctx context.Context, members []string) ([]string, error) {
+	if strings.EqualFold(s.cfg.User.ID, "dn") {
+		return members, nil
+	}
+
+	dns := make([]*ldap.DN, 0, len(members))
+	rdns := strings.Builder{}
+	for _, member := range members {
+		dn, err := ldap.ParseDN(member)
+		if err != nil || !s.underBase(member) {
+			continue
+		}
+		dns = append(dns, dn)
+
+		rdns.WriteString("(&")
+		for _, attr := range dn.RDNs[0].Attributes {
+			rdns.WriteString(equalityFilter(attr.Type, attr.Value))
+		}
+		rdns.WriteString(")")
+	}
+	if len(dns) == 0 {
+		return []string{}, nil
+	}
+
+	entries, _, err := s.searchPage(ctx, LDAPSearchRequest{
+		BaseDN:     s.cfg.BaseDN,
+		Scope:      LDAPScopeSubtree,
+		Filter:     "(&" + s.cfg.UserFilter + "(|" + rdns.String() + "))",
+		Attributes: []string{s.cfg.User.ID},
+	}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// RDN相同的其他条目也可能被搜索到, 按完整的DN对应
+	ids := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if dn, err := ldap.ParseDN(e.DN); err == nil {
+			ids[normalizeDN(dn)] = e.first(s.cfg.User.ID)
+		}
+	}
+	data := []string{}
+	for _, dn := range dns {
+		if id := ids[normalizeDN(dn)]; id != "" {
+			data = append(data, id)
+		}
+	}
+	return data, nil
+}
+
+// normalizeDN 返回可用于比较的DN, 属性名和值不区分大小写
+func normalizeDN(dn *ldap.DN) string {
+	return strings.ToLower(dn.String())
+}
+
+// underBase dn是否为合法的DN, 且位于BaseDN之下(不含BaseDN本身), 避免请求者搜索目录中的其他子树
+func (s *contactsLDAP) underBase(dn string) bool {
+	base, err := ldap.ParseDN(s.cfg.BaseDN)
+	if err != nil {
+		return false
+	}
+	parsed, err := ldap.ParseDN(dn)
+	return err == nil && base.AncestorOfFold(parsed)
+}
+
+// department 把组织单元转换为部门, BaseDN本身不作为部门
+func (s *contactsLDAP) department(e *LDAPEntry) *spec.Department {
+	if strings.EqualFold(e.DN, s.cfg.BaseDN) {
+		return nil
+	}
+
+	parent := parentDN(e.DN)
+	if strings.EqualFold(parent, s.cfg.BaseDN) {
+		parent = ""
+	}
+	return &spec.Department{
+		ID:     e.DN,
+		Parent: parent,
+		Name:   e.first(s.cfg.DepartmentName),
+	}
+}
+
+func (s *contactsLDAP) user(e *LDAPEntry) *spec.User {
+	attrs := s.cfg.User
+	optional := func(attr string) *string {
+		if v := e.first(attr); v != "" {
+			return spec.Pointer(v)
+		}
+		return nil
+	}
+
+	return &spec.User{
+		ID:               e.first(attrs.ID),
+		Name:             e.first(attrs.Name),
+		Username:         optional(attrs.Username),
+		Email:            optional(attrs.Email),
+		Mobile:           optional(attrs.Mobile),
+		EmployeeNumber:   optional(attrs.EmployeeNumber),
+		Position:         optional(attrs.Position),
+		Active:           true,
+		MainDepartmentID: parentDN(e.DN),
+	}
+}
+
+func (s *contactsLDAP) group(e *LDAPEntry) *spec.Group {
+	return &spec.Group{
+		ID:   e.first(s.cfg.GroupID),
+		Name: e.first(s.cfg.GroupName),
+	}
+}
+
+// parentDN 返回DN的上一级, 如"uid=a,ou=b,dc=c"返回"ou=b,dc=c", 支持转义的逗号
+func parentDN(dn string) string {
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			return strings.TrimSpace(dn[i+1:])
+		}
+	}
+	return ""
+}
+
+// substringFilter 生成任一属性包含关键字的过滤条件
+func substringFilter(kw string, attrs ...string) string {
+	b := strings.Builder{}
+	b.WriteString("(|")
+	for _, attr := range attrs {
+		if strings.EqualFold(attr, "dn") {
+			continue
+		}
+		b.WriteString("(" + attr + "=*" + escapeFilter(kw) + "*)")
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func equalityFilter(attr, value string) string {
+	return "(" + attr + "=" + escapeFilter(value) + ")"
+}
+
+// escapeFilter 按RFC 4515转义过滤条件中的特殊字符
+func escapeFilter(s string) string {
+	return strings.NewReplacer(
+		`\`, `\5c`, `*`, `\2a`, `(`, `\28`, `)`, `\29`, "\x00", `\00`,
+	).Replace(s)
+}
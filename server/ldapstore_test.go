@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testLDAPBindDN   = "cn=admin,dc=example,dc=com"
+	testLDAPPassword = "secret"
+)
+
+// testDirectory 进程内LDAP服务的数据, 支持测试用到的过滤条件: &, |, 等值, 子串以及存在性判断
+type testDirectory struct {
+	entries []*LDAPEntry
+	// 收到的搜索请求数
+	searches atomic.Int32
+}
+
+// serve 在随机端口上启动LDAP服务, 返回其地址
+func (d *testDirectory) serve(t *testing.T) string {
+	mux, err := gldap.NewMux()
+	require.NoError(t, err)
+	require.NoError(t, mux.Bind(d.bind))
+	require.NoError(t, mux.Search(d.search))
+	srv, err := gldap.NewServer()
+	require.NoError(t, err)
+	require.NoError(t, srv.Router(mux))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	go func() { _ = srv.Run(addr) }()
+	t.Cleanup(func() { _ = srv.Stop() })
+	require.Eventually(t, srv.Ready, 5*time.Second, 10*time.Millisecond)
+	return "ldap://" + addr
+}
+
+func (d *testDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	m, err := r.GetSimpleBindMessage()
+	if err == nil && m.UserName == testLDAPBindDN && string(m.Password) == testLDAPPassword {
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+	_ = w.Write(resp)
+}
+
+// search 按simple paged results control分页, cookie为下一页的位置
+func (d *testDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	d.searches.Add(1)
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		_ = w.Write(r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultOperationsError)))
+		return
+	}
+
+	if !slices.ContainsFunc(d.entries, func(e *LDAPEntry) bool { return strings.EqualFold(e.DN, m.BaseDN) }) {
+		_ = w.Write(r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultNoSuchObject)))
+		return
+	}
+
+	var paging *gldap.ControlPaging
+	for _, c := range m.Controls {
+		if p, ok := c.(*gldap.ControlPaging); ok {
+			paging = p
+		}
+	}
+	size, cookie := 0, []byte(nil)
+	if paging != nil {
+		size, cookie = int(paging.PagingSize), paging.Cookie
+	}
+
+	entries, next, err := d.SearchPage(context.TODO(), LDAPSearchRequest{
+		BaseDN: m.BaseDN, Scope: LDAPScope(m.Scope), Filter: m.Filter,
+	}, size, cookie)
+	if err != nil {
+		_ = w.Write(r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultProtocolError)))
+		return
+	}
+	for _, e := range entries {
+		attrs := map[string][]string{}
+		for name, values := range e.Attributes {
+			if len(m.Attributes) == 0 || slices.ContainsFunc(m.Attributes, func(a string) bool {
+				return strings.EqualFold(a, name)
+			}) {
+				attrs[name] = values
+			}
+		}
+		_ = w.Write(r.NewSearchResponseEntry(e.DN, gldap.WithAttributes(attrs)))
+	}
+
+	done := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	if paging != nil {
+		done.SetControls(&gldap.ControlPaging{Cookie: next})
+	}
+	_ = w.Write(done)
+}
+
+func (d *testDirectory) SearchPage(_ context.Context, req LDAPSearchRequest, size int, cookie []byte) (
+	[]*LDAPEntry, []byte, error,
+) {
+	filter, rest, err := parseFilter(req.Filter)
+	if err != nil || rest != "" {
+		return nil, nil, fmt.Errorf("bad filter %q", req.Filter)
+	}
+
+	matched := []*LDAPEntry{}
+	for _, e := range d.entries {
+		if inScope(e.DN, req.BaseDN, req.Scope) && filter(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	start := 0
+	if len(cookie) > 0 {
+		start, _ = strconv.Atoi(string(cookie))
+	}
+	if size <= 0 {
+		size = len(matched)
+	}
+	page, next := sublist(matched, start, size)
+	if next == -1 {
+		return page, nil, nil
+	}
+	return page, []byte(strconv.Itoa(next)), nil
+}
+
+func inScope(dn, base string, scope LDAPScope) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case LDAPScopeBase:
+		return dn == base
+	case LDAPScopeOneLevel:
+		return parentDN(dn) == base
+	default:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+type ldapFilter func(*LDAPEntry) bool
+
+func parseFilter(s string) (ldapFilter, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("expect (")
+	}
+	s = s[1:]
+
+	switch s[0] {
+	case '&', '|':
+		op := s[0]
+		s = s[1:]
+		subs := []ldapFilter{}
+		for strings.HasPrefix(s, "(") {
+			sub, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, s, err
+			}
+			subs, s = append(subs, sub), rest
+		}
+		return func(e *LDAPEntry) bool {
+			for _, sub := range subs {
+				if sub(e) == (op == '|') {
+					return op == '|'
+				}
+			}
+			return op == '&'
+		}, strings.TrimPrefix(s, ")"), nil
+	}
+
+	end := strings.Index(s, ")")
+	attr, value, _ := strings.Cut(s[:end], "=")
+	parts := strings.Split(value, "*")
+	for i := range parts {
+		parts[i] = strings.ToLower(unescapeFilter(parts[i]))
+	}
+	return func(e *LDAPEntry) bool {
+		for _, v := range e.values(attr) {
+			if matchParts(strings.ToLower(v), parts) {
+				return true
+			}
+		}
+		return false
+	}, s[end+1:], nil
+}
+
+func matchParts(v string, parts []string) bool {
+	if len(parts) == 1 {
+		return v == parts[0]
+	}
+	if !strings.HasPrefix(v, parts[0]) {
+		return false
+	}
+	v = v[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(v, part)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(part):]
+	}
+	return strings.HasSuffix(v, parts[len(parts)-1])
+}
+
+func unescapeFilter(s string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+2 < len(s) {
+			decoded, _ := hex.DecodeString(s[i+1 : i+3])
+			b.Write(decoded)
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func newTestLDAPStore(t *testing.T) (*contactsLDAP, *testDirectory) {
+	entry := func(dn string, attrs ...string) *LDAPEntry {
+		e := &LDAPEntry{DN: dn, Attributes: map[string][]string{}}
+		for i := 0; i < len(attrs); i += 2 {
+			e.Attributes[attrs[i]] = append(e.Attributes[attrs[i]], attrs[i+1])
+		}
+		return e
+	}
+
+	dir := &testDirectory{entries: []*LDAPEntry{
+		entry("dc=example,dc=com", "objectClass", "domain"),
+		entry("ou=china,dc=example,dc=com", "objectClass", "organizationalUnit", "ou", "中国"),
+		entry("ou=beijing,ou=china,dc=example,dc=com", "objectClass", "organizationalUnit", "ou", "北京"),
+		entry("ou=shanghai,ou=china,dc=example,dc=com", "objectClass", "organizationalUnit", "ou", "上海"),
+
+		entry("uid=user1,ou=china,dc=example,dc=com", "objectClass", "inetOrgPerson",
+			"uid", "user1", "cn", "User 1", "mail", "user1@example.com"),
+		entry("uid=user2,ou=beijing,ou=china,dc=example,dc=com", "objectClass", "inetOrgPerson",
+			"uid", "user2", "cn", "User 2", "mail", "user2@example.com", "title", "engineer"),
+		entry("uid=user3,ou=beijing,ou=china,dc=example,dc=com", "objectClass", "inetOrgPerson",
+			"uid", "user3", "cn", "User (3)"),
+		// 与user1的RDN相同, 但不是developer的成员
+		entry("uid=user1,ou=shanghai,ou=china,dc=example,dc=com", "objectClass", "inetOrgPerson",
+			"uid", "user1-sh", "cn", "User 1 (SH)"),
+
+		entry("cn=developer,dc=example,dc=com", "objectClass", "groupOfNames", "cn", "developer",
+			"member", "uid=user1,ou=china,dc=example,dc=com",
+			"member", "uid=user2,ou=beijing,ou=china,dc=example,dc=com",
+			"member", "uid=user3,ou=beijing,ou=china,dc=example,dc=com",
+			"member", "uid=deleted,ou=china,dc=example,dc=com"),
+		entry("cn=qa,dc=example,dc=com", "objectClass", "groupOfNames", "cn", "qa"),
+	}}
+
+	searcher, err := NewLDAPSearcher(LDAPClientConfig{
+		URL: dir.serve(t), BindDN: testLDAPBindDN, BindPassword: testLDAPPassword,
+	})
+	require.NoError(t, err)
+	store := newContactsLDAP(searcher, LDAPConfig{BaseDN: "dc=example,dc=com"})
+	t.Cleanup(func() { store.Close() })
+	return store, dir
+}
+
+func Test_contactsLDAP_ListDepartments(t *testing.T) {
+	store, _ := newTestLDAPStore(t)
+
+	first, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 2})
+	require.NoError(t, err)
+	assert.True(t, first.HasNext)
+	require.Len(t, first.Data, 2)
+	assert.Equal(t, &spec.Department{ID: "ou=china,dc=example,dc=com", Name: "中国"}, first.Data[0])
+	assert.Equal(t, "ou=china,dc=example,dc=com", first.Data[1].Parent)
+
+	second, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 2, Cursor: first.Cursor})
+	require.NoError(t, err)
+	assert.False(t, second.HasNext)
+	assert.Equal(t, "", second.Cursor)
+	require.Len(t, second.Data, 1)
+	assert.Equal(t, "上海", second.Data[0].Name)
+}
+
+func Test_contactsLDAP_users(t *testing.T) {
+	store, _ := newTestLDAPStore(t)
+
+	users, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "ou=beijing,ou=china,dc=example,dc=com",
+		PagingParam:  spec.PagingParam{Size: 10},
+	})
+	require.NoError(t, err)
+	require.Len(t, users.Data, 2)
+	assert.Equal(t, "user2", users.Data[0].ID)
+	assert.Equal(t, "engineer", *users.Data[0].Position)
+	assert.Equal(t, "ou=beijing,ou=china,dc=example,dc=com", users.Data[0].MainDepartmentID)
+	assert.Nil(t, users.Data[1].Email)
+
+	// 部门id须为BaseDN之下的DN
+	for _, dept := range []string{"dc=example,dc=com", "dc=other,dc=com", "ou=x,dc=other,dc=com", "not a dn", ""} {
+		_, err = store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{DepartmentID: dept})
+		assert.ErrorIs(t, err, ErrNotFound, dept)
+	}
+
+	found, err := store.SearchUser(context.TODO(), "USER1@")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "user1", found[0].ID)
+
+	// 关键字中的特殊字符被转义
+	found, err = store.SearchUser(context.TODO(), "(3)")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "user3", found[0].ID)
+}
+
+func Test_contactsLDAP_groups(t *testing.T) {
+	store, dir := newTestLDAPStore(t)
+
+	groups, err := store.ListGroups(context.TODO(), spec.PagingParam{Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, []*spec.Group{{ID: "developer", Name: "developer"}, {ID: "qa", Name: "qa"}}, groups.Data)
+
+	first, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "developer",
+		PagingParam: spec.PagingParam{Size: 2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, first.Data)
+	assert.True(t, first.HasNext)
+
+	// 每页只搜索group以及一次批量查询成员
+	searches := dir.searches.Load()
+
+	second, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "developer",
+		PagingParam: spec.PagingParam{Size: 2, Cursor: first.Cursor},
+	})
+	require.NoError(t, err)
+	// 不存在的成员被忽略
+	assert.Equal(t, []string{"user3"}, second.Data)
+	assert.False(t, second.HasNext)
+	assert.EqualValues(t, 2, dir.searches.Load()-searches)
+
+	found, err := store.SearchGroup(context.TODO(), "dev")
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+	// group id为DN时, 须位于BaseDN之下
+	byDN := newContactsLDAP(store.searcher, LDAPConfig{BaseDN: "dc=example,dc=com", GroupID: "dn"})
+	members, err := byDN.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group: "cn=developer,dc=example,dc=com",
+	})
+	require.NoError(t, err)
+	assert.Len(t, members.Data, 3)
+	_, err = byDN.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{Group: "cn=admins,dc=other,dc=com"})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_parentDN(t *testing.T) {
+	assert.Equal(t, "ou=b,dc=c", parentDN("uid=a,ou=b,dc=c"))
+	assert.Equal(t, "dc=c", parentDN(`ou=a\,b,dc=c`))
+	assert.Equal(t, "", parentDN("dc=c"))
+}
+
+func Test_NewLDAPSearcher(t *testing.T) {
+	store, _ := newTestLDAPStore(t)
+
+	// 连接关闭后重新连接
+	require.NoError(t, store.Close())
+	users, err := store.SearchUser(context.TODO(), "user2")
+	require.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	// BaseDN不存在时返回空的结果
+	entries, cookie, err := store.searcher.SearchPage(context.TODO(), LDAPSearchRequest{
+		BaseDN: "ou=missing,dc=example,dc=com", Scope: LDAPScopeSubtree, Filter: "(objectClass=*)",
+	}, 10, nil)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Empty(t, cookie)
+
+	dir := &testDirectory{}
+	_, err = NewLDAPSearcher(LDAPClientConfig{URL: dir.serve(t), BindDN: testLDAPBindDN, BindPassword: "wrong"})
+	assert.Error(t, err)
+	_, err = NewLDAPSearcher(LDAPClientConfig{URL: "http://ldap.example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+)
+
+// SCIM服务的路径前缀
+const scimPrefix = "/scim/v2"
+
+// SCIM 2.0中用到的schema
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema         = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSPConfigSchema     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema       = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	scimContentType        = "application/scim+json"
+	scimDefaultCount       = 100
+	scimMaxResults         = 1000
+)
+
+// WithSCIMProvider 在/scim/v2下以SCIM 2.0协议(只读)提供与/v1相同的通讯录数据, 使用相同的access_token鉴权.
+// ContactStore实现了UserLister和ContactGetter(如通讯录文件存储)时直接分页和按id获取,
+// 否则/Users需要遍历全部部门, 适合数据量不大的场景; 带filter的请求需遍历全部用户或group, 只保留当前页
+func WithSCIMProvider() Option {
+	return func(srv *Server) {
+		srv.scim = true
+	}
+}
+
+// mountSCIM 注册SCIM的路由
+func (s *Server) mountSCIM(g *echo.Group) {
+	g.GET("/Users", s.listSCIMUsers, s.requireSCIMScope(ScopeUsersRead))
+	g.GET("/Users/:id", s.getSCIMUser, s.requireSCIMScope(ScopeUsersRead))
+	g.GET("/Groups", s.listSCIMGroups, s.requireSCIMScope(ScopeGroupsRead))
+	g.GET("/Groups/:id", s.getSCIMGroup, s.requireSCIMScope(ScopeGroupsRead))
+
+	g.GET("/ServiceProviderConfig", s.scimServiceProviderConfig)
+	g.GET("/ResourceTypes", s.scimResourceTypes)
+	g.GET("/ResourceTypes/:id", s.scimResourceTypes)
+	g.GET("/Schemas", s.scimSchemas)
+	g.GET("/Schemas/:id", s.scimSchemas)
+}
+
+type (
+	scimListResult struct {
+		Schemas      []string `json:"schemas"`
+		TotalResults int      `json:"totalResults"`
+		StartIndex   int      `json:"startIndex"`
+		ItemsPerPage int      `json:"itemsPerPage"`
+		Resources    []any    `json:"Resources"`
+	}
+
+	scimErrorResponse struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}
+
+	scimMeta struct {
+		ResourceType string `json:"resourceType"`
+		Location     string `json:"location"`
+	}
+
+	scimUserResource struct {
+		Schemas      []string         `json:"schemas"`
+		ID           string           `json:"id"`
+		UserName     string           `json:"userName"`
+		DisplayName  string           `json:"displayName,omitempty"`
+		Name         *scimName        `json:"name,omitempty"`
+		Title        string           `json:"title,omitempty"`
+		Active       bool             `json:"active"`
+		Emails       []scimMultiValue `json:"emails,omitempty"`
+		PhoneNumbers []scimMultiValue `json:"phoneNumbers,omitempty"`
+		Enterprise   *scimEnterprise  `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+		Meta         scimMeta         `json:"meta"`
+	}
+
+	scimName struct {
+		Formatted string `json:"formatted"`
+	}
+
+	scimEnterprise struct {
+		EmployeeNumber string `json:"employeeNumber,omitempty"`
+		Department     string `json:"department,omitempty"`
+	}
+
+	scimGroupResource struct {
+		Schemas     []string     `json:"schemas"`
+		ID          string       `json:"id"`
+		DisplayName string       `json:"displayName"`
+		Members     []scimMember `json:"members"`
+		Meta        scimMeta     `json:"meta"`
+	}
+
+	scimMember struct {
+		Value string `json:"value"`
+		Ref   string `json:"$ref"`
+		Type  string `json:"type"`
+	}
+)
+
+func (s *Server) listSCIMUsers(c echo.Context) error {
+	filter, err := s.scimFilter(c, "id", "userName", "displayName", "emails", "emails.value")
+	if err != nil {
+		return s.returnSCIMError(c, 400, "invalidFilter", err)
+	}
+
+	store := s.getContactStore(c)
+	ctx := s.scimContext(c, store)
+	page := newSCIMWindow[*spec.User](c)
+
+	if lister, ok := store.(UserLister); ok && filter == nil {
+		page.items, page.total, err = lister.ListAllUsers(ctx, page.start-1, page.count)
+	} else {
+		err = walkUsers(ctx, store, func(u *spec.User) bool {
+			if filter == nil || filter(scimUserAttributes(u)) {
+				page.add(u)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return s.returnSCIMStoreError(c, err)
+	}
+
+	resources := make([]any, 0, len(page.items))
+	for _, u := range page.items {
+		resources = append(resources, s.scimUser(c, u))
+	}
+	return s.returnSCIM(c, 200, scimList(page.total, page.start, resources))
+}
+
+func (s *Server) getSCIMUser(c echo.Context) error {
+	store := s.getContactStore(c)
+	u, err := getUser(s.scimContext(c, store), store, c.Param("id"))
+	if errors.Is(err, ErrNotFound) {
+		return s.returnSCIMError(c, 404, "", errors.New("user not found"))
+	}
+	if err != nil {
+		return s.returnSCIMStoreError(c, err)
+	}
+	return s.returnSCIM(c, 200, s.scimUser(c, u))
+}
+
+func (s *Server) listSCIMGroups(c echo.Context) error {
+	filter, err := s.scimFilter(c, "id", "displayName")
+	if err != nil {
+		return s.returnSCIMError(c, 400, "invalidFilter", err)
+	}
+
+	store := s.getContactStore(c)
+	page := newSCIMWindow[*spec.Group](c)
+	err = walkGroups(s.scimContext(c, store), store, func(g *spec.Group) bool {
+		if filter == nil || filter(scimGroupAttributes(g)) {
+			page.add(g)
+		}
+		return true
+	})
+	if err != nil {
+		return s.returnSCIMStoreError(c, err)
+	}
+
+	resources := make([]any, 0, len(page.items))
+	for _, g := range page.items {
+		group, err := s.scimGroup(c, g)
+		if err != nil {
+			return s.returnSCIMStoreError(c, err)
+		}
+		resources = append(resources, group)
+	}
+	return s.returnSCIM(c, 200, scimList(page.total, page.start, resources))
+}
+
+func (s *Server) getSCIMGroup(c echo.Context) error {
+	store := s.getContactStore(c)
+	g, err := getGroup(s.scimContext(c, store), store, c.Param("id"))
+	if errors.Is(err, ErrNotFound) {
+		return s.returnSCIMError(c, 404, "", errors.New("group not found"))
+	}
+	if err != nil {
+		return s.returnSCIMStoreError(c, err)
+	}
+
+	group, err := s.scimGroup(c, g)
+	if err != nil {
+		return s.returnSCIMStoreError(c, err)
+	}
+	return s.returnSCIM(c, 200, group)
+}
+
+func (s *Server) scimFilter(c echo.Context, attrs ...string) (scimFilter, error) {
+	filter := c.QueryParam("filter")
+	if filter == "" {
+		return nil, nil
+	}
+	return parseSCIMFilter(filter, attrs...)
+}
+
+// scimContext 返回固定在当前数据版本上的context, 保证遍历过程中数据一致
+func (s *Server) scimContext(c echo.Context, store ContactStore) context.Context {
+	return withSnapshotVersion(c.Request().Context(), storeVersion(store))
+}
+
+func (s *Server) scimUser(c echo.Context, u *spec.User) *scimUserResource {
+	r := &scimUserResource{
+		Schemas:     []string{scimUserSchema},
+		ID:          u.ID,
+		UserName:    u.ID,
+		DisplayName: u.Name,
+		Active:      u.Active,
+		Meta: scimMeta{
+			ResourceType: "User",
+			Location:     s.absoluteURL(c, scimPrefix, "Users", u.ID),
+		},
+	}
+	if u.Name != "" {
+		r.Name = &scimName{Formatted: u.Name}
+	}
+	if u.Username != nil && *u.Username != "" {
+		r.UserName = *u.Username
+	}
+	if u.Position != nil {
+		r.Title = *u.Position
+	}
+	if u.Email != nil && *u.Email != "" {
+		r.Emails = []scimMultiValue{{Value: *u.Email, Type: "work", Primary: true}}
+	}
+	if u.Mobile != nil && *u.Mobile != "" {
+		r.PhoneNumbers = []scimMultiValue{{Value: *u.Mobile, Type: "mobile", Primary: true}}
+	}
+
+	enterprise := &scimEnterprise{Department: u.MainDepartmentID}
+	if u.EmployeeNumber != nil {
+		enterprise.EmployeeNumber = *u.EmployeeNumber
+	}
+	if *enterprise != (scimEnterprise{}) {
+		r.Schemas = append(r.Schemas, scimEnterpriseUser)
+		r.Enterprise = enterprise
+	}
+	return r
+}
+
+func (s *Server) scimGroup(c echo.Context, g *spec.Group) (*scimGroupResource, error) {
+	store := s.getContactStore(c)
+	ctx := s.scimContext(c, store)
+
+	r := &scimGroupResource{
+		Schemas:     []string{scimGroupSchema},
+		ID:          g.ID,
+		DisplayName: g.Name,
+		Members:     []scimMember{},
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Location:     s.absoluteURL(c, scimPrefix, "Groups", g.ID),
+		},
+	}
+
+	members, err := allGroupMembers(ctx, store, g.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		r.Members = append(r.Members, scimMember{
+			Value: member,
+			Ref:   s.absoluteURL(c, scimPrefix, "Users", member),
+			Type:  "User",
+		})
+	}
+	return r, nil
+}
+
+// scimUserAttributes 用户可用于过滤的属性, key为小写的属性名
+func scimUserAttributes(u *spec.User) map[string][]string {
+	userName := u.ID
+	if u.Username != nil && *u.Username != "" {
+		userName = *u.Username
+	}
+	emails := []string{}
+	if u.Email != nil {
+		emails = append(emails, *u.Email)
+	}
+
+	return map[string][]string{
+		"id":           {u.ID},
+		"username":     {userName},
+		"displayname":  {u.Name},
+		"emails":       emails,
+		"emails.value": emails,
+	}
+}
+
+func scimGroupAttributes(g *spec.Group) map[string][]string {
+	return map[string][]string{
+		"id":          {g.ID},
+		"displayname": {g.Name},
+	}
+}
+
+// scimWindow 按startIndex(从1开始)和count分页, 依次加入符合条件的数据时只保留当前页, 并统计总数
+type scimWindow[T any] struct {
+	start, count int
+	total        int
+	items        []T
+}
+
+func newSCIMWindow[T any](c echo.Context) *scimWindow[T] {
+	start, err := strconv.Atoi(c.QueryParam("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(c.QueryParam("count"))
+	if err != nil {
+		count = scimDefaultCount
+	}
+	return &scimWindow[T]{start: start, count: max(0, min(count, scimMaxResults)), items: []T{}}
+}
+
+func (w *scimWindow[T]) add(item T) {
+	w.total++
+	if w.total >= w.start && len(w.items) < w.count {
+		w.items = append(w.items, item)
+	}
+}
+
+func scimList(total, start int, resources []any) *scimListResult {
+	return &scimListResult{
+		Schemas:      []string{scimListSchema},
+		TotalResults: total,
+		StartIndex:   start,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+func (s *Server) returnSCIM(c echo.Context, status int, v any) error {
+	c.Response().Header().Set(echo.HeaderContentType, scimContentType)
+	return c.JSON(status, v)
+}
+
+func (s *Server) returnSCIMError(c echo.Context, status int, scimType string, err error) error {
+	return s.returnSCIM(c, status, scimErrorResponse{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   err.Error(),
+	})
+}
+
+// requireSCIMScope 与requireScope相同, 以SCIM的格式返回错误
+func (s *Server) requireSCIMScope(scopes ...string) echo.MiddlewareFunc {
+	return s.checkScope(func(c echo.Context, err error) error {
+		return s.returnSCIMError(c, http.StatusForbidden, "", err)
+	}, scopes...)
+}
+
+// returnSCIMStoreError 与returnStoreError相同, 数据无法加载时返回503, 其他错误返回400
+func (s *Server) returnSCIMStoreError(c echo.Context, err error) error {
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return s.returnSCIMError(c, http.StatusServiceUnavailable, "", err)
+	}
+	return s.returnSCIMError(c, http.StatusBadRequest, "", err)
+}
+
+func (s *Server) scimServiceProviderConfig(c echo.Context) error {
+	supported := func(v bool) map[string]bool { return map[string]bool{"supported": v} }
+	return s.returnSCIM(c, 200, map[string]any{
+		"schemas":        []string{scimSPConfigSchema},
+		"patch":          supported(false),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "access_token issued by " + s.absoluteURL(c, "/v1/token"),
+			"primary":     true,
+		}},
+		"meta": map[string]string{
+			"resourceType": "ServiceProviderConfig",
+			"location":     s.absoluteURL(c, scimPrefix, "ServiceProviderConfig"),
+		},
+	})
+}
+
+func (s *Server) scimResourceTypes(c echo.Context) error {
+	types := []map[string]any{
+		{
+			"schemas":  []string{scimResourceTypeSchema},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   scimUserSchema,
+			"schemaExtensions": []map[string]any{
+				{"schema": scimEnterpriseUser, "required": false},
+			},
+			"meta": map[string]string{
+				"resourceType": "ResourceType",
+				"location":     s.absoluteURL(c, scimPrefix, "ResourceTypes", "User"),
+			},
+		},
+		{
+			"schemas":  []string{scimResourceTypeSchema},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   scimGroupSchema,
+			"meta": map[string]string{
+				"resourceType": "ResourceType",
+				"location":     s.absoluteURL(c, scimPrefix, "ResourceTypes", "Group"),
+			},
+		},
+	}
+	return s.returnSCIMDefinitions(c, types)
+}
+
+func (s *Server) scimSchemas(c echo.Context) error {
+	attr := func(name string, multi bool, sub ...map[string]any) map[string]any {
+		a := map[string]any{
+			"name":        name,
+			"type":        "string",
+			"multiValued": multi,
+			"required":    false,
+			"caseExact":   false,
+			"mutability":  "readOnly",
+			"returned":    "default",
+			"uniqueness":  "none",
+		}
+		if len(sub) > 0 {
+			a["type"] = "complex"
+			a["subAttributes"] = sub
+		}
+		return a
+	}
+	schema := func(id, name string, attrs ...map[string]any) map[string]any {
+		return map[string]any{
+			"schemas":    []string{scimSchemaSchema},
+			"id":         id,
+			"name":       name,
+			"attributes": attrs,
+			"meta": map[string]string{
+				"resourceType": "Schema",
+				"location":     s.absoluteURL(c, scimPrefix, "Schemas", id),
+			},
+		}
+	}
+
+	active := attr("active", false)
+	active["type"] = "boolean"
+	schemas := []map[string]any{
+		schema(scimUserSchema, "User",
+			attr("userName", false),
+			attr("displayName", false),
+			attr("name", false, attr("formatted", false)),
+			attr("title", false),
+			active,
+			attr("emails", true, attr("value", false), attr("type", false)),
+			attr("phoneNumbers", true, attr("value", false), attr("type", false)),
+		),
+		schema(scimEnterpriseUser, "EnterpriseUser",
+			attr("employeeNumber", false),
+			attr("department", false),
+		),
+		schema(scimGroupSchema, "Group",
+			attr("displayName", false),
+			attr("members", true, attr("value", false), attr("$ref", false), attr("type", false)),
+		),
+	}
+	return s.returnSCIMDefinitions(c, schemas)
+}
+
+// returnSCIMDefinitions 返回ResourceTypes/Schemas的列表, 指定了id时只返回对应的一项
+func (s *Server) returnSCIMDefinitions(c echo.Context, definitions []map[string]any) error {
+	if id := c.Param("id"); id != "" {
+		for _, d := range definitions {
+			if d["id"] == id {
+				return s.returnSCIM(c, 200, d)
+			}
+		}
+		return s.returnSCIMError(c, 404, "", errors.New(id+" not found"))
+	}
+
+	resources := make([]any, 0, len(definitions))
+	for _, d := range definitions {
+		resources = append(resources, d)
+	}
+	return s.returnSCIM(c, 200, scimList(len(resources), 1, resources))
+}
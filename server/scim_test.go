@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSCIMProviderStore(t *testing.T) *contactsFS {
+	store, err := newContactsFS("testdata/departments.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json", WithReloadInterval(0))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func newTestSCIMServer(t *testing.T) *echo.Echo {
+	return newSCIMServerWith(newTestSCIMProviderStore(t))
+}
+
+func newSCIMServerWith(store ContactStore) *echo.Echo {
+	s := New(0, WithContactStore(store))
+	e := echo.New()
+	s.mountSCIM(e.Group(scimPrefix, s.authn()))
+	return e
+}
+
+func scimGet(t *testing.T, e *echo.Echo, path string, query url.Values) (int, map[string]any) {
+	req := httptest.NewRequest("GET", scimPrefix+path+"?"+query.Encode(), nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer any")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, scimContentType, rec.Header().Get(echo.HeaderContentType))
+	body := map[string]any{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec.Code, body
+}
+
+func scimIDs(body map[string]any) []string {
+	ids := []string{}
+	for _, r := range body["Resources"].([]any) {
+		ids = append(ids, r.(map[string]any)["id"].(string))
+	}
+	return ids
+}
+
+func Test_scimUsers(t *testing.T) {
+	e := newTestSCIMServer(t)
+
+	status, body := scimGet(t, e, "/Users", url.Values{"startIndex": {"2"}, "count": {"2"}})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, float64(13), body["totalResults"])
+	assert.Equal(t, float64(2), body["startIndex"])
+	assert.Equal(t, []string{"uid-1.1", "uid-1.2"}, scimIDs(body))
+
+	_, body = scimGet(t, e, "/Users", url.Values{"filter": {`userName eq "USER2"`}})
+	require.Equal(t, []string{"uid-2"}, scimIDs(body))
+	user := body["Resources"].([]any)[0].(map[string]any)
+	assert.Equal(t, "user 2", user["displayName"])
+	assert.Equal(t, "user2@example.com", user["emails"].([]any)[0].(map[string]any)["value"])
+	assert.Equal(t, "1.1", user[scimEnterpriseUser].(map[string]any)["department"])
+
+	_, body = scimGet(t, e, "/Users", url.Values{"filter": {`emails co "user3" and not (displayName sw "user 3.")`}})
+	assert.Equal(t, []string{"uid-3"}, scimIDs(body))
+
+	status, body = scimGet(t, e, "/Users/uid-4", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "user4", body["userName"])
+
+	status, _ = scimGet(t, e, "/Users/uid-404", nil)
+	assert.Equal(t, 404, status)
+
+	status, body = scimGet(t, e, "/Users", url.Values{"filter": {`title eq "engineer"`}})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "invalidFilter", body["scimType"])
+}
+
+func Test_scimGroups(t *testing.T) {
+	e := newTestSCIMServer(t)
+
+	_, body := scimGet(t, e, "/Groups", url.Values{"filter": {`displayName sw "dev"`}})
+	assert.Equal(t, []string{"1", "5"}, scimIDs(body))
+
+	status, body := scimGet(t, e, "/Groups/1", nil)
+	assert.Equal(t, 200, status)
+	members := []string{}
+	for _, m := range body["members"].([]any) {
+		members = append(members, m.(map[string]any)["value"].(string))
+	}
+	assert.Equal(t, []string{"uid-1", "uid-1.1"}, members)
+}
+
+// countingStore 记录按部门遍历用户的次数
+type countingStore struct {
+	*contactsFS
+	deptWalks int
+}
+
+func (s *countingStore) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	s.deptWalks++
+	return s.contactsFS.ListUsersInDepartment(ctx, req)
+}
+
+func Test_scimUsers_noWalk(t *testing.T) {
+	store := &countingStore{contactsFS: newTestSCIMProviderStore(t)}
+	e := newSCIMServerWith(store)
+
+	status, body := scimGet(t, e, "/Users/uid-4", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "user4", body["userName"])
+
+	_, body = scimGet(t, e, "/Users", url.Values{"startIndex": {"12"}, "count": {"5"}})
+	assert.Equal(t, float64(13), body["totalResults"])
+	assert.Equal(t, []string{"uid-8", "uid-9"}, scimIDs(body))
+
+	_, body = scimGet(t, e, "/Users", url.Values{"filter": {`userName eq "USER2"`}})
+	assert.Equal(t, []string{"uid-2"}, scimIDs(body))
+	assert.Zero(t, store.deptWalks)
+}
+
+func Test_scim_plainStore(t *testing.T) {
+	// 只实现了ContactStore, 通过遍历部门和group查找
+	e := newSCIMServerWith(struct{ ContactStore }{newTestSCIMProviderStore(t)})
+
+	status, body := scimGet(t, e, "/Users/uid-4", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "user4", body["userName"])
+
+	status, _ = scimGet(t, e, "/Users/uid-404", nil)
+	assert.Equal(t, 404, status)
+
+	_, body = scimGet(t, e, "/Users", url.Values{"startIndex": {"2"}, "count": {"2"}})
+	assert.Equal(t, float64(13), body["totalResults"])
+	assert.Equal(t, []string{"uid-1.1", "uid-1.2"}, scimIDs(body))
+
+	status, body = scimGet(t, e, "/Groups/1", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "1", body["id"])
+
+	status, _ = scimGet(t, e, "/Groups/404", nil)
+	assert.Equal(t, 404, status)
+}
+
+func Test_scimDefinitions(t *testing.T) {
+	e := newTestSCIMServer(t)
+
+	status, body := scimGet(t, e, "/ServiceProviderConfig", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, true, body["filter"].(map[string]any)["supported"])
+
+	_, body = scimGet(t, e, "/ResourceTypes", nil)
+	assert.Equal(t, []string{"User", "Group"}, scimIDs(body))
+
+	_, body = scimGet(t, e, "/Schemas", nil)
+	assert.Equal(t, []string{scimUserSchema, scimEnterpriseUser, scimGroupSchema}, scimIDs(body))
+
+	status, body = scimGet(t, e, "/Schemas/"+scimGroupSchema, nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Group", body["name"])
+}
+
+func Test_parseSCIMFilter(t *testing.T) {
+	attrs := map[string][]string{
+		"username":     {"Alice"},
+		"displayname":  {"Alice Liddell"},
+		"emails.value": {"alice@example.com", "al@work.com"},
+	}
+
+	cases := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "alice"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+		{`displayName co "lid"`, true},
+		{`displayName sw "Lid"`, false},
+		{`emails.value sw "al@"`, true},
+		{`userName eq "bob" or emails.value co "work"`, true},
+		{`userName eq "alice" and displayName eq "alice"`, false},
+		{`not (userName eq "bob")`, true},
+		{`(userName eq "bob" or userName eq "alice") and displayName pr`, true},
+	}
+	for _, tc := range cases {
+		f, err := parseSCIMFilter(tc.filter, "userName", "displayName", "emails.value")
+		require.NoError(t, err, tc.filter)
+		assert.Equal(t, tc.match, f(attrs), tc.filter)
+	}
+
+	for _, bad := range []string{``, `userName`, `userName gt "a"`, `userName eq "a`, `(userName eq "a"`, `title eq "a"`} {
+		_, err := parseSCIMFilter(bad, "userName")
+		assert.Error(t, err, bad)
+	}
+}
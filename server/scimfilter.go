@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// scimFilter 解析后的SCIM过滤条件, 参数为资源的属性值, key为小写的属性名
+type scimFilter func(attrs map[string][]string) bool
+
+// parseSCIMFilter 解析SCIM过滤条件(RFC 7644 3.4.2.2), 支持eq/co/sw/pr, and/or/not以及括号.
+// 属性名和属性值均按大小写不敏感比较, attrs为允许使用的属性名
+func parseSCIMFilter(filter string, attrs ...string) (scimFilter, error) {
+	tokens, err := scanSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &scimFilterParser{tokens: tokens, attrs: map[string]bool{}}
+	for _, attr := range attrs {
+		p.attrs[strings.ToLower(attr)] = true
+	}
+
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// scanSCIMFilter 把过滤条件拆分为括号, 字符串字面量以及其他单词
+func scanSCIMFilter(filter string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(filter); {
+		switch ch := filter[i]; {
+		case ch == ' ':
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" ()\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+	attrs  map[string]bool
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *scimFilterParser) or() (scimFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(attrs map[string][]string) bool { return l(attrs) || right(attrs) }
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) and() (scimFilter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(attrs map[string][]string) bool { return l(attrs) && right(attrs) }
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) factor() (scimFilter, error) {
+	switch tok := p.next(); {
+	case strings.EqualFold(tok, "not"):
+		if p.next() != "(" {
+			return nil, fmt.Errorf("expect ( after not")
+		}
+		f, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		return func(attrs map[string][]string) bool { return !f(attrs) }, nil
+	case tok == "(":
+		return p.group()
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	default:
+		return p.comparison(tok)
+	}
+}
+
+func (p *scimFilterParser) group() (scimFilter, error) {
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.next() != ")" {
+		return nil, fmt.Errorf("missing ) in filter")
+	}
+	return f, nil
+}
+
+func (p *scimFilterParser) comparison(attr string) (scimFilter, error) {
+	// 去掉schema前缀, 如urn:ietf:params:scim:schemas:core:2.0:User:userName
+	if i := strings.LastIndex(attr, ":"); i >= 0 {
+		attr = attr[i+1:]
+	}
+	attr = strings.ToLower(attr)
+	if !p.attrs[attr] {
+		return nil, fmt.Errorf("unsupported attribute %q in filter", attr)
+	}
+
+	op := strings.ToLower(p.next())
+	if op == "pr" {
+		return func(attrs map[string][]string) bool {
+			for _, v := range attrs[attr] {
+				if v != "" {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	var match func(v, value string) bool
+	switch op {
+	case "eq":
+		match = func(v, value string) bool { return v == value }
+	case "co":
+		match = strings.Contains
+	case "sw":
+		match = strings.HasPrefix
+	default:
+		return nil, fmt.Errorf("unsupported operator %q in filter", op)
+	}
+
+	value := ""
+	if err := json.Unmarshal([]byte(p.next()), &value); err != nil {
+		return nil, fmt.Errorf("expect string value for %s %s", attr, op)
+	}
+	value = strings.ToLower(value)
+
+	return func(attrs map[string][]string) bool {
+		for _, v := range attrs[attr] {
+			if match(strings.ToLower(v), value) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
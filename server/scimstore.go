@@ -0,0 +1,532 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"golang.org/x/sync/singleflight"
+)
+
+// SCIM企业用户扩展的schema
+const scimEnterpriseUser = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+
+// SCIMConfig 上游SCIM 2.0服务的配置
+type SCIMConfig struct {
+	// SCIM服务的根地址, 如https://example.com/scim/v2
+	BaseURL string
+	// 请求上游时使用的Bearer token
+	Token string
+	// 默认使用http.DefaultClient
+	Client *http.Client
+
+	// 用于生成部门的用户属性, 默认为企业用户扩展中的department.
+	// 扩展属性使用"schema:属性名"的形式, 如"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:division"
+	DepartmentAttribute string
+	// 部门属性中上下级部门的分隔符, 如"/"时"中国/北京"会生成"中国"和"中国/北京"两个部门; 为空时不分级
+	DepartmentSeparator string
+	// 部门列表的缓存时间, 默认5分钟. 部门需要遍历全部用户才能得到;
+	// 过期后由一个后台请求刷新, 刷新期间继续返回过期的部门列表
+	DepartmentCacheTTL time.Duration
+	// 刷新部门列表的超时时间, 默认1分钟; 与触发刷新的请求无关, 请求取消后刷新仍会继续
+	DepartmentRefreshTimeout time.Duration
+}
+
+// WithContactSCIMStore 代理上游的SCIM 2.0服务作为通讯录的存储.
+// 用户和group直接分页请求上游的/Users和/Groups, 部门由用户的部门属性生成, 部门id为属性值
+func WithContactSCIMStore(cfg SCIMConfig) Option {
+	return WithContactStore(newContactsSCIM(cfg))
+}
+
+func newContactsSCIM(cfg SCIMConfig) *contactsSCIM {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.DepartmentAttribute == "" {
+		cfg.DepartmentAttribute = scimEnterpriseUser + ":department"
+	}
+	if cfg.DepartmentCacheTTL <= 0 {
+		cfg.DepartmentCacheTTL = 5 * time.Minute
+	}
+	if cfg.DepartmentRefreshTimeout <= 0 {
+		cfg.DepartmentRefreshTimeout = time.Minute
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+
+	return &contactsSCIM{cfg: cfg}
+}
+
+type contactsSCIM struct {
+	cfg SCIMConfig
+
+	mu       sync.Mutex
+	depts    []*spec.Department
+	loadedAt time.Time
+	// 同一时间只有一个刷新部门列表的请求
+	refresh singleflight.Group
+}
+
+// interface compliance
+var _ ContactStore = (*contactsSCIM)(nil)
+
+// scimListResponse SCIM的ListResponse
+type scimListResponse struct {
+	TotalResults int               `json:"totalResults"`
+	StartIndex   int               `json:"startIndex"`
+	Resources    []json.RawMessage `json:"Resources"`
+}
+
+// scimUser 用到的SCIM用户属性
+type scimUser struct {
+	ID          string `json:"id"`
+	UserName    string `json:"userName"`
+	DisplayName string `json:"displayName"`
+	Name        struct {
+		Formatted string `json:"formatted"`
+	} `json:"name"`
+	Title       string           `json:"title"`
+	Active      *bool            `json:"active"`
+	Emails      []scimMultiValue `json:"emails"`
+	PhoneNumber []scimMultiValue `json:"phoneNumbers"`
+	Enterprise  struct {
+		EmployeeNumber string `json:"employeeNumber"`
+	} `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"`
+}
+
+type scimGroup struct {
+	ID          string           `json:"id"`
+	DisplayName string           `json:"displayName"`
+	Members     []scimMultiValue `json:"members"`
+}
+
+type scimMultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type"`
+	Primary bool   `json:"primary"`
+}
+
+// ListDepartments implements ContactStore.
+func (s *contactsSCIM) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
+	*spec.PagingDepartments, error,
+) {
+	cursor, err := intCursor(req.Cursor).int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
+	}
+
+	depts, err := s.departments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, next := sublist(depts, cursor, req.GetSize())
+	return &spec.PagingDepartments{
+		HasNext: next != -1,
+		Cursor: func() string {
+			if next == -1 {
+				return ""
+			}
+			return strconv.Itoa(next)
+		}(),
+		Data: data,
+	}, nil
+}
+
+// SearchDepartment implements ContactStore.
+func (s *contactsSCIM) SearchDepartment(ctx context.Context, kw string) ([]*spec.Department, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Department{}, nil
+	}
+
+	depts, err := s.departments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kw = strings.ToLower(kw)
+	data := []*spec.Department{}
+	for _, d := range depts {
+		if strings.Contains(strings.ToLower(d.ID), kw) {
+			data = append(data, d)
+		}
+		// 返回前10个
+		if len(data) >= searchLimit {
+			break
+		}
+	}
+	return data, nil
+}
+
+// ListUsersInDepartment implements ContactStore.
+func (s *contactsSCIM) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	start, err := scimStartIndex(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := s.cfg.DepartmentAttribute + " eq " + scimString(req.DepartmentID)
+	resp, err := s.list(ctx, "/Users", filter, start, req.GetSize())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.users(resp.Resources)
+	if err != nil {
+		return nil, err
+	}
+	hasNext, next := scimNext(resp, start)
+	return &spec.PagingUsers{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+// SearchUser implements ContactStore.
+func (s *contactsSCIM) SearchUser(ctx context.Context, kw string) ([]*spec.User, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.User{}, nil
+	}
+
+	v := scimString(kw)
+	filter := "userName co " + v + " or displayName co " + v + " or emails.value co " + v
+	resp, err := s.list(ctx, "/Users", filter, 1, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+	return s.users(resp.Resources)
+}
+
+// ListGroups implements ContactStore.
+func (s *contactsSCIM) ListGroups(ctx context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+	start, err := scimStartIndex(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.list(ctx, "/Groups", "", start, req.GetSize(), "attributes", "id,displayName")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.groups(resp.Resources)
+	if err != nil {
+		return nil, err
+	}
+	hasNext, next := scimNext(resp, start)
+	return &spec.PagingGroups{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+// SearchGroup implements ContactStore.
+func (s *contactsSCIM) SearchGroup(ctx context.Context, kw string) ([]*spec.Group, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Group{}, nil
+	}
+
+	resp, err := s.list(ctx, "/Groups", "displayName co "+scimString(kw), 1, searchLimit,
+		"attributes", "id,displayName")
+	if err != nil {
+		return nil, err
+	}
+	return s.groups(resp.Resources)
+}
+
+// ListUsersInGroup implements ContactStore.
+// 上游一次返回group的全部成员, 按成员的位置分页
+func (s *contactsSCIM) ListUsersInGroup(ctx context.Context, req spec.ListGroupMembershipRequest) (
+	*spec.PagingResult[string], error,
+) {
+	cursor, err := intCursor(req.Cursor).int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", req.Cursor)
+	}
+
+	g := scimGroup{}
+	if err := s.get(ctx, "/Groups/"+url.PathEscape(req.Group), url.Values{"attributes": {"members"}}, &g); err != nil {
+		return nil, err
+	}
+
+	all := []string{}
+	for _, m := range g.Members {
+		// 只返回用户成员, 忽略嵌套的group
+		if m.Type == "" || strings.EqualFold(m.Type, "User") {
+			all = append(all, m.Value)
+		}
+	}
+	data, next := sublist(all, cursor, req.GetSize())
+
+	return &spec.PagingResult[string]{
+		HasNext: next != -1,
+		Cursor: func() string {
+			if next == -1 {
+				return ""
+			}
+			return strconv.Itoa(next)
+		}(),
+		Data: data,
+	}, nil
+}
+
+// departments 返回缓存的部门列表. 缓存过期时在后台刷新并先返回过期的列表; 没有缓存时等待刷新完成
+func (s *contactsSCIM) departments(ctx context.Context) ([]*spec.Department, error) {
+	s.mu.Lock()
+	depts, fresh := s.depts, time.Since(s.loadedAt) < s.cfg.DepartmentCacheTTL
+	s.mu.Unlock()
+	if depts != nil && fresh {
+		return depts, nil
+	}
+
+	// 刷新不使用请求的ctx, 避免第一个请求取消后其他等待的请求一起失败
+	ch := s.refresh.DoChan("departments", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.DepartmentRefreshTimeout)
+		defer cancel()
+
+		depts, err := s.loadDepartments(ctx)
+		if err != nil {
+			log.Printf("scim: refresh departments failed: %v", err)
+			return nil, err
+		}
+		s.mu.Lock()
+		s.depts, s.loadedAt = depts, time.Now()
+		s.mu.Unlock()
+		return depts, nil
+	})
+	if depts != nil {
+		return depts, nil
+	}
+
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.([]*spec.Department), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadDepartments 遍历全部用户的部门属性生成部门列表
+func (s *contactsSCIM) loadDepartments(ctx context.Context) ([]*spec.Department, error) {
+	const pageSize = 100
+	values := map[string]bool{}
+	for start := 1; ; {
+		resp, err := s.list(ctx, "/Users", "", start, pageSize, "attributes", s.cfg.DepartmentAttribute)
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range resp.Resources {
+			if v := s.departmentOf(raw); v != "" {
+				values[v] = true
+			}
+		}
+
+		hasNext, next := scimNext(resp, start)
+		if !hasNext {
+			break
+		}
+		start, _ = strconv.Atoi(next)
+	}
+	return synthesizeDepartments(values, s.cfg.DepartmentSeparator), nil
+}
+
+// departmentOf 返回用户的部门属性值
+func (s *contactsSCIM) departmentOf(raw json.RawMessage) string {
+	resource := map[string]any{}
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return ""
+	}
+
+	attr := s.cfg.DepartmentAttribute
+	if i := strings.LastIndex(attr, ":"); i >= 0 {
+		ext, _ := resource[attr[:i]].(map[string]any)
+		v, _ := ext[attr[i+1:]].(string)
+		return strings.TrimSpace(v)
+	}
+	v, _ := resource[attr].(string)
+	return strings.TrimSpace(v)
+}
+
+func (s *contactsSCIM) users(resources []json.RawMessage) ([]*spec.User, error) {
+	data := []*spec.User{}
+	for _, raw := range resources {
+		u := scimUser{}
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return nil, &UnavailableError{Source: s.cfg.BaseURL, Err: err}
+		}
+
+		user := &spec.User{
+			ID:               u.ID,
+			Name:             firstNonEmpty(u.DisplayName, u.Name.Formatted, u.UserName),
+			Username:         optionalString(u.UserName),
+			Email:            optionalString(primaryValue(u.Emails, "")),
+			Mobile:           optionalString(primaryValue(u.PhoneNumber, "mobile")),
+			EmployeeNumber:   optionalString(u.Enterprise.EmployeeNumber),
+			Position:         optionalString(u.Title),
+			Active:           u.Active == nil || *u.Active,
+			MainDepartmentID: s.departmentOf(raw),
+		}
+		data = append(data, user)
+	}
+	return data, nil
+}
+
+func (s *contactsSCIM) groups(resources []json.RawMessage) ([]*spec.Group, error) {
+	data := []*spec.Group{}
+	for _, raw := range resources {
+		g := scimGroup{}
+		if err := json.Unmarshal(raw, &g); err != nil {
+			return nil, &UnavailableError{Source: s.cfg.BaseURL, Err: err}
+		}
+		data = append(data, &spec.Group{ID: g.ID, Name: g.DisplayName})
+	}
+	return data, nil
+}
+
+// list 分页请求上游的资源列表, startIndex从1开始; extra为额外的query参数, 按key, value成对传入
+func (s *contactsSCIM) list(ctx context.Context, path, filter string, start, count int, extra ...string) (
+	*scimListResponse, error,
+) {
+	query := url.Values{}
+	query.Set("startIndex", strconv.Itoa(start))
+	query.Set("count", strconv.Itoa(count))
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		query.Set(extra[i], extra[i+1])
+	}
+
+	resp := &scimListResponse{}
+	if err := s.get(ctx, path, query, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *contactsSCIM) get(ctx context.Context, path string, query url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.BaseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/scim+json")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return &UnavailableError{Source: s.cfg.BaseURL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %w", path, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &UnavailableError{Source: s.cfg.BaseURL, Err: fmt.Errorf("GET %s: %s", path, resp.Status)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &UnavailableError{Source: s.cfg.BaseURL, Err: err}
+	}
+	return nil
+}
+
+// synthesizeDepartments 由部门属性值生成部门, 按id排序; 指定了分隔符时补齐上级部门
+func synthesizeDepartments(values map[string]bool, separator string) []*spec.Department {
+	all := map[string]*spec.Department{}
+	for v := range values {
+		if separator == "" {
+			all[v] = &spec.Department{ID: v, Name: v}
+			continue
+		}
+
+		parts := strings.Split(v, separator)
+		for i := range parts {
+			id := strings.Join(parts[:i+1], separator)
+			if _, found := all[id]; found {
+				continue
+			}
+			all[id] = &spec.Department{
+				ID:     id,
+				Parent: strings.Join(parts[:i], separator),
+				Name:   parts[i],
+			}
+		}
+	}
+
+	data := make([]*spec.Department, 0, len(all))
+	for _, d := range all {
+		data = append(data, d)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].ID < data[j].ID })
+	return data
+}
+
+// scimStartIndex 把cursor转换为SCIM的startIndex, 首页为1
+func scimStartIndex(cursor string) (int, error) {
+	if cursor == "" {
+		return 1, nil
+	}
+	start, err := strconv.Atoi(cursor)
+	if err != nil || start < 1 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return start, nil
+}
+
+// scimNext 根据上游返回的总数判断是否还有下一页, 下一页的cursor为下一页的startIndex
+func scimNext(resp *scimListResponse, start int) (bool, string) {
+	next := start + len(resp.Resources)
+	if len(resp.Resources) == 0 || next > resp.TotalResults {
+		return false, ""
+	}
+	return true, strconv.Itoa(next)
+}
+
+// scimString 把字符串转换为SCIM过滤条件中的字符串字面量
+func scimString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// primaryValue 返回多值属性中指定类型(为空时不限类型)的值, 优先返回primary的值, 否则返回第一个.
+// 没有该类型的值时返回空, 如primary的办公电话不会作为手机号
+func primaryValue(values []scimMultiValue, typ string) string {
+	value := ""
+	for _, v := range values {
+		if typ != "" && !strings.EqualFold(v.Type, typ) {
+			continue
+		}
+		if v.Primary {
+			return v.Value
+		}
+		if value == "" {
+			value = v.Value
+		}
+	}
+	return value
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return spec.Pointer(s)
+}
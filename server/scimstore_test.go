@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSCIMServer 进程内的SCIM服务, 支持startIndex/count分页, 以及测试用到的过滤条件:
+// 单个eq, 以及用or连接的多个co
+type fakeSCIMServer struct {
+	users  []map[string]any
+	groups []map[string]any
+	token  string
+}
+
+func (f *fakeSCIMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var resources []map[string]any
+	switch {
+	case r.URL.Path == "/scim/v2/Users":
+		resources = f.users
+	case r.URL.Path == "/scim/v2/Groups":
+		resources = f.groups
+	case strings.HasPrefix(r.URL.Path, "/scim/v2/Groups/"):
+		id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Groups/")
+		for _, g := range f.groups {
+			if g["id"] == id {
+				_ = json.NewEncoder(w).Encode(g)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	matched := []map[string]any{}
+	for _, res := range resources {
+		if matchSCIMFilter(res, r.URL.Query().Get("filter")) {
+			matched = append(matched, res)
+		}
+	}
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	page, _ := sublist(matched, start-1, count)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"schemas":      []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"},
+		"totalResults": len(matched),
+		"startIndex":   start,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+func matchSCIMFilter(res map[string]any, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	for _, cond := range strings.Split(filter, " or ") {
+		parts := strings.SplitN(cond, " ", 3)
+		var value string
+		_ = json.Unmarshal([]byte(parts[2]), &value)
+
+		for _, v := range scimAttrValues(res, parts[0]) {
+			if parts[1] == "eq" && v == value ||
+				parts[1] == "co" && strings.Contains(strings.ToLower(v), strings.ToLower(value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func scimAttrValues(res map[string]any, attr string) []string {
+	if i := strings.LastIndex(attr, ":"); i >= 0 {
+		ext, _ := res[attr[:i]].(map[string]any)
+		v, _ := ext[attr[i+1:]].(string)
+		return []string{v}
+	}
+	if name, sub, found := strings.Cut(attr, "."); found {
+		values := []string{}
+		items, _ := res[name].([]any)
+		for _, item := range items {
+			v, _ := item.(map[string]any)[sub].(string)
+			values = append(values, v)
+		}
+		return values
+	}
+	v, _ := res[attr].(string)
+	return []string{v}
+}
+
+func newTestSCIMStore(t *testing.T) (*contactsSCIM, *fakeSCIMServer) {
+	user := func(id, name, dept string, extra map[string]any) map[string]any {
+		u := map[string]any{
+			"id":          id,
+			"userName":    id,
+			"displayName": name,
+			scimEnterpriseUser: map[string]any{
+				"department":     dept,
+				"employeeNumber": "E-" + id,
+			},
+		}
+		for k, v := range extra {
+			u[k] = v
+		}
+		return u
+	}
+
+	fake := &fakeSCIMServer{
+		token: "secret",
+		users: []map[string]any{
+			user("user1", "User 1", "中国", map[string]any{
+				"emails": []any{
+					map[string]any{"value": "user1@work.com", "type": "work"},
+					map[string]any{"value": "user1@example.com", "primary": true},
+				},
+			}),
+			user("user2", "User 2", "中国/北京", map[string]any{
+				"title": "engineer",
+				"phoneNumbers": []any{
+					map[string]any{"value": "+86 200", "type": "work", "primary": true},
+					map[string]any{"value": "+86 100", "type": "mobile"},
+				},
+			}),
+			user("user3", "", "中国/北京", map[string]any{"active": false}),
+			user("user4", "User 4", "中国/上海", map[string]any{
+				"phoneNumbers": []any{map[string]any{"value": "+86 300", "type": "work", "primary": true}},
+			}),
+		},
+		groups: []map[string]any{
+			{"id": "developer", "displayName": "Developer", "members": []any{
+				map[string]any{"value": "user1", "type": "User"},
+				map[string]any{"value": "user2"},
+				map[string]any{"value": "qa", "type": "Group"},
+				map[string]any{"value": "user3", "type": "User"},
+			}},
+			{"id": "qa", "displayName": "QA"},
+		},
+	}
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return newContactsSCIM(SCIMConfig{
+		BaseURL:             srv.URL + "/scim/v2/",
+		Token:               fake.token,
+		Client:              srv.Client(),
+		DepartmentSeparator: "/",
+	}), fake
+}
+
+func Test_contactsSCIM_departments(t *testing.T) {
+	store, _ := newTestSCIMStore(t)
+
+	first, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 2})
+	require.NoError(t, err)
+	assert.True(t, first.HasNext)
+	assert.Equal(t, []*spec.Department{
+		{ID: "中国", Name: "中国"},
+		{ID: "中国/上海", Parent: "中国", Name: "上海"},
+	}, first.Data)
+
+	second, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 2, Cursor: first.Cursor})
+	require.NoError(t, err)
+	assert.False(t, second.HasNext)
+	assert.Equal(t, []*spec.Department{{ID: "中国/北京", Parent: "中国", Name: "北京"}}, second.Data)
+
+	found, err := store.SearchDepartment(context.TODO(), "北京")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "中国/北京", found[0].ID)
+}
+
+func Test_contactsSCIM_departmentsRefresh(t *testing.T) {
+	_, fake := newTestSCIMStore(t)
+
+	// 遍历用户的部门属性时阻塞, 直到release
+	var crawls atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("attributes") != "" {
+			crawls.Add(1)
+			<-release
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	store := newContactsSCIM(SCIMConfig{
+		BaseURL: srv.URL + "/scim/v2", Token: fake.token, Client: srv.Client(), DepartmentSeparator: "/",
+	})
+
+	// 第一个请求取消后, 刷新仍继续, 其他请求得到结果
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := store.departments(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	done := make(chan []*spec.Department)
+	go func() {
+		depts, _ := store.departments(context.Background())
+		done <- depts
+	}()
+	close(release)
+	assert.Len(t, <-done, 3)
+	assert.Equal(t, int32(1), crawls.Load())
+
+	// 缓存过期后先返回过期的列表, 后台刷新
+	store.mu.Lock()
+	store.loadedAt = time.Now().Add(-time.Hour)
+	store.mu.Unlock()
+	depts, err := store.departments(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, depts, 3)
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return time.Since(store.loadedAt) < time.Minute
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), crawls.Load())
+}
+
+func Test_contactsSCIM_users(t *testing.T) {
+	store, _ := newTestSCIMStore(t)
+
+	first, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "中国/北京",
+		PagingParam:  spec.PagingParam{Size: 1},
+	})
+	require.NoError(t, err)
+	assert.True(t, first.HasNext)
+	require.Len(t, first.Data, 1)
+	assert.Equal(t, &spec.User{
+		ID:               "user2",
+		Name:             "User 2",
+		Username:         spec.Pointer("user2"),
+		Mobile:           spec.Pointer("+86 100"),
+		EmployeeNumber:   spec.Pointer("E-user2"),
+		Position:         spec.Pointer("engineer"),
+		Active:           true,
+		MainDepartmentID: "中国/北京",
+	}, first.Data[0])
+
+	second, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "中国/北京",
+		PagingParam:  spec.PagingParam{Size: 1, Cursor: first.Cursor},
+	})
+	require.NoError(t, err)
+	assert.False(t, second.HasNext)
+	assert.Equal(t, "", second.Cursor)
+	require.Len(t, second.Data, 1)
+	assert.Equal(t, "user3", second.Data[0].Name)
+	assert.False(t, second.Data[0].Active)
+
+	found, err := store.SearchUser(context.TODO(), "USER1@example")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "user1@example.com", *found[0].Email)
+
+	// 只有办公电话时, 不作为手机号
+	found, err = store.SearchUser(context.TODO(), "User 4")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Nil(t, found[0].Mobile)
+
+	_, err = store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "中国",
+		PagingParam:  spec.PagingParam{Size: 1, Cursor: "abc"},
+	})
+	assert.Error(t, err)
+}
+
+func Test_contactsSCIM_groups(t *testing.T) {
+	store, _ := newTestSCIMStore(t)
+
+	groups, err := store.ListGroups(context.TODO(), spec.PagingParam{Size: 10})
+	require.NoError(t, err)
+	assert.False(t, groups.HasNext)
+	assert.Equal(t, []*spec.Group{{ID: "developer", Name: "Developer"}, {ID: "qa", Name: "QA"}}, groups.Data)
+
+	// 嵌套的group不作为成员返回
+	first, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "developer",
+		PagingParam: spec.PagingParam{Size: 2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, first.Data)
+	assert.True(t, first.HasNext)
+
+	second, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "developer",
+		PagingParam: spec.PagingParam{Size: 2, Cursor: first.Cursor},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user3"}, second.Data)
+	assert.False(t, second.HasNext)
+
+	_, err = store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{Group: "missing"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	found, err := store.SearchGroup(context.TODO(), "q")
+	require.NoError(t, err)
+	assert.Equal(t, []*spec.Group{{ID: "qa", Name: "QA"}}, found)
+}
+
+func Test_contactsSCIM_unavailable(t *testing.T) {
+	store, fake := newTestSCIMStore(t)
+	fake.token = "rotated"
+
+	_, err := store.ListGroups(context.TODO(), spec.PagingParam{Size: 10})
+	var unavailable *UnavailableError
+	require.True(t, errors.As(err, &unavailable))
+	assert.Contains(t, err.Error(), "401")
+}
@@ -2,8 +2,21 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	spec "github.com/idaaser/syncspecv1"
 	"github.com/labstack/echo/v4"
@@ -16,15 +29,56 @@ func New(port int, opts ...Option) *Server {
 		port:     port,
 		clients:  &allowAnyAs{},
 		contacts: &nopcs{},
+		cursors:  newCursorCodec(),
+
+		deptParents:     newDeptParentsCache(),
+		shutdownTimeout: 30 * time.Second,
 	}
 
 	for _, opt := range opts {
 		opt(srv)
 	}
 
+	if srv.rotation != nil {
+		if rotator, ok := srv.clients.(keyRotator); !ok {
+			srv.errs = append(srv.errs, fmt.Errorf("key rotation is not supported by %T", srv.clients))
+		} else if stop, err := rotator.startRotation(srv.rotation); err != nil {
+			srv.errs = append(srv.errs, err)
+		} else {
+			srv.stopRotation = stop
+		}
+	}
+	if srv.revocations != nil {
+		if store, ok := srv.clients.(revocable); !ok {
+			srv.errs = append(srv.errs, fmt.Errorf("revocation list is not supported by %T", srv.clients))
+		} else {
+			store.setRevocationList(srv.revocations)
+		}
+	}
+	if len(srv.admins) > 0 {
+		if store, ok := srv.clients.(adminGrantable); !ok {
+			srv.errs = append(srv.errs, fmt.Errorf("admin clients are not supported by %T", srv.clients))
+		} else {
+			store.setAdminClients(srv.admins)
+		}
+	}
+
 	return srv
 }
 
+// withError 记录选项中的配置错误, 由Start返回, 见Err
+func withError(err error) Option {
+	return func(srv *Server) {
+		srv.errs = append(srv.errs, err)
+	}
+}
+
+// Err 返回选项中的配置错误(如参数无效、AuthnStore不支持的选项), 没有错误时返回nil.
+// Start时会先返回该错误; 通过Handler嵌入到其他程序时, 应先检查
+func (s *Server) Err() error {
+	return errors.Join(s.errs...)
+}
+
 type (
 	// Server "企业通讯录数据同步接口v1"的参考实现
 	Server struct {
@@ -32,14 +86,208 @@ type (
 
 		clients  AuthnStore
 		contacts ContactStore
+
+		// 分页cursor的签名和校验
+		cursors *cursorCodec
+
+		// 是否提供SCIM 2.0接口
+		scim bool
+
+		// 允许调用管理接口的client_id
+		admins map[string]bool
+		// client_id -> 访问策略
+		policies map[string]*ClientPolicy
+		// 按访问策略过滤时缓存的部门上级关系, 见deptParentsCache
+		deptParents *deptParentsCache
+
+		// 签名密钥的轮换, 见WithKeyRotation
+		rotation *keyRotation
+		// 已撤销的token, 见WithRevocationList
+		revocations RevocationList
+
+		// 使用HTTPS时的配置, 见WithTLS
+		tlsConfig *tls.Config
+
+		// 选项中的配置错误, 见Err
+		errs []error
+
+		// 服务对外的地址, 见WithBaseURL
+		baseURL string
+		// 信任其X-Forwarded-*头的反向代理, 见WithTrustedProxies
+		trustedProxies []*net.IPNet
+
+		// 监听的listener, 为空时监听port, 见WithListener
+		listener net.Listener
+		// 停止服务时, 等待处理中的请求完成的最长时间, 见WithShutdownTimeout
+		shutdownTimeout time.Duration
+
+		handlerOnce sync.Once
+		handler     *echo.Echo
+
+		mu           sync.Mutex
+		httpServer   *http.Server
+		stopRotation func()
+		closeOnce    sync.Once
 	}
 
 	// Option Server可接受的配置选项
 	Option func(srv *Server)
 )
 
-// Start 启动服务
-func (s *Server) Start() {
+// WithTLS 使用HTTPS. clientCAs不为空时, 校验客户端证书(可选), 以支持tls_client_auth的client鉴权
+func WithTLS(cert tls.Certificate, clientCAs *x509.CertPool) Option {
+	return func(srv *Server) {
+		srv.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if clientCAs != nil {
+			srv.tlsConfig.ClientCAs = clientCAs
+			srv.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+}
+
+// WithListener 在l上提供服务(设置后忽略port), 如测试时使用随机端口, 或者由systemd等传入listener
+func WithListener(l net.Listener) Option {
+	return func(srv *Server) {
+		srv.listener = l
+	}
+}
+
+// WithBaseURL 服务对外的地址, 如https://sync.example.com. 设置后, .well-known等返回的接口地址,
+// 以及private_key_jwt的client assertion须匹配的aud均基于该地址, 不再根据请求的Host和X-Forwarded-*头生成.
+// 不是有效的http(s)地址时, Start返回错误
+func WithBaseURL(baseURL string) Option {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return withError(fmt.Errorf("invalid base url %q", baseURL))
+	}
+
+	return func(srv *Server) {
+		srv.baseURL = strings.TrimSuffix(u.String(), "/")
+	}
+}
+
+// WithTrustedProxies 未设置WithBaseURL时, private_key_jwt的client assertion须匹配的aud只采用来自这些地址(IP或CIDR)的
+// X-Forwarded-Proto和X-Forwarded-Host头; 默认不信任, 以请求的Host为准. 其他接口地址仍按请求的X-Forwarded-*头生成.
+// 地址无效时, Start返回错误
+func WithTrustedProxies(proxies ...string) Option {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		cidr := p
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return withError(fmt.Errorf("invalid trusted proxy %q", p))
+		}
+		networks = append(networks, network)
+	}
+
+	return func(srv *Server) {
+		srv.trustedProxies = append(srv.trustedProxies, networks...)
+	}
+}
+
+// WithShutdownTimeout Start的ctx取消后, 等待处理中的请求完成的最长时间, 默认30秒
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.shutdownTimeout = d
+	}
+}
+
+// Handler 返回处理全部接口的http.Handler, 用于嵌入到其他程序中; 多次调用返回同一个Handler
+func (s *Server) Handler() http.Handler {
+	s.handlerOnce.Do(func() {
+		s.handler = s.newEcho()
+	})
+	return s.handler
+}
+
+// Start 启动服务, 直到ctx取消或者调用Shutdown; 监听失败等启动错误直接返回.
+// ctx取消后停止接受新的请求, 等待处理中的请求完成(最长为WithShutdownTimeout)后返回, 正常停止时返回nil.
+// 注: 调用Shutdown停止时, Start立即返回, 须等待Shutdown返回
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.Err(); err != nil {
+		_ = s.Shutdown(context.Background())
+		return err
+	}
+
+	s.mu.Lock()
+	if s.httpServer != nil {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	srv := &http.Server{Handler: s.Handler(), TLSConfig: s.tlsConfig}
+	s.httpServer = srv
+	s.mu.Unlock()
+
+	l := s.listener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", ":"+strconv.Itoa(s.port)); err != nil {
+			_ = s.Shutdown(context.Background())
+			return err
+		}
+	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+
+	log.Printf("server: listening on %s", l.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		_ = s.Shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
+	}
+}
+
+// Shutdown 停止服务: 停止接受新的请求, 等待处理中的请求完成(直到ctx取消);
+// 并停止密钥轮换, 关闭实现了io.Closer的ContactStore. 可以多次调用
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	var errs []error
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.closeOnce.Do(func() {
+		if s.stopRotation != nil {
+			s.stopRotation()
+		}
+		if closer, ok := s.contacts.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// newEcho 创建echo实例, 并注册全部路由
+func (s *Server) newEcho() *echo.Echo {
 	e := echo.New()
 	e.Use(middleware.Recover())
 	e.Use(middleware.Logger())
@@ -56,23 +304,42 @@ func (s *Server) Start() {
 	v1.GET("/.well-known", s.wellknown)
 	// 生成access_token
 	v1.POST("/token", s.token)
+	// 撤销access_token以及查询access_token的状态, 仅当AuthnStore实现了RevocableAuthnStore时可用
+	v1.POST("/token/revoke", s.revokeToken)
+	v1.POST("/token/introspect", s.introspectToken)
+	// 校验access_token的公钥, 仅当AuthnStore实现了JWKSProvider时可用
+	v1.GET("/jwks.json", s.jwks)
 
+	// 各接口需要对应的scope, 缺少时返回403
 	withAuth := v1.Group("", s.authn())
 	// 分页获取部门详情
-	withAuth.GET("/depts", s.listDepts)
+	withAuth.GET("/depts", s.listDepts, s.requireScope(ScopeDeptsRead))
 	// 根据关键字, 搜索部门
-	withAuth.GET("/depts/search", s.searchDept)
+	withAuth.GET("/depts/search", s.searchDept, s.requireScope(ScopeDeptsRead))
+	// 获取部门的全部上级部门, 仅当ContactStore实现了DepartmentTreeStore时可用
+	withAuth.GET("/depts/ancestors", s.listAncestors, s.requireScope(ScopeDeptsRead))
 	// 分页获取指定部门下的用户详情
-	withAuth.GET("/users", s.listUsersInDept)
+	withAuth.GET("/users", s.listUsersInDept, s.requireScope(ScopeUsersRead))
 	// 根据关键字, 搜索用户
-	withAuth.GET("/users/search", s.serarchUser)
+	withAuth.GET("/users/search", s.serarchUser, s.requireScope(ScopeUsersRead))
 
 	// 分页获取group详情
-	withAuth.GET("/groups", s.listGroups)
+	withAuth.GET("/groups", s.listGroups, s.requireScope(ScopeGroupsRead))
 	// 根据关键字, 搜索group
-	withAuth.GET("/groups/search", s.searchGroup)
+	withAuth.GET("/groups/search", s.searchGroup, s.requireScope(ScopeGroupsRead))
 	// 分页获取指定group下的用户id列表
-	withAuth.GET("/groups/users", s.listUsersInGroup)
+	withAuth.GET("/groups/users", s.listUsersInGroup, s.requireScope(ScopeGroupsRead))
+
+	// 增量同步, 仅当ContactStore实现了ChangeFeedStore时可用; 返回全部类型的变更, 需要全部读取的scope
+	withAuth.GET("/changes", s.listChanges, s.requireScope(DefaultScopes...))
+
+	// 管理接口, 仅当ContactStore实现了MutableContactStore时可用, 且只有包含ScopeAdmin的token可以调用
+	s.mountAdmin(withAuth.Group("/admin"))
+
+	if s.scim {
+		// SCIM 2.0接口(只读), 与/v1使用相同的鉴权
+		s.mountSCIM(e.Group(scimPrefix, s.authn()))
+	}
 
 	// jit mock, for test only
 	jit := v1.Group("/jit/:prefix/:count", s.jit())
@@ -80,13 +347,16 @@ func (s *Server) Start() {
 
 	// 生成access_token
 	jit.POST("/token", s.token)
+	jit.POST("/token/revoke", s.revokeToken)
+	jit.POST("/token/introspect", s.introspectToken)
+	jit.GET("/jwks.json", s.jwks)
 	jitAuth := jit.Group("", s.authn())
 	// 分页获取部门详情
-	jitAuth.GET("/depts", s.listDepts)
+	jitAuth.GET("/depts", s.listDepts, s.requireScope(ScopeDeptsRead))
 	// 分页获取指定部门下的用户详情
-	jitAuth.GET("/users", s.listUsersInDept)
+	jitAuth.GET("/users", s.listUsersInDept, s.requireScope(ScopeUsersRead))
 
-	e.Logger.Fatal(e.Start(":" + strconv.Itoa(s.port)))
+	return e
 }
 
 func (s *Server) absoluteURL(c echo.Context, paths ...string) string {
@@ -95,6 +365,9 @@ func (s *Server) absoluteURL(c echo.Context, paths ...string) string {
 }
 
 func (s *Server) rootURL(c echo.Context) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
 	return s.scheme(c) + "://" + s.host(c)
 }
 
@@ -114,15 +387,76 @@ func (s *Server) host(c echo.Context) string {
 	return c.Request().Host
 }
 
+// trustedRootURL 同rootURL, 但只采用信任的反向代理设置的X-Forwarded-*头, 用于须防止伪造的地址(如client assertion的aud).
+// 注: 不使用c.Scheme(), 其总是信任X-Forwarded-*头
+func (s *Server) trustedRootURL(c echo.Context) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
+
+	scheme, host := "http", c.Request().Host
+	if c.IsTLS() {
+		scheme = "https"
+	}
+	if s.fromTrustedProxy(c) {
+		if xfp := forwarded(c, "X-Forwarded-Proto"); xfp != "" {
+			scheme = xfp
+		}
+		if xfh := forwarded(c, "X-Forwarded-Host"); xfh != "" {
+			host = xfh
+		}
+	}
+	return scheme + "://" + host
+}
+
+// forwarded 返回X-Forwarded-*头的第一个值, 即离客户端最近的代理设置的值
+func forwarded(c echo.Context, header string) string {
+	v, _, _ := strings.Cut(c.Request().Header.Get(header), ",")
+	return strings.TrimSpace(v)
+}
+
+// fromTrustedProxy 请求的直接来源是否为WithTrustedProxies中的地址
+func (s *Server) fromTrustedProxy(c echo.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && slices.ContainsFunc(s.trustedProxies, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
 func (s *Server) returnJSONError(c echo.Context, status int, code string, err error) error {
+	return c.JSON(status, s.errResponse(c, code, err))
+}
+
+func (s *Server) errResponse(c echo.Context, code string, err error) spec.ErrResponse {
 	resp := spec.ErrResponse{Code: code, Msg: err.Error()}
 	if reqid, ok := c.Get("reqid").(string); ok {
 		resp.RequestID = reqid
 	}
-
-	return c.JSON(status, resp)
+	return resp
 }
 
 func (s *Server) returnBadRequest(c echo.Context, err error) error {
 	return s.returnJSONError(c, 400, spec.ErrInvalidRequest, err)
 }
+
+// 通讯录数据暂时无法加载时返回的错误码
+const errTemporarilyUnavailable = "temporarily_unavailable"
+
+// returnStoreError 返回ContactStore的错误:
+// 数据无法加载时返回503, 部门/用户/group不存在时返回404, 非法的cursor以及其他错误返回400
+func (s *Server) returnStoreError(c echo.Context, err error) error {
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return s.returnJSONError(c, 503, errTemporarilyUnavailable, err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return s.returnJSONError(c, 404, errNotFound, err)
+	}
+	if isCursorError(err) {
+		return s.returnJSONError(c, 400, errInvalidCursor, err)
+	}
+
+	return s.returnBadRequest(c, err)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closingStore 记录是否被关闭的ContactStore
+type closingStore struct {
+	nopcs
+	closed bool
+}
+
+func (s *closingStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func Test_Server_lifecycle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	store := &closingStore{}
+	s := New(0, WithListener(l), WithContactStore(store))
+
+	// 处理中的请求, 在停止服务前完成
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Handler().(*echo.Echo).GET("/slow", func(c echo.Context) error {
+		close(started)
+		<-release
+		return c.String(200, "done")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Start(ctx) }()
+
+	base := "http://" + l.Addr().String()
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(base + "/v1/.well-known")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == 200
+	}, 5*time.Second, 10*time.Millisecond)
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		slow <- result{status: resp.StatusCode, body: string(b)}
+	}()
+	<-started
+
+	cancel()
+	// 停止接受新的连接, 但等待处理中的请求完成
+	select {
+	case <-stopped:
+		t.Fatal("Start returned before in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	r := <-slow
+	require.NoError(t, r.err)
+	assert.Equal(t, 200, r.status)
+	assert.Equal(t, "done", r.body)
+	assert.NoError(t, <-stopped)
+	assert.True(t, store.closed)
+
+	_, err = http.Get(base + "/v1/.well-known")
+	assert.Error(t, err)
+	// 不能再次启动
+	assert.Error(t, s.Start(context.Background()))
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func Test_Server_Start_error(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// 端口已被占用
+	s := New(l.Addr().(*net.TCPAddr).Port)
+	err = s.Start(context.Background())
+	assert.ErrorContains(t, err, strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+}
+
+func Test_Server_Start_configError(t *testing.T) {
+	s := New(0,
+		WithBaseURL("sync.example.com"),
+		WithJWTAuthnStore(newTestKey(t), time.Hour, "client_without_secret"),
+	)
+	err := s.Start(context.Background())
+	assert.ErrorContains(t, err, "invalid base url")
+	assert.ErrorContains(t, err, "pairs")
+
+	// 通讯录文件加载失败
+	err = New(0, WithContactFileStore("testdata/notexists.json", "testdata/users.json",
+		"testdata/groups.json", "testdata/group-users.json")).Start(context.Background())
+	assert.ErrorContains(t, err, "notexists.json")
+	err = New(0, WithContactCSVStore("testdata/notexists.csv", CSVMapping{})).Start(context.Background())
+	assert.ErrorContains(t, err, "notexists.csv")
+
+	// 默认的AuthnStore不支持RevocationList
+	assert.ErrorContains(t, New(0, WithRevocationList(NewMemoryRevocationList())).Start(context.Background()),
+		"revocation list is not supported")
+}
+
+func Test_Server_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := New(0, WithListener(l))
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Start(context.Background()) }()
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.httpServer != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-stopped)
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// SQLContactSchema SQL存储使用的表结构(以SQLite/PostgreSQL的语法为例).
+// 用户的主部门保存在users.main_department中, 其他部门保存在user_departments中.
+// 注: MySQL 8中groups为保留字, 需要开启ANSI_QUOTES并给表名加上双引号
+const SQLContactSchema = `
+CREATE TABLE departments (
+	id         VARCHAR(64)  PRIMARY KEY,
+	parent     VARCHAR(64)  NOT NULL DEFAULT '',
+	name       VARCHAR(255) NOT NULL,
+	sort_order INTEGER      NOT NULL DEFAULT 0
+);
+
+CREATE TABLE users (
+	id              VARCHAR(64)  PRIMARY KEY,
+	name            VARCHAR(255) NOT NULL,
+	username        VARCHAR(255),
+	email           VARCHAR(255),
+	mobile          VARCHAR(64),
+	employee_number VARCHAR(64),
+	position        VARCHAR(255),
+	active          BOOLEAN      NOT NULL DEFAULT TRUE,
+	sort_order      INTEGER      NOT NULL DEFAULT 0,
+	main_department VARCHAR(64)  NOT NULL
+);
+CREATE INDEX idx_users_main_department ON users (main_department, id);
+
+CREATE TABLE user_departments (
+	user_id       VARCHAR(64) NOT NULL,
+	department_id VARCHAR(64) NOT NULL,
+	PRIMARY KEY (user_id, department_id)
+);
+CREATE INDEX idx_user_departments_department ON user_departments (department_id, user_id);
+
+CREATE TABLE groups (
+	id   VARCHAR(64)  PRIMARY KEY,
+	name VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE group_members (
+	group_id VARCHAR(64) NOT NULL,
+	user_id  VARCHAR(64) NOT NULL,
+	PRIMARY KEY (group_id, user_id)
+);
+`
+
+// SQLStoreOption SQL存储可接受的配置选项
+type SQLStoreOption func(s *contactsSQL)
+
+// WithDollarPlaceholder 使用$1, $2...作为参数占位符(如PostgreSQL), 默认使用?
+func WithDollarPlaceholder() SQLStoreOption {
+	return func(s *contactsSQL) {
+		s.dollar = true
+	}
+}
+
+// WithContactSQLStore 使用关系型数据库作为通讯录的存储, 表结构见SQLContactSchema.
+// 分页使用keyset方式(按id排序), 搜索使用LIKE模糊匹配
+func WithContactSQLStore(db *sql.DB, opts ...SQLStoreOption) Option {
+	return WithContactStore(newContactsSQL(db, opts...))
+}
+
+func newContactsSQL(db *sql.DB, opts ...SQLStoreOption) *contactsSQL {
+	s := &contactsSQL{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type contactsSQL struct {
+	db *sql.DB
+
+	// 是否使用$n作为参数占位符
+	dollar bool
+}
+
+// interface compliance
+var _ ContactStore = (*contactsSQL)(nil)
+
+// 搜索时最多返回的数量
+const searchLimit = 10
+
+const userColumns = `u.id, u.name, u.username, u.email, u.mobile, u.employee_number, u.position,
+	u.active, u.sort_order, u.main_department`
+
+// ListDepartments implements ContactStore.
+func (s *contactsSQL) ListDepartments(ctx context.Context, req spec.ListDepatmentRequest) (
+	*spec.PagingDepartments, error,
+) {
+	size := req.GetSize()
+	rows, err := s.query(ctx,
+		`SELECT id, parent, name, sort_order FROM departments WHERE id > ? ORDER BY id LIMIT ?`,
+		req.Cursor, size+1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := scanDepartments(rows)
+	if err != nil {
+		return nil, s.unavailable(err)
+	}
+
+	data, hasNext, next := keysetPage(data, size, func(d *spec.Department) string { return d.ID })
+	return &spec.PagingDepartments{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+// SearchDepartment implements ContactStore.
+func (s *contactsSQL) SearchDepartment(ctx context.Context, kw string) ([]*spec.Department, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Department{}, nil
+	}
+
+	pattern := likePattern(kw)
+	rows, err := s.query(ctx,
+		`SELECT id, parent, name, sort_order FROM departments
+		WHERE LOWER(name) LIKE ? ESCAPE '!' OR LOWER(id) LIKE ? ESCAPE '!'
+		ORDER BY id LIMIT ?`,
+		pattern, pattern, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := scanDepartments(rows)
+	if err != nil {
+		return nil, s.unavailable(err)
+	}
+	return data, nil
+}
+
+// ListUsersInDepartment implements ContactStore.
+func (s *contactsSQL) ListUsersInDepartment(ctx context.Context, req spec.ListUsersInDepatmentRequest) (
+	*spec.PagingUsers, error,
+) {
+	size := req.GetSize()
+	rows, err := s.query(ctx,
+		`SELECT `+userColumns+` FROM users u
+		WHERE (u.main_department = ? OR EXISTS (
+			SELECT 1 FROM user_departments ud WHERE ud.user_id = u.id AND ud.department_id = ?
+		)) AND u.id > ?
+		ORDER BY u.id LIMIT ?`,
+		req.DepartmentID, req.DepartmentID, req.Cursor, size+1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.scanUsers(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	data, hasNext, next := keysetPage(data, size, func(u *spec.User) string { return u.ID })
+	return &spec.PagingUsers{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+// SearchUser implements ContactStore.
+func (s *contactsSQL) SearchUser(ctx context.Context, kw string) ([]*spec.User, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.User{}, nil
+	}
+
+	pattern := likePattern(kw)
+	columns := []string{"u.id", "u.name", "u.username", "u.email", "u.mobile", "u.employee_number"}
+	conds, args := []string{}, []any{}
+	for _, column := range columns {
+		conds = append(conds, "LOWER("+column+`) LIKE ? ESCAPE '!'`)
+		args = append(args, pattern)
+	}
+
+	rows, err := s.query(ctx,
+		`SELECT `+userColumns+` FROM users u WHERE `+strings.Join(conds, " OR ")+` ORDER BY u.id LIMIT ?`,
+		append(args, searchLimit)...)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanUsers(ctx, rows)
+}
+
+// ListGroups implements ContactStore.
+func (s *contactsSQL) ListGroups(ctx context.Context, req spec.ListGroupRequest) (*spec.PagingGroups, error) {
+	size := req.GetSize()
+	rows, err := s.query(ctx,
+		`SELECT id, name FROM groups WHERE id > ? ORDER BY id LIMIT ?`,
+		req.Cursor, size+1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := scanGroups(rows)
+	if err != nil {
+		return nil, s.unavailable(err)
+	}
+
+	data, hasNext, next := keysetPage(data, size, func(g *spec.Group) string { return g.ID })
+	return &spec.PagingGroups{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+// SearchGroup implements ContactStore.
+func (s *contactsSQL) SearchGroup(ctx context.Context, kw string) ([]*spec.Group, error) {
+	if kw = strings.TrimSpace(kw); kw == "" {
+		return []*spec.Group{}, nil
+	}
+
+	pattern := likePattern(kw)
+	rows, err := s.query(ctx,
+		`SELECT id, name FROM groups
+		WHERE LOWER(name) LIKE ? ESCAPE '!' OR LOWER(id) LIKE ? ESCAPE '!'
+		ORDER BY id LIMIT ?`,
+		pattern, pattern, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := scanGroups(rows)
+	if err != nil {
+		return nil, s.unavailable(err)
+	}
+	return data, nil
+}
+
+// ListUsersInGroup implements ContactStore.
+func (s *contactsSQL) ListUsersInGroup(ctx context.Context, req spec.ListGroupMembershipRequest) (
+	*spec.PagingResult[string], error,
+) {
+	size := req.GetSize()
+	rows, err := s.query(ctx,
+		`SELECT user_id FROM group_members WHERE group_id = ? AND user_id > ? ORDER BY user_id LIMIT ?`,
+		req.Group, req.Cursor, size+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, s.unavailable(err)
+		}
+		data = append(data, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.unavailable(err)
+	}
+
+	data, hasNext, next := keysetPage(data, size, func(id string) string { return id })
+	return &spec.PagingResult[string]{HasNext: hasNext, Cursor: next, Data: data}, nil
+}
+
+func (s *contactsSQL) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, s.unavailable(err)
+	}
+	return rows, nil
+}
+
+// rebind 按配置把?替换为对应的参数占位符
+func (s *contactsSQL) rebind(query string) string {
+	if !s.dollar {
+		return query
+	}
+
+	b := strings.Builder{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *contactsSQL) unavailable(err error) error {
+	return &UnavailableError{Source: "sql", Err: err}
+}
+
+// scanUsers 读取用户, 并查询这些用户的其他部门
+func (s *contactsSQL) scanUsers(ctx context.Context, rows *sql.Rows) ([]*spec.User, error) {
+	defer rows.Close()
+
+	data := []*spec.User{}
+	byID := map[string]*spec.User{}
+	for rows.Next() {
+		u := &spec.User{}
+		var username, email, mobile, employeeNumber, position sql.NullString
+		if err := rows.Scan(&u.ID, &u.Name, &username, &email, &mobile, &employeeNumber, &position,
+			&u.Active, &u.Order, &u.MainDepartmentID); err != nil {
+			return nil, s.unavailable(err)
+		}
+		u.Username = nullString(username)
+		u.Email = nullString(email)
+		u.Mobile = nullString(mobile)
+		u.EmployeeNumber = nullString(employeeNumber)
+		u.Position = nullString(position)
+
+		data = append(data, u)
+		byID[u.ID] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.unavailable(err)
+	}
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(data)), ", ")
+	args := make([]any, 0, len(data))
+	for _, u := range data {
+		args = append(args, u.ID)
+	}
+	depts, err := s.query(ctx,
+		`SELECT user_id, department_id FROM user_departments
+		WHERE user_id IN (`+placeholders+`) ORDER BY user_id, department_id`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer depts.Close()
+
+	for depts.Next() {
+		var userid, deptid string
+		if err := depts.Scan(&userid, &deptid); err != nil {
+			return nil, s.unavailable(err)
+		}
+		if u := byID[userid]; u != nil && deptid != u.MainDepartmentID {
+			u.OtherDepartmentsID = append(u.OtherDepartmentsID, deptid)
+		}
+	}
+	if err := depts.Err(); err != nil {
+		return nil, s.unavailable(err)
+	}
+
+	return data, nil
+}
+
+func scanDepartments(rows *sql.Rows) ([]*spec.Department, error) {
+	defer rows.Close()
+
+	data := []*spec.Department{}
+	for rows.Next() {
+		d := &spec.Department{}
+		if err := rows.Scan(&d.ID, &d.Parent, &d.Name, &d.Order); err != nil {
+			return nil, err
+		}
+		data = append(data, d)
+	}
+	return data, rows.Err()
+}
+
+func scanGroups(rows *sql.Rows) ([]*spec.Group, error) {
+	defer rows.Close()
+
+	data := []*spec.Group{}
+	for rows.Next() {
+		g := &spec.Group{}
+		if err := rows.Scan(&g.ID, &g.Name); err != nil {
+			return nil, err
+		}
+		data = append(data, g)
+	}
+	return data, rows.Err()
+}
+
+// keysetPage 查询时多取一条用于判断是否还有下一页, 下一页的cursor为本页最后一条数据的id
+func keysetPage[T any](data []T, size int, key func(T) string) ([]T, bool, string) {
+	if len(data) <= size {
+		return data, false, ""
+	}
+
+	data = data[:size]
+	return data, true, key(data[size-1])
+}
+
+// likePattern 生成不区分大小写的LIKE模糊匹配, 转义关键字中的通配符.
+// 以!作为转义字符(ESCAPE '!'), 而不是在MySQL等数据库的字符串中有特殊含义的反斜杠
+func likePattern(kw string) string {
+	r := strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+	return "%" + r.Replace(strings.ToLower(kw)) + "%"
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newTestSQLStore(t *testing.T) *contactsSQL {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	// 内存数据库只在同一个连接内可见
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(SQLContactSchema)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		INSERT INTO departments (id, parent, name, sort_order) VALUES
+			('1', '', '中国', 1), ('1.1', '1', '北京', 1), ('1.2', '1', '上海', 2), ('1.3', '1', '辽宁', 3);
+		INSERT INTO users (id, name, username, email, main_department) VALUES
+			('uid-1', 'user 1', 'user1', 'user1@example.com', '1'),
+			('uid-2', 'user 2', 'user2', 'user2@example.com', '1.1'),
+			('uid-3', 'user 3', 'user3', NULL, '1.1'),
+			('uid-4', 'user_4', NULL, NULL, '1.2');
+		INSERT INTO user_departments (user_id, department_id) VALUES ('uid-4', '1.1'), ('uid-4', '1.3');
+		INSERT INTO groups (id, name) VALUES ('1', 'developer'), ('2', 'qa!100%');
+		INSERT INTO group_members (group_id, user_id) VALUES ('1', 'uid-1'), ('1', 'uid-2'), ('1', 'uid-4');
+	`)
+	require.NoError(t, err)
+
+	return newContactsSQL(db)
+}
+
+func Test_contactsSQL_ListDepartments(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	first, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 3})
+	require.NoError(t, err)
+	assert.True(t, first.HasNext)
+	assert.Equal(t, "1.2", first.Cursor)
+	assert.Len(t, first.Data, 3)
+
+	second, err := store.ListDepartments(context.TODO(), spec.PagingParam{Size: 3, Cursor: first.Cursor})
+	require.NoError(t, err)
+	assert.False(t, second.HasNext)
+	assert.Equal(t, "", second.Cursor)
+	require.Len(t, second.Data, 1)
+	assert.Equal(t, "1.3", second.Data[0].ID)
+}
+
+func Test_contactsSQL_ListUsersInDepartment(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	first, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "1.1",
+		PagingParam:  spec.PagingParam{Size: 2},
+	})
+	require.NoError(t, err)
+	assert.True(t, first.HasNext)
+	require.Len(t, first.Data, 2)
+	assert.Equal(t, "user2", *first.Data[0].Username)
+	assert.Nil(t, first.Data[1].Email)
+
+	second, err := store.ListUsersInDepartment(context.TODO(), spec.ListUsersInDepatmentRequest{
+		DepartmentID: "1.1",
+		PagingParam:  spec.PagingParam{Size: 2, Cursor: first.Cursor},
+	})
+	require.NoError(t, err)
+	assert.False(t, second.HasNext)
+	require.Len(t, second.Data, 1)
+	assert.Equal(t, "uid-4", second.Data[0].ID)
+	assert.Equal(t, []string{"1.1", "1.3"}, second.Data[0].OtherDepartmentsID)
+}
+
+func Test_contactsSQL_Search(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	users, err := store.SearchUser(context.TODO(), "USER2@")
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "uid-2", users[0].ID)
+
+	// _不作为通配符
+	users, err = store.SearchUser(context.TODO(), "user_")
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "uid-4", users[0].ID)
+
+	depts, err := store.SearchDepartment(context.TODO(), "北京")
+	require.NoError(t, err)
+	require.Len(t, depts, 1)
+
+	groups, err := store.SearchGroup(context.TODO(), "dev")
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+
+	// 转义字符!和%按原样匹配
+	groups, err = store.SearchGroup(context.TODO(), "a!1")
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "2", groups[0].ID)
+	groups, err = store.SearchGroup(context.TODO(), "r%")
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+}
+
+func Test_contactsSQL_Groups(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	groups, err := store.ListGroups(context.TODO(), spec.PagingParam{Size: 10})
+	require.NoError(t, err)
+	assert.Len(t, groups.Data, 2)
+
+	members, err := store.ListUsersInGroup(context.TODO(), spec.ListGroupMembershipRequest{
+		Group:       "1",
+		PagingParam: spec.PagingParam{Size: 2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-1", "uid-2"}, members.Data)
+	assert.True(t, members.HasNext)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	spec "github.com/idaaser/syncspecv1"
+)
+
+// IssueKind 通讯录数据问题的类型
+type IssueKind string
+
+const (
+	// IssueDuplicateID 同类数据中存在重复的id
+	IssueDuplicateID IssueKind = "duplicate_id"
+	// IssueMissingField 必填字段为空
+	IssueMissingField IssueKind = "missing_field"
+	// IssueOrphan 引用了不存在的部门或group
+	IssueOrphan IssueKind = "orphan"
+	// IssueCycle 部门树中存在环
+	IssueCycle IssueKind = "cycle"
+	// IssueDanglingMember group成员引用了不存在的用户
+	IssueDanglingMember IssueKind = "dangling_member"
+)
+
+// 出现问题的数据类型
+const (
+	entityDepartment  = "department"
+	entityUser        = "user"
+	entityGroup       = "group"
+	entityGroupMember = "group_member"
+)
+
+// ValidationIssue 校验发现的单个问题
+type ValidationIssue struct {
+	Kind IssueKind `json:"kind"`
+	// 出现问题的数据类型: department/user/group/group_member
+	Entity string `json:"entity"`
+	// 出现问题的数据id
+	ID string `json:"id"`
+	// 出现问题的字段
+	Field string `json:"field,omitempty"`
+	// 被引用但不存在的id, 或环中的部门id列表
+	Ref     string `json:"ref,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationReport 通讯录数据的校验结果
+type ValidationReport struct {
+	Departments  int               `json:"departments"`
+	Users        int               `json:"users"`
+	Groups       int               `json:"groups"`
+	GroupMembers int               `json:"group_members"`
+	Issues       []ValidationIssue `json:"issues"`
+}
+
+// OK 是否未发现任何问题
+func (r *ValidationReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *ValidationReport) add(kind IssueKind, entity, id, field, ref, format string, args ...any) {
+	r.Issues = append(r.Issues, ValidationIssue{
+		Kind: kind, Entity: entity, ID: id, Field: field, Ref: ref,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// ValidationError 通讯录数据未通过校验
+type ValidationError struct {
+	Report *ValidationReport
+}
+
+func (e *ValidationError) Error() string {
+	const limit = 5
+
+	msgs := []string{}
+	for i, issue := range e.Report.Issues {
+		if i >= limit {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Report.Issues)-limit))
+			break
+		}
+		msgs = append(msgs, issue.Message)
+	}
+	return fmt.Sprintf("%d validation issue(s): %s", len(e.Report.Issues), strings.Join(msgs, "; "))
+}
+
+// ValidateContactFiles 加载并校验通讯录文件, 文件读取或解析失败时返回错误
+func ValidateContactFiles(dept, user, group, groupMembers string) (*ValidationReport, error) {
+	snap, err := newContactFiles(dept, user, group, groupMembers).read()
+	if err != nil {
+		return nil, err
+	}
+	return validateContacts(snap), nil
+}
+
+// validateContacts 校验数据的完整性:
+// 必填字段, id唯一, 部门/group的引用存在, 部门树中不存在环
+func validateContacts(snap *contactsSnapshot) *ValidationReport {
+	r := &ValidationReport{
+		Departments:  len(snap.depts),
+		Users:        len(snap.users),
+		Groups:       len(snap.groups),
+		GroupMembers: len(snap.groupMembers),
+		Issues:       []ValidationIssue{},
+	}
+
+	depts := map[string]*spec.Department{}
+	for _, d := range snap.depts {
+		if d.ID == "" {
+			r.add(IssueMissingField, entityDepartment, "", "id", "", "department %q has empty id", d.Name)
+			continue
+		}
+		if d.Name == "" {
+			r.add(IssueMissingField, entityDepartment, d.ID, "name", "", "department %q has empty name", d.ID)
+		}
+		if _, found := depts[d.ID]; found {
+			r.add(IssueDuplicateID, entityDepartment, d.ID, "id", "", "duplicate department id %q", d.ID)
+			continue
+		}
+		depts[d.ID] = d
+	}
+	for _, d := range snap.depts {
+		if d.ID == "" || d.Parent == "" || depts[d.ID] != d {
+			continue
+		}
+		if _, found := depts[d.Parent]; !found {
+			r.add(IssueOrphan, entityDepartment, d.ID, "parent", d.Parent,
+				"department %q refers to non-existent parent %q", d.ID, d.Parent)
+		}
+	}
+	validateDepartmentTree(r, snap.depts, depts)
+
+	users := map[string]bool{}
+	for _, u := range snap.users {
+		if u.ID == "" {
+			r.add(IssueMissingField, entityUser, "", "id", "", "user %q has empty id", u.Name)
+			continue
+		}
+		if u.Name == "" {
+			r.add(IssueMissingField, entityUser, u.ID, "name", "", "user %q has empty name", u.ID)
+		}
+		if users[u.ID] {
+			r.add(IssueDuplicateID, entityUser, u.ID, "id", "", "duplicate user id %q", u.ID)
+		}
+		users[u.ID] = true
+
+		if u.MainDepartmentID == "" {
+			r.add(IssueMissingField, entityUser, u.ID, "main_department", "",
+				"user %q has empty main department", u.ID)
+		} else if _, found := depts[u.MainDepartmentID]; !found {
+			r.add(IssueOrphan, entityUser, u.ID, "main_department", u.MainDepartmentID,
+				"user %q refers to non-existent main department %q", u.ID, u.MainDepartmentID)
+		}
+		for _, other := range u.OtherDepartmentsID {
+			if _, found := depts[other]; !found {
+				r.add(IssueOrphan, entityUser, u.ID, "other_departments", other,
+					"user %q refers to non-existent department %q", u.ID, other)
+			}
+		}
+	}
+
+	groups := map[string]bool{}
+	for _, g := range snap.groups {
+		if g.ID == "" {
+			r.add(IssueMissingField, entityGroup, "", "id", "", "group %q has empty id", g.Name)
+			continue
+		}
+		if g.Name == "" {
+			r.add(IssueMissingField, entityGroup, g.ID, "name", "", "group %q has empty name", g.ID)
+		}
+		if groups[g.ID] {
+			r.add(IssueDuplicateID, entityGroup, g.ID, "id", "", "duplicate group id %q", g.ID)
+		}
+		groups[g.ID] = true
+	}
+
+	for _, m := range snap.groupMembers {
+		if m.ID == "" {
+			r.add(IssueMissingField, entityGroupMember, "", "id", "", "group membership has empty group id")
+			continue
+		}
+		if !groups[m.ID] {
+			r.add(IssueOrphan, entityGroupMember, m.ID, "id", m.ID,
+				"group membership refers to non-existent group %q", m.ID)
+		}
+		for _, member := range m.Members {
+			if !users[member] {
+				r.add(IssueDanglingMember, entityGroupMember, m.ID, "members", member,
+					"group %q refers to non-existent user %q", m.ID, member)
+			}
+		}
+	}
+
+	return r
+}
+
+// validateDepartmentTree 检查部门树中的环, 每个环只报告一次
+func validateDepartmentTree(r *ValidationReport, list []*spec.Department, depts map[string]*spec.Department) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := map[string]int{}
+	for _, d := range list {
+		if d.ID == "" || state[d.ID] != unvisited {
+			continue
+		}
+
+		// 沿parent向上查找, 直到根部门、不存在的部门或已经检查过的部门
+		path := []string{}
+		id := d.ID
+		for id != "" && state[id] == unvisited {
+			parent, found := depts[id]
+			if !found {
+				break
+			}
+			state[id] = visiting
+			path = append(path, id)
+			id = parent.Parent
+		}
+
+		if id != "" && state[id] == visiting {
+			start := 0
+			for path[start] != id {
+				start++
+			}
+			cycle := path[start:]
+			r.add(IssueCycle, entityDepartment, id, "parent", strings.Join(cycle, ","),
+				"department tree has a cycle: %s -> %s", strings.Join(cycle, " -> "), id)
+		}
+
+		for _, p := range path {
+			state[p] = done
+		}
+	}
+}
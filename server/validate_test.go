@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+
+	spec "github.com/idaaser/syncspecv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValidateContactFiles(t *testing.T) {
+	report, err := ValidateContactFiles(
+		"./testdata/departments.json",
+		"./testdata/users.json",
+		"./testdata/groups.json",
+		"./testdata/group-users.json",
+	)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Issues)
+	assert.Equal(t, 11, report.Departments)
+}
+
+func Test_validateContacts(t *testing.T) {
+	snap := &contactsSnapshot{
+		depts: []*spec.Department{
+			{ID: "1", Name: "root"},
+			{ID: "2", Parent: "3", Name: "a"},
+			{ID: "3", Parent: "2", Name: "b"},
+			{ID: "4", Parent: "404", Name: "orphan"},
+			{ID: "1", Name: "duplicate"},
+		},
+		users: []*spec.User{
+			{ID: "u1", Name: "u1", MainDepartmentID: "1"},
+			{ID: "u2", MainDepartmentID: "404", OtherDepartmentsID: []string{"1", "405"}},
+		},
+		groups: []*spec.Group{
+			{ID: "g1", Name: "g1"},
+		},
+		groupMembers: []*groupMembership{
+			{ID: "g1", Members: []string{"u1", "u404"}},
+			{ID: "g404", Members: []string{}},
+		},
+	}
+
+	report := validateContacts(snap)
+	kinds := map[IssueKind][]string{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind] = append(kinds[issue.Kind], issue.Entity+":"+issue.ID+":"+issue.Ref)
+	}
+
+	assert.Equal(t, []string{"department:1:"}, kinds[IssueDuplicateID])
+	assert.Equal(t, []string{"user:u2:"}, kinds[IssueMissingField])
+	assert.Equal(t, []string{"department:2:2,3"}, kinds[IssueCycle])
+	assert.Equal(t, []string{"department:4:404", "user:u2:404", "user:u2:405", "group_member:g404:g404"},
+		kinds[IssueOrphan])
+	assert.Equal(t, []string{"group_member:g1:u404"}, kinds[IssueDanglingMember])
+
+	assert.Error(t, &ValidationError{Report: report})
+}
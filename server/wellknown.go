@@ -7,9 +7,27 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// wellknown 在spec.Wellknown的基础上, 增加了可选接口的地址
+type wellknown struct {
+	spec.Wellknown
+
+	// 校验access_token的公钥, 仅当AuthnStore支持时返回
+	JWKSURI string `json:"jwks_uri,omitempty"`
+	// /token等接口支持的client鉴权方式
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	// 撤销access_token以及查询access_token状态的接口, 仅当AuthnStore支持时返回
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+	// 增量同步接口, 仅当ContactStore支持时返回
+	ChangesEndpoint string `json:"changes_endpoint,omitempty"`
+	// 获取上级部门的接口, 仅当ContactStore支持部门树查询时返回
+	DeptAncestorsEndpoint string `json:"dept_ancestors_endpoint,omitempty"`
+}
+
 func (s *Server) wellknown(c echo.Context) error {
 	u := strings.TrimSuffix(c.Request().URL.String(), ".well-known")
-	w := spec.Wellknown{
+	w := wellknown{}
+	w.Wellknown = spec.Wellknown{
 		TokenEndpoint:            s.absoluteURL(c, u, "token"),
 		ListUsersInDeptEndpoint:  s.absoluteURL(c, u, "users"),
 		SearchUserEndpoint:       s.absoluteURL(c, u, "users/search"),
@@ -19,6 +37,20 @@ func (s *Server) wellknown(c echo.Context) error {
 		SearchGroupEndpoint:      s.absoluteURL(c, u, "groups/search"),
 		ListUsersInGroupEndpoint: s.absoluteURL(c, u, "groups/users"),
 	}
+	w.TokenEndpointAuthMethods = s.authMethods()
+	if _, ok := s.clients.(JWKSProvider); ok {
+		w.JWKSURI = s.absoluteURL(c, u, "jwks.json")
+	}
+	if _, ok := s.clients.(RevocableAuthnStore); ok {
+		w.RevocationEndpoint = s.absoluteURL(c, u, "token/revoke")
+		w.IntrospectionEndpoint = s.absoluteURL(c, u, "token/introspect")
+	}
+	if _, ok := s.getContactStore(c).(ChangeFeedStore); ok {
+		w.ChangesEndpoint = s.absoluteURL(c, u, "changes")
+	}
+	if _, ok := s.getContactStore(c).(DepartmentTreeStore); ok {
+		w.DeptAncestorsEndpoint = s.absoluteURL(c, u, "depts/ancestors")
+	}
 
 	return c.JSON(200, w)
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/idaaser/syncdemov1/server"
+)
+
+// validate 校验通讯录文件, 以JSON格式输出校验结果.
+// 返回进程退出码: 0 校验通过, 1 发现问题, 2 文件无法加载或参数错误
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	dept := fs.String("dept", deptFile, "departments file")
+	user := fs.String("user", userFile, "users file")
+	group := fs.String("group", groupFile, "groups file")
+	groupMembers := fs.String("group-users", groupMemberFile, "group memberships file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := server.ValidateContactFiles(*dept, *user, *group, *groupMembers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}